@@ -77,15 +77,22 @@ func main() {
 	<form id="userForm">
 		<label>Name: <input type="text" id="name" required /></label>
 		<label>Email: <input type="email" id="email" required /></label>
+		<label>Password (12+ characters): <input type="password" id="password" minlength="12" required /></label>
 		<button type="submit">Create User</button>
 	</form>
 	<pre id="userResponse"></pre>
 
+	<h2>Log In</h2>
+	<form id="loginForm">
+		<label>Email: <input type="email" id="loginEmail" required /></label>
+		<label>Password: <input type="password" id="loginPassword" required /></label>
+		<button type="submit">Log In</button>
+		<button type="button" id="logoutBtn">Log Out</button>
+	</form>
+	<pre id="loginStatus"></pre>
+
 	<h2>Place an Order</h2>
 	<form id="orderForm">
-		<label>User:
-			<select id="user_id"></select>
-		</label>
 		<label>Product:
 			<select id="product_id"></select>
 		</label>
@@ -101,30 +108,43 @@ func main() {
 	<pre id="ordersList"></pre>
 
 <script>
-	async function loadUsers() {
-		const res = await fetch("http://localhost:8080/users");
-		const users = await res.json();
-		const userSelect = document.getElementById("user_id");
-		userSelect.innerHTML = "";
+	const api = "http://localhost:8080";
 
-		users.forEach(u => {
-			const option = document.createElement("option");
-			option.value = u.id;
-			option.textContent = u.name + " (" + u.email + ")";
-			userSelect.appendChild(option);
-		});
+	// The login token and user live in sessionStorage so a reload keeps
+	// you logged in but closing the tab doesn't.
+	function session() {
+		return JSON.parse(sessionStorage.getItem("session") || "null");
+	}
+
+	function authHeaders() {
+		const s = session();
+		return s ? { "Authorization": "Bearer " + s.token } : {};
+	}
+
+	function showSession() {
+		const s = session();
+		document.getElementById("loginStatus").textContent = s
+			? "Logged in as " + s.user.name + " (" + s.user.email + ")"
+			: "Not logged in";
+	}
+
+	async function show(res, elementId) {
+		const text = await res.text();
+		let out = text;
+		try { out = JSON.stringify(JSON.parse(text), null, 2); } catch (e) {}
+		document.getElementById(elementId).textContent = res.status + " " + out;
 	}
 
 	async function loadProducts() {
-		const res = await fetch("http://localhost:8080/products");
-		const products = await res.json();
+		const res = await fetch(api + "/products?limit=100&sort=name");
+		const products = (await res.json()).items;
 		const select = document.getElementById("product_id");
 		select.innerHTML = "";
 
 		products.forEach(p => {
 			const option = document.createElement("option");
 			option.value = p.id;
-			option.textContent = p.name + " ($" + p.price + ")";
+			option.textContent = p.name + " (" + p.price + " " + p.currency + ")";
 			select.appendChild(option);
 		});
 	}
@@ -134,43 +154,66 @@ func main() {
 
 		const name = document.getElementById("name").value;
 		const email = document.getElementById("email").value;
+		const password = document.getElementById("password").value;
 
-		const res = await fetch("http://localhost:8080/users", {
+		const res = await fetch(api + "/users", {
 			method: "POST",
 			headers: { "Content-Type": "application/json" },
-			body: JSON.stringify({ name, email })
+			body: JSON.stringify({ name, email, password })
 		});
+		await show(res, "userResponse");
+	});
 
+	document.getElementById("loginForm").addEventListener("submit", async function(e) {
+		e.preventDefault();
+
+		const email = document.getElementById("loginEmail").value;
+		const password = document.getElementById("loginPassword").value;
+
+		const res = await fetch(api + "/auth/login", {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ email, password })
+		});
+		if (!res.ok) {
+			await show(res, "loginStatus");
+			return;
+		}
 		const data = await res.json();
-		document.getElementById("userResponse").textContent = JSON.stringify(data, null, 2);
+		sessionStorage.setItem("session", JSON.stringify({ token: data.token, user: data.user }));
+		showSession();
+	});
 
-		await loadUsers();
+	document.getElementById("logoutBtn").addEventListener("click", () => {
+		sessionStorage.removeItem("session");
+		showSession();
 	});
 
 	document.getElementById("orderForm").addEventListener("submit", async function(e) {
 		e.preventDefault();
 
-		const user_id = Number(document.getElementById("user_id").value);
+		const s = session();
+		if (!s) {
+			document.getElementById("orderResponse").textContent = "Log in to place an order";
+			return;
+		}
 		const product_id = Number(document.getElementById("product_id").value);
 		const quantity = Number(document.getElementById("quantity").value);
 
-		const res = await fetch("http://localhost:8080/orders", {
+		const res = await fetch(api + "/orders", {
 			method: "POST",
-			headers: { "Content-Type": "application/json" },
-			body: JSON.stringify({ user_id, product_id, quantity })
+			headers: { "Content-Type": "application/json", ...authHeaders() },
+			body: JSON.stringify({ user_id: s.user.id, product_id, quantity })
 		});
-
-		const data = await res.json();
-		document.getElementById("orderResponse").textContent = JSON.stringify(data, null, 2);
+		await show(res, "orderResponse");
 	});
 
 	document.getElementById("loadOrdersBtn").addEventListener("click", async () => {
-		const res = await fetch("http://localhost:8080/orders");
-		const data = await res.json();
-		document.getElementById("ordersList").textContent = JSON.stringify(data, null, 2);
+		const res = await fetch(api + "/orders", { headers: authHeaders() });
+		await show(res, "ordersList");
 	});
 
-	loadUsers();
+	showSession();
 	loadProducts();
 </script>
 </body>
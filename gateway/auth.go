@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// identityHeaders carry the verified caller to backends. Clients can't set
+// them: the gateway deletes whatever a request arrives with before
+// (maybe) filling them in from a valid token, so backends can trust them.
+// X-Service-Name is only ever set by one backend calling another.
+const (
+	headerUserID      = "X-User-ID"
+	headerUserEmail   = "X-User-Email"
+	headerUserRoles   = "X-User-Roles"
+	headerServiceName = "X-Service-Name"
+)
+
+var identityHeaders = []string{headerUserID, headerUserEmail, headerUserRoles, headerServiceName}
+
+// JWKS refresh policy: keys are refetched every jwksMaxAge, and sooner
+// when a token names a key we don't have (userservice just rotated), but
+// never more than once per jwksMinRefresh so junk tokens can't make us
+// hammer userservice.
+const (
+	tokenIssuer    = "userservice"
+	clockSkew      = 30 * time.Second
+	jwksMaxAge     = 5 * time.Minute
+	jwksMinRefresh = 10 * time.Second
+)
+
+var (
+	errNoToken      = errors.New("no bearer token")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// route is one path the gateway proxies (see routes.go for the file they
+// come from). Methods limits what may be sent to it (any, if empty), and
+// PublicMethods is what may be called without a token ("*" for all).
+type route struct {
+	Pattern       string         `json:"pattern"`
+	Upstream      string         `json:"upstream"`
+	Target        string         `json:"-"` // the upstream's URL
+	Rewrite       *prefixRewrite `json:"rewrite,omitempty"`
+	Methods       []string       `json:"methods,omitempty"`
+	PublicMethods []string       `json:"public_methods,omitempty"`
+	Timeout       duration       `json:"timeout,omitempty"`
+}
+
+func (rt route) isPublic(method string) bool {
+	return slices.Contains(rt.PublicMethods, "*") || slices.Contains(rt.PublicMethods, method)
+}
+
+// claims are the parts of userservice's tokens the gateway uses.
+type claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat"`
+}
+
+// verifier checks tokens against the keys userservice publishes.
+type verifier struct {
+	jwksURL string
+	client  *http.Client
+	now     func() time.Time
+
+	mu          sync.Mutex
+	keys        map[string]ed25519.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+func newVerifier(jwksURL string) *verifier {
+	return &verifier{
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		now:     time.Now,
+		keys:    map[string]ed25519.PublicKey{},
+	}
+}
+
+// key returns the public key with the given ID, refreshing the key set if
+// it's stale or doesn't have it.
+func (v *verifier) key(kid string) (ed25519.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := v.now()
+	key, ok := v.keys[kid]
+	if (!ok || now.Sub(v.fetchedAt) > jwksMaxAge) && now.Sub(v.attemptedAt) >= jwksMinRefresh {
+		v.attemptedAt = now
+		if keys, err := v.fetchKeys(); err == nil {
+			v.keys, v.fetchedAt = keys, now
+			key, ok = keys[kid]
+		} else if !ok {
+			return nil, err
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidToken, kid)
+	}
+	return key, nil
+}
+
+func (v *verifier) fetchKeys() (map[string]ed25519.PublicKey, error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			KeyID   string `json:"kid"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]ed25519.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.KeyType != "OKP" || k.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.KeyID] = ed25519.PublicKey(x)
+	}
+	return keys, nil
+}
+
+// verify checks token's signature, issuer and lifetime, returning its
+// claims.
+func (v *verifier) verify(token string) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims{}, errInvalidToken
+	}
+	enc := base64.RawURLEncoding
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil || header.Alg != "EdDSA" {
+		return claims{}, errInvalidToken
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return claims{}, err
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), sig) {
+		return claims{}, errInvalidToken
+	}
+
+	var c claims
+	raw, err = enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &c) != nil {
+		return claims{}, errInvalidToken
+	}
+	now := v.now()
+	if c.Issuer != tokenIssuer || c.Subject == "" ||
+		now.After(time.Unix(c.ExpiresAt, 0).Add(clockSkew)) ||
+		now.Add(clockSkew).Before(time.Unix(c.IssuedAt, 0)) {
+		return claims{}, errInvalidToken
+	}
+	return c, nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, error) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return "", errNoToken
+	}
+	scheme, token, ok := strings.Cut(h, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errInvalidToken
+	}
+	return token, nil
+}
+
+// authenticate wraps a route's proxy. Identity headers from the client are
+// always dropped. A request with a valid token is forwarded with the
+// caller's identity; one without a token only gets through to the
+// route's public methods, and one with a bad token never does.
+func authenticate(v *verifier, rt route, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range identityHeaders {
+			r.Header.Del(h)
+		}
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+
+		token, err := bearerToken(r)
+		if errors.Is(err, errNoToken) && rt.isPublic(r.Method) {
+			next(w, r)
+			return
+		}
+		var c claims
+		if err == nil {
+			c, err = v.verify(token)
+		}
+		if err != nil && !errors.Is(err, errNoToken) && !errors.Is(err, errInvalidToken) {
+			// We couldn't get userservice's keys, so we can't tell.
+			setCORSHeaders(w)
+			http.Error(w, "Unable to verify token", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			setCORSHeaders(w)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-microservice"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		r.Header.Set(headerUserID, c.Subject)
+		r.Header.Set(headerUserEmail, c.Email)
+		if len(c.Roles) > 0 {
+			r.Header.Set(headerUserRoles, strings.Join(c.Roles, ","))
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeIssuer stands in for userservice: it signs tokens and serves the
+// JWKS for its keys.
+type fakeIssuer struct {
+	mu      sync.Mutex
+	keys    map[string]ed25519.PrivateKey
+	fetches atomic.Int32
+	srv     *httptest.Server
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	f := &fakeIssuer{keys: map[string]ed25519.PrivateKey{}}
+	f.addKey("k1")
+	f.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.fetches.Add(1)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var set struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		for kid, priv := range f.keys {
+			set.Keys = append(set.Keys, map[string]string{
+				"kty": "OKP", "crv": "Ed25519", "kid": kid,
+				"x": base64.RawURLEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeIssuer) addKey(kid string) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	f.mu.Lock()
+	f.keys[kid] = priv
+	f.mu.Unlock()
+}
+
+func (f *fakeIssuer) sign(kid string, c claims) string {
+	f.mu.Lock()
+	priv := f.keys[kid]
+	f.mu.Unlock()
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(c)
+	input := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	return input + "." + enc.EncodeToString(ed25519.Sign(priv, []byte(input)))
+}
+
+func validClaims() claims {
+	now := time.Now()
+	return claims{Issuer: tokenIssuer, Subject: "7", Email: "ada@example.com", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}
+}
+
+// echoBackend records the identity headers of the last request it saw.
+func echoBackend(t *testing.T) (*httptest.Server, *http.Header) {
+	t.Helper()
+	var seen http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &seen
+}
+
+func doRequest(h http.HandlerFunc, method, token string, extra map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/orders", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range extra {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestAuthenticateForwardsVerifiedIdentity(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	backend, seen := echoBackend(t)
+	h := authenticate(newVerifier(issuer.srv.URL), route{Pattern: "/orders", Target: backend.URL}, proxyHandler(route{Target: backend.URL}))
+
+	rec := doRequest(h, http.MethodGet, issuer.sign("k1", validClaims()), map[string]string{headerUserID: "1", headerUserRoles: "admin"})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if seen.Get(headerUserID) != "7" || seen.Get(headerUserEmail) != "ada@example.com" {
+		t.Errorf("expected identity from the token, backend saw %q/%q", seen.Get(headerUserID), seen.Get(headerUserEmail))
+	}
+	if seen.Get(headerUserRoles) != "" {
+		t.Errorf("client-supplied roles must be dropped, backend saw %q", seen.Get(headerUserRoles))
+	}
+
+	withRoles := validClaims()
+	withRoles.Roles = []string{"admin", "support"}
+	doRequest(h, http.MethodGet, issuer.sign("k1", withRoles), nil)
+	if seen.Get(headerUserRoles) != "admin,support" {
+		t.Errorf("expected the token's roles to be forwarded, backend saw %q", seen.Get(headerUserRoles))
+	}
+}
+
+func TestAuthenticateRejects(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	other := newFakeIssuer(t) // same kid, different key
+
+	expired := validClaims()
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	wrongIssuer := validClaims()
+	wrongIssuer.Issuer = "someone-else"
+
+	tests := map[string]string{
+		"no token":         "",
+		"garbage":          "not.a.token",
+		"expired":          issuer.sign("k1", expired),
+		"wrong issuer":     issuer.sign("k1", wrongIssuer),
+		"forged signature": other.sign("k1", validClaims()),
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			backend, seen := echoBackend(t)
+			h := authenticate(newVerifier(issuer.srv.URL), route{Pattern: "/orders", Target: backend.URL}, proxyHandler(route{Target: backend.URL}))
+
+			rec := doRequest(h, http.MethodGet, token, nil)
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("expected 401, got %d", rec.Code)
+			}
+			if rec.Header().Get("WWW-Authenticate") == "" || rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+				t.Errorf("expected WWW-Authenticate and CORS headers, got %v", rec.Header())
+			}
+			if *seen != nil {
+				t.Error("rejected request reached the backend")
+			}
+		})
+	}
+}
+
+func TestAuthenticatePublicMethods(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	backend, seen := echoBackend(t)
+	rt := route{Pattern: "/products", Target: backend.URL, PublicMethods: []string{"GET"}}
+	h := authenticate(newVerifier(issuer.srv.URL), rt, proxyHandler(route{Target: backend.URL}))
+
+	rec := doRequest(h, http.MethodGet, "", map[string]string{headerUserID: "1", headerUserEmail: "spoof@example.com", headerServiceName: "orderservice"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected anonymous GET to pass, got %d", rec.Code)
+	}
+	if seen.Get(headerUserID) != "" || seen.Get(headerUserEmail) != "" || seen.Get(headerServiceName) != "" {
+		t.Errorf("client-supplied identity headers must be stripped, backend saw %v", *seen)
+	}
+
+	if rec := doRequest(h, http.MethodPost, "", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected anonymous POST to need a token, got %d", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodGet, "junk", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("a bad token is refused even on a public method, got %d", rec.Code)
+	}
+	if rec := doRequest(h, http.MethodOptions, "", nil); rec.Code != http.StatusOK {
+		t.Errorf("expected preflight to skip auth, got %d", rec.Code)
+	}
+}
+
+func TestVerifierPicksUpRotatedKeys(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	v := newVerifier(issuer.srv.URL)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	if _, err := v.verify(issuer.sign("k1", validClaims())); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if _, err := v.verify(issuer.sign("k1", validClaims())); err != nil || issuer.fetches.Load() != 1 {
+		t.Fatalf("expected the key set to be cached, got %v after %d fetches", err, issuer.fetches.Load())
+	}
+
+	// userservice rotates: the new key is fetched on first sight.
+	issuer.addKey("k2")
+	now = now.Add(jwksMinRefresh)
+	if _, err := v.verify(issuer.sign("k2", validClaims())); err != nil {
+		t.Fatalf("expected the rotated key to be fetched, got %v", err)
+	}
+
+	// Unknown keys don't trigger a refetch more than once per jwksMinRefresh.
+	stranger := &fakeIssuer{keys: map[string]ed25519.PrivateKey{}}
+	stranger.addKey("k9")
+	now = now.Add(jwksMinRefresh)
+	fetches := issuer.fetches.Load()
+	for i := 0; i < 5; i++ {
+		if _, err := v.verify(stranger.sign("k9", validClaims())); err == nil {
+			t.Fatal("expected a token from an unknown key to be refused")
+		}
+	}
+	if issuer.fetches.Load() != fetches+1 {
+		t.Errorf("expected one refresh for unknown keys, got %d", issuer.fetches.Load()-fetches)
+	}
+}
+
+func TestAuthenticateKeysUnavailable(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	token := issuer.sign("k1", validClaims())
+	backend, _ := echoBackend(t)
+	h := authenticate(newVerifier("http://127.0.0.1:1"), route{Pattern: "/orders", Target: backend.URL}, proxyHandler(route{Target: backend.URL}))
+
+	if rec := doRequest(h, http.MethodGet, token, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when keys can't be fetched, got %d", rec.Code)
+	}
+}
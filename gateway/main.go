@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -21,27 +24,62 @@ func envOr(key, fallback string) string {
 	return fallback
 }
 
-func proxyHandler(target string) http.HandlerFunc {
-	url, err := url.Parse(target)
+// proxyHandler forwards requests for rt to its upstream, after rewriting
+// the path prefix if rt says to. An upstream that doesn't answer within
+// rt's timeout gets the client a 504; one that can't be reached, a 502.
+func proxyHandler(rt route) http.HandlerFunc {
+	target, err := url.Parse(rt.Target)
 	if err != nil {
 		log.Fatalf("Failed to parse target URL: %v", err)
 	}
-	proxy := httputil.NewSingleHostReverseProxy(url)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	if rt.Rewrite != nil {
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			r.URL.Path = rt.Rewrite.apply(r.URL.Path)
+			r.URL.RawPath = ""
+			director(r)
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("http: proxy error: %v", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	timeout := time.Duration(rt.Timeout)
+	if timeout == 0 {
+		timeout = defaultRouteTimeout
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		setCORSHeaders(w)
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
+		if len(rt.Methods) > 0 && !slices.Contains(rt.Methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(rt.Methods, ", "))
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-		proxy.ServeHTTP(w, r)
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		proxy.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+func setCORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, If-Match, If-None-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
+}
+
 // healthzHandler: the gateway has no dependencies of its own to check
 // (a backend being down is that backend's problem, reported per-request
 // as 502), so healthy just means alive and serving.
@@ -50,28 +88,38 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+// newRouter serves /healthz and proxies each route, behind authenticate.
+func newRouter(routes []route, tokens *verifier) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	for _, rt := range routes {
+		mux.HandleFunc(rt.Pattern, authenticate(tokens, rt, proxyHandler(rt)))
+	}
+	return mux
+}
+
 func main() {
-	productURL := envOr("PRODUCT_SERVICE_URL", "http://productservice:8081")
-	orderURL := envOr("ORDER_SERVICE_URL", "http://orderservice:8082")
 	userURL := envOr("USER_SERVICE_URL", "http://userservice:8083")
+	tokens := newVerifier(userURL + "/.well-known/jwks.json")
 
-	http.HandleFunc("/healthz", healthzHandler)
-	http.HandleFunc("/products", proxyHandler(productURL))
-	http.HandleFunc("/products/", proxyHandler(productURL))
-
-	http.HandleFunc("/orders", proxyHandler(orderURL))
-	http.HandleFunc("/orders/", proxyHandler(orderURL))
-
-	http.HandleFunc("/users", proxyHandler(userURL))
-	http.HandleFunc("/users/", proxyHandler(userURL))
+	// The routes come from a file (see routes.go), reloaded on SIGHUP or
+	// when it changes.
+	routesPath := envOr("GATEWAY_ROUTES", "routes.json")
+	routes, err := newRouteTable(routesPath, tokens)
+	if err != nil {
+		log.Fatalf("Failed to load routes from %s: %v", routesPath, err)
+	}
+	go routes.watch(context.Background())
 
 	log.Println("API Gateway listening on port 8080")
 	// WriteTimeout is generous because the gateway waits on downstream
 	// services: an order creation can legitimately take several seconds
 	// while orderservice calls its neighbors. An upstream's patience must
-	// exceed its downstreams' worst case.
+	// exceed its downstreams' worst case, and this must exceed every
+	// route's timeout.
 	server := &http.Server{
 		Addr:         ":8080",
+		Handler:      routes,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 30 * time.Second,
 	}
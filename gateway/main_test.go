@@ -16,7 +16,7 @@ func TestProxyForwardsToBackend(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	handler := proxyHandler(backend.URL)
+	handler := proxyHandler(route{Target: backend.URL})
 	req := httptest.NewRequest(http.MethodGet, "/products", nil)
 	rec := httptest.NewRecorder()
 	handler(rec, req)
@@ -34,7 +34,7 @@ func TestProxySetsCORSHeaders(t *testing.T) {
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 	defer backend.Close()
 
-	handler := proxyHandler(backend.URL)
+	handler := proxyHandler(route{Target: backend.URL})
 	req := httptest.NewRequest(http.MethodGet, "/products", nil)
 	rec := httptest.NewRecorder()
 	handler(rec, req)
@@ -54,7 +54,7 @@ func TestProxyPreflightSkipsBackend(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	handler := proxyHandler(backend.URL)
+	handler := proxyHandler(route{Target: backend.URL})
 	req := httptest.NewRequest(http.MethodOptions, "/products", nil)
 	rec := httptest.NewRecorder()
 	handler(rec, req)
@@ -75,7 +75,7 @@ func TestProxyBackendUnreachable(t *testing.T) {
 
 	// Port 1 is reserved and nothing listens there, so the proxy's error
 	// handler should answer with 502 rather than hanging or panicking.
-	handler := proxyHandler("http://127.0.0.1:1")
+	handler := proxyHandler(route{Target: "http://127.0.0.1:1"})
 	req := httptest.NewRequest(http.MethodGet, "/products", nil)
 	rec := httptest.NewRecorder()
 	handler(rec, req)
@@ -94,3 +94,40 @@ func TestHealthz(t *testing.T) {
 		t.Errorf("expected 200, got %d", rec.Code)
 	}
 }
+
+func TestRouterSendsOrderHistoryToOrderService(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	named := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	routes := shippedRoutes(t, map[string]string{
+		"productservice": named("products").URL,
+		"orderservice":   named("orders").URL,
+		"userservice":    named("users").URL,
+		"paymentservice": named("payments").URL,
+	})
+	router := newRouter(routes, newVerifier(issuer.srv.URL))
+	token := issuer.sign("k1", validClaims())
+
+	for path, want := range map[string]string{
+		"/users/7/orders": "orders",
+		"/users/7":        "users",
+		"/users/7/roles":  "users",
+		"/orders/1":       "orders",
+		"/payments/1":     "payments",
+		"/webhooks/1":     "orders",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if body, _ := io.ReadAll(rec.Body); string(body) != want {
+			t.Errorf("%s: expected it to reach %s, got %d %q", path, want, rec.Code, body)
+		}
+	}
+}
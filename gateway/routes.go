@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Route timeouts bound how long the gateway waits on an upstream for one
+// request. The server's WriteTimeout (see main) must stay above
+// maxRouteTimeout, or the connection is cut before the 504 can be sent.
+const (
+	defaultRouteTimeout = 20 * time.Second
+	maxRouteTimeout     = 25 * time.Second
+	// routesPollInterval is how often the route file is checked for
+	// changes. Polling keeps the gateway free of dependencies and also
+	// catches a Kubernetes ConfigMap's symlink swap, which file watchers
+	// tend to miss.
+	routesPollInterval = 2 * time.Second
+)
+
+// httpMethods are the methods a route can list.
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// routeConfig is the route file: named upstreams, and the routes to
+// them, in JSON. See routes.json for the one compose runs with.
+type routeConfig struct {
+	Upstreams map[string]string `json:"upstreams"`
+	Routes    []route           `json:"routes"`
+}
+
+// prefixRewrite replaces a leading From in the request path with To
+// before it's proxied, so "/api/v1/orders/5" can reach an upstream as
+// "/orders/5".
+type prefixRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (p *prefixRewrite) apply(path string) string {
+	rest, ok := strings.CutPrefix(path, p.From)
+	if !ok {
+		return path
+	}
+	out := strings.TrimSuffix(p.To, "/") + rest
+	if !strings.HasPrefix(out, "/") {
+		out = "/" + out
+	}
+	return out
+}
+
+// duration is a time.Duration written as a string like "10s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New(`timeout must be a string like "10s"`)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("timeout: %w", err)
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// parseRouteConfig decodes a route file. Unknown fields are an error, so
+// a misspelt key doesn't silently do nothing.
+func parseRouteConfig(data []byte) (routeConfig, error) {
+	var cfg routeConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return routeConfig{}, fmt.Errorf("invalid route file: %w", err)
+	}
+	return cfg, nil
+}
+
+// build validates the config and returns its routes, each with Target
+// set to its upstream's URL.
+func (cfg routeConfig) build() ([]route, error) {
+	for name, target := range cfg.Upstreams {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("upstream %q: %q is not an absolute http or https URL", name, target)
+		}
+	}
+	if len(cfg.Routes) == 0 {
+		return nil, errors.New("no routes")
+	}
+
+	seen := map[string]bool{}
+	routes := make([]route, 0, len(cfg.Routes))
+	for i, rt := range cfg.Routes {
+		where := fmt.Sprintf("route %d (%s)", i, rt.Pattern)
+		if !strings.HasPrefix(rt.Pattern, "/") || strings.ContainsAny(rt.Pattern, " \t") {
+			return nil, fmt.Errorf("%s: pattern must be a path starting with /", where)
+		}
+		if seen[rt.Pattern] {
+			return nil, fmt.Errorf("%s: pattern is listed twice", where)
+		}
+		seen[rt.Pattern] = true
+
+		target, ok := cfg.Upstreams[rt.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown upstream %q", where, rt.Upstream)
+		}
+		rt.Target = target
+
+		for _, m := range rt.Methods {
+			if !slices.Contains(httpMethods, m) {
+				return nil, fmt.Errorf("%s: unknown method %q", where, m)
+			}
+		}
+		for _, m := range rt.PublicMethods {
+			if m != "*" && !slices.Contains(httpMethods, m) {
+				return nil, fmt.Errorf("%s: unknown public method %q", where, m)
+			}
+		}
+		if rt.Rewrite != nil {
+			if !strings.HasPrefix(rt.Rewrite.From, "/") || !strings.HasPrefix(rt.Rewrite.To, "/") {
+				return nil, fmt.Errorf("%s: rewrite from and to must start with /", where)
+			}
+			if !strings.HasPrefix(rt.Pattern, rt.Rewrite.From) {
+				return nil, fmt.Errorf("%s: rewrite from %q isn't a prefix of the pattern", where, rt.Rewrite.From)
+			}
+		}
+		if rt.Timeout < 0 || time.Duration(rt.Timeout) > maxRouteTimeout {
+			return nil, fmt.Errorf("%s: timeout must be between 0 and %s", where, maxRouteTimeout)
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+// loadRoutes reads, decodes and validates the route file at path.
+func loadRoutes(path string) ([]route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseRouteConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.build()
+}
+
+// buildRouter is newRouter, with a pattern ServeMux won't take (such as
+// one that conflicts with another) reported as an error instead of a
+// panic.
+func buildRouter(routes []route, tokens *verifier) (mux *http.ServeMux, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	return newRouter(routes, tokens), nil
+}
+
+// routeTable is the gateway's handler. It serves each request through
+// the router built from the route file, and swaps in a new one when the
+// file changes. A request keeps the router it started with, so a reload
+// never cuts one off; a file that doesn't validate is logged and the
+// routes in use are kept.
+type routeTable struct {
+	path   string
+	tokens *verifier
+
+	current atomic.Pointer[http.ServeMux]
+
+	mu      sync.Mutex // serializes reloads
+	modTime time.Time
+	size    int64
+}
+
+// newRouteTable loads the route file at path. Unlike a reload, a bad file
+// here is an error: there are no routes to fall back on.
+func newRouteTable(path string, tokens *verifier) (*routeTable, error) {
+	t := &routeTable{path: path, tokens: tokens}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *routeTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t.current.Load().ServeHTTP(w, r)
+}
+
+// reload builds a router from the route file and, if it's valid, starts
+// serving through it.
+func (t *routeTable) reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	// Noted even if this version is bad, so it's only reported once.
+	t.modTime, t.size = info.ModTime(), info.Size()
+
+	routes, err := loadRoutes(t.path)
+	if err != nil {
+		return err
+	}
+	mux, err := buildRouter(routes, t.tokens)
+	if err != nil {
+		return err
+	}
+	t.current.Store(mux)
+	return nil
+}
+
+// changed reports whether the route file looks different from the one
+// last loaded.
+func (t *routeTable) changed() bool {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !info.ModTime().Equal(t.modTime) || info.Size() != t.size
+}
+
+// watch reloads the routes on SIGHUP, and when the file changes, until
+// ctx is done.
+func (t *routeTable) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(routesPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			t.reloadAndLog("SIGHUP")
+		case <-ticker.C:
+			if t.changed() {
+				t.reloadAndLog("file changed")
+			}
+		}
+	}
+}
+
+func (t *routeTable) reloadAndLog(why string) {
+	if err := t.reload(); err != nil {
+		log.Printf("routes: keeping current routes, %s failed to load (%s): %v", t.path, why, err)
+		return
+	}
+	log.Printf("routes: reloaded %s (%s)", t.path, why)
+}
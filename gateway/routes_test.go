@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// shippedRoutes builds the routes in routes.json, with the upstreams
+// pointed at the given URLs.
+func shippedRoutes(t *testing.T, upstreams map[string]string) []route {
+	t.Helper()
+	data, err := os.ReadFile("routes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseRouteConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Upstreams = upstreams
+	routes, err := cfg.build()
+	if err != nil {
+		t.Fatalf("routes.json doesn't validate: %v", err)
+	}
+	return routes
+}
+
+// writeRoutes writes a route file to path with the given routes, all to
+// one upstream.
+func writeRoutes(t *testing.T, path, upstream, routes string) {
+	t.Helper()
+	data := `{"upstreams": {"svc": "` + upstream + `"}, "routes": [` + routes + `]}`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShippedRoutesValidate(t *testing.T) {
+	routes, err := loadRoutes("routes.json")
+	if err != nil {
+		t.Fatalf("routes.json doesn't validate: %v", err)
+	}
+	if _, err := buildRouter(routes, newVerifier("http://127.0.0.1:1")); err != nil {
+		t.Fatalf("routes.json doesn't make a router: %v", err)
+	}
+}
+
+func TestRouteConfigValidation(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file string
+		want string
+	}{
+		"unknown field":    {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "/a", "upstream": "svc", "timout": "1s"}]}`, "unknown field"},
+		"bad upstream URL": {`{"upstreams": {"svc": "svc:8080"}, "routes": [{"pattern": "/a", "upstream": "svc"}]}`, "not an absolute"},
+		"no routes":        {`{"upstreams": {"svc": "http://svc"}, "routes": []}`, "no routes"},
+		"relative pattern": {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "a", "upstream": "svc"}]}`, "must be a path"},
+		"duplicate":        {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "/a", "upstream": "svc"}, {"pattern": "/a", "upstream": "svc"}]}`, "listed twice"},
+		"unknown upstream": {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "/a", "upstream": "other"}]}`, `unknown upstream "other"`},
+		"unknown method":   {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "/a", "upstream": "svc", "methods": ["get"]}]}`, `unknown method "get"`},
+		"rewrite mismatch": {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "/a", "upstream": "svc", "rewrite": {"from": "/b", "to": "/"}}]}`, "isn't a prefix"},
+		"bad timeout":      {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "/a", "upstream": "svc", "timeout": 5}]}`, "string like"},
+		"timeout too long": {`{"upstreams": {"svc": "http://svc"}, "routes": [{"pattern": "/a", "upstream": "svc", "timeout": "1m"}]}`, "between 0 and"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := parseRouteConfig([]byte(tc.file))
+			if err == nil {
+				_, err = cfg.build()
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected an error containing %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestProxyRewritesPrefix(t *testing.T) {
+	var gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer backend.Close()
+
+	handler := proxyHandler(route{Target: backend.URL, Rewrite: &prefixRewrite{From: "/api/v1/", To: "/"}})
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/orders/5", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if gotPath != "/orders/5" {
+		t.Errorf("expected the upstream to see /orders/5, got %q", gotPath)
+	}
+}
+
+func TestProxyRouteTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	handler := proxyHandler(route{Target: backend.URL, Timeout: duration(20 * time.Millisecond)})
+	req := httptest.NewRequest(http.MethodGet, "/products", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504, got %d", rec.Code)
+	}
+}
+
+func TestProxyRejectsUnlistedMethods(t *testing.T) {
+	called := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer backend.Close()
+
+	handler := proxyHandler(route{Target: backend.URL, Methods: []string{"GET", "POST"}})
+	req := httptest.NewRequest(http.MethodDelete, "/orders", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("expected Allow: GET, POST, got %q", allow)
+	}
+	if called {
+		t.Error("expected the upstream not to be called")
+	}
+}
+
+// get sends a public GET through the route table and returns the body.
+func get(t *testing.T, h http.Handler, path string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestRouteTableReloadsChangedFile(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes(t, path, backend.URL, `{"pattern": "/a", "upstream": "svc", "public_methods": ["*"]}`)
+
+	table, err := newRouteTable(path, newVerifier("http://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get(t, table, "/b"); code != http.StatusNotFound {
+		t.Fatalf("expected /b to be unrouted, got %d", code)
+	}
+
+	writeRoutes(t, path, backend.URL, `{"pattern": "/b", "upstream": "svc", "methods": ["GET"], "public_methods": ["*"]}`)
+	if !table.changed() {
+		t.Fatal("expected the file to be seen as changed")
+	}
+	if err := table.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if table.changed() {
+		t.Error("expected no change right after a reload")
+	}
+	if code, body := get(t, table, "/b"); code != http.StatusOK || body != "/b" {
+		t.Errorf("expected /b to be routed after the reload, got %d %q", code, body)
+	}
+}
+
+func TestRouteTableKeepsRoutesWhenFileIsBad(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes(t, path, backend.URL, `{"pattern": "/a", "upstream": "svc", "public_methods": ["*"]}`)
+
+	table, err := newRouteTable(path, newVerifier("http://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, routes := range map[string]string{
+		"invalid":     `{"pattern": "/a", "upstream": "nope"}`,
+		"conflicting": `{"pattern": "/x/{id}", "upstream": "svc"}, {"pattern": "/{id}/x", "upstream": "svc"}`,
+	} {
+		writeRoutes(t, path, backend.URL, routes)
+		if err := table.reload(); err == nil {
+			t.Errorf("%s: expected the reload to fail", name)
+		}
+		if code, _ := get(t, table, "/a"); code != http.StatusOK {
+			t.Errorf("%s: expected the old routes to be kept, got %d for /a", name, code)
+		}
+	}
+
+	os.WriteFile(path, []byte("{"), 0o644)
+	if _, err := newRouteTable(path, newVerifier("http://127.0.0.1:1")); err == nil {
+		t.Error("expected a bad file to fail at startup")
+	}
+}
+
+func TestRouteTableReloadsOnSIGHUP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes(t, path, backend.URL, `{"pattern": "/a", "upstream": "svc", "public_methods": ["*"]}`)
+
+	table, err := newRouteTable(path, newVerifier("http://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Until watch has subscribed, a SIGHUP would kill the test binary, so
+	// hold one subscription open for the whole test.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go table.watch(ctx)
+
+	writeRoutes(t, path, backend.URL, `{"pattern": "/b", "upstream": "svc", "public_methods": ["*"]}`)
+	// watch may not have subscribed yet, so keep signalling until it has.
+	deadline := time.Now().Add(time.Second)
+	for {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+		if code, _ := get(t, table, "/b"); code == http.StatusOK {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected /b to be routed after SIGHUP")
+		}
+	}
+}
+
+func TestReloadKeepsInFlightRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		io.WriteString(w, "done")
+	}))
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "routes.json")
+	writeRoutes(t, path, backend.URL, `{"pattern": "/slow", "upstream": "svc", "public_methods": ["*"]}`)
+
+	table, err := newRouteTable(path, newVerifier("http://127.0.0.1:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		code int
+		body string
+	}
+	done := make(chan result)
+	go func() {
+		rec := httptest.NewRecorder()
+		table.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		done <- result{rec.Code, rec.Body.String()}
+	}()
+	<-started
+
+	// The route the request came in on is gone once this reload is done.
+	writeRoutes(t, path, backend.URL, `{"pattern": "/fast", "upstream": "svc", "public_methods": ["*"]}`)
+	if err := table.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get(t, table, "/slow"); code != http.StatusNotFound {
+		t.Errorf("expected new requests to /slow to be unrouted, got %d", code)
+	}
+	close(release)
+
+	if res := <-done; res.code != http.StatusOK || res.body != "done" {
+		t.Errorf("expected the in-flight request to finish, got %d %q", res.code, res.body)
+	}
+}
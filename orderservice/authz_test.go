@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shared/authz"
+)
+
+// seedOrderFor stores an order belonging to userID.
+func seedOrderFor(t *testing.T, userID int) Order {
+	t.Helper()
+	order := seedOrder(t, 1, 1, 2000, 0)
+	if err := db.Model(&order).Update("user_id", userID).Error; err != nil {
+		t.Fatalf("failed to set owner: %v", err)
+	}
+	order.UserID = userID
+	return order
+}
+
+func TestOrdersRequireIdentity(t *testing.T) {
+	setupTestDB(t)
+
+	for _, header := range []string{"", "abc", "0"} {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if header != "" {
+			req.Header.Set(authz.HeaderUserID, header)
+		}
+		rec := httptest.NewRecorder()
+		ordersRouter(rec, req)
+
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("X-User-ID %q: expected 401, got %d", header, rec.Code)
+		}
+	}
+}
+
+func TestGetOrdersListsOnlyCallersOrders(t *testing.T) {
+	setupTestDB(t)
+	seedOrderFor(t, 1)
+	seedOrderFor(t, 2)
+	seedOrderFor(t, 1)
+
+	list := func(req *http.Request) []Order {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		ordersRouter(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		var page orderPage
+		json.NewDecoder(rec.Body).Decode(&page)
+		return page.Items
+	}
+
+	mine := list(asUser(httptest.NewRequest(http.MethodGet, "/orders", nil), 2))
+	if len(mine) != 1 || mine[0].UserID != 2 {
+		t.Errorf("expected only user 2's order, got %+v", mine)
+	}
+	all := list(asUser(httptest.NewRequest(http.MethodGet, "/orders", nil), 2, authz.RoleAdmin))
+	if len(all) != 3 {
+		t.Errorf("expected an admin to see all 3 orders, got %d", len(all))
+	}
+}
+
+func TestOtherUsersOrderIsForbidden(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	order := seedOrderFor(t, 1)
+	path := fmt.Sprintf("/orders/%d", order.ID)
+
+	tests := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, path, ""},
+		{http.MethodPut, path, `{"product_id":2,"quantity":1}`},
+		{http.MethodDelete, path, ""},
+		{http.MethodGet, path + "/transitions", ""},
+		{http.MethodPost, path + "/transitions", `{"status":"cancelled"}`},
+	}
+	for _, tt := range tests {
+		req := asUser(httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)), 2)
+		rec := httptest.NewRecorder()
+		ordersRouter(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected 403, got %d", tt.method, tt.path, rec.Code)
+		}
+	}
+
+	var stored Order
+	db.First(&stored, order.ID)
+	if stored.Status != statusPending {
+		t.Errorf("forbidden requests must not change the order, status is %s", stored.Status)
+	}
+
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, path, nil), 2, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected an admin to read any order, got %d", rec.Code)
+	}
+}
+
+func TestCreateOrderUsesCaller(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"product_id":2,"quantity":1}`)), 2)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var order Order
+	json.NewDecoder(rec.Body).Decode(&order)
+	if order.UserID != 2 {
+		t.Errorf("expected user_id to default to the caller, got %d", order.UserID)
+	}
+
+	req = asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"user_id":1,"product_id":2,"quantity":1}`)), 2)
+	rec = httptest.NewRecorder()
+	ordersRouter(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 ordering for another user, got %d", rec.Code)
+	}
+
+	req = asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"user_id":1,"product_id":2,"quantity":1}`)), 2, authz.RoleAdmin)
+	rec = httptest.NewRecorder()
+	ordersRouter(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected an admin to order for another user, got %d", rec.Code)
+	}
+}
+
+func TestOwnerCanOnlyCancel(t *testing.T) {
+	setupTestDB(t)
+	setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+	order := seedOrderFor(t, 1)
+
+	transition := func(status string) int {
+		body := strings.NewReader(fmt.Sprintf(`{"status":%q}`, status))
+		req := asUser(httptest.NewRequest(http.MethodPost, fmt.Sprintf("/orders/%d/transitions", order.ID), body), 1)
+		rec := httptest.NewRecorder()
+		ordersRouter(rec, req)
+		return rec.Code
+	}
+
+	if code := transition(statusShipped); code != http.StatusForbidden {
+		t.Errorf("expected an owner marking their order shipped to get 403, got %d", code)
+	}
+	if code := transition(statusCancelled); code != http.StatusOK {
+		t.Errorf("expected an owner to cancel their order, got %d", code)
+	}
+}
+
+func TestIdempotencyKeyIsScopedToCaller(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	body := `{"product_id":2,"quantity":1}`
+
+	if rec := postOrderWithKey(t, "shared", body); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+
+	// Another user who picks the same key places their own order, and
+	// never sees the first user's response.
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)), 2)
+	req.Header.Set("Idempotency-Key", "shared")
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("expected another user's order to be placed, not replayed; got %d: %s", rec.Code, rec.Body.String())
+	}
+	var order Order
+	json.NewDecoder(rec.Body).Decode(&order)
+	if order.ID != 2 || order.UserID != 2 {
+		t.Errorf("expected user 2's own order, got %+v", order)
+	}
+
+	// Each user's retry still replays their own response.
+	if rec := postOrderWithKey(t, "shared", body); rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected user 1's retry to be replayed, got %d", rec.Code)
+	}
+}
+
+func TestAuthorizeUnlistedRoutes(t *testing.T) {
+	setupTestDB(t)
+
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodPatch, "/orders/1", nil), 1))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for a listed path with another method, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, "/orders/1/items/2", nil), 1))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unlisted path, got %d", rec.Code)
+	}
+}
+
+func TestAuthorizeChecksRoles(t *testing.T) {
+	setupTestDB(t)
+	seedOrderFor(t, 1)
+
+	tests := []struct {
+		name   string
+		roles  []string
+		method string
+		path   string
+		want   int
+	}{
+		{"customer lists orders", []string{authz.RoleCustomer}, http.MethodGet, "/orders", http.StatusOK},
+		{"no roles", []string{"none"}, http.MethodGet, "/orders", http.StatusForbidden},
+		{"catalog admin", []string{authz.RoleCatalogAdmin}, http.MethodGet, "/orders/1", http.StatusForbidden},
+		{"support reads any order", []string{authz.RoleSupport}, http.MethodGet, "/orders/1", http.StatusOK},
+		{"support can't delete", []string{authz.RoleSupport}, http.MethodDelete, "/orders/1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ordersRouter(rec, asUser(httptest.NewRequest(tt.method, tt.path, nil), 2, tt.roles...))
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
+
+func TestProductEventsNeedServiceCaller(t *testing.T) {
+	handler := authz.Authorize(permissions, productEventsHandler)
+	body := `{"type":"product.updated","product_id":2}`
+
+	rec := httptest.NewRecorder()
+	handler(rec, asUser(httptest.NewRequest(http.MethodPost, "/product-events", strings.NewReader(body)), 1, authz.RoleAdmin))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected a user to get 403, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/product-events", strings.NewReader(body))
+	req.Header.Set(authz.HeaderServiceName, "productservice")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected productservice to be let in, got %d", rec.Code)
+	}
+}
+
+func TestOutgoingCallsIdentifyService(t *testing.T) {
+	var seen string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(authz.HeaderServiceName)
+	}))
+	defer srv.Close()
+
+	resp, err := testClient().Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seen != serviceName {
+		t.Errorf("expected %s=%s, got %q", authz.HeaderServiceName, serviceName, seen)
+	}
+}
+
+func TestDependenciesNeedAdminOrService(t *testing.T) {
+	handler := authz.Authorize(permissions, dependenciesHandler)
+	get := func(req *http.Request) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	newReq := func() *http.Request { return httptest.NewRequest(http.MethodGet, "/debug/dependencies", nil) }
+
+	if code := get(newReq()); code != http.StatusUnauthorized {
+		t.Errorf("expected an anonymous caller to get 401, got %d", code)
+	}
+	for _, role := range []string{authz.RoleCustomer, authz.RoleSupport} {
+		if code := get(asUser(newReq(), 1, role)); code != http.StatusForbidden {
+			t.Errorf("expected %s to get 403, got %d", role, code)
+		}
+	}
+	if code := get(asUser(newReq(), 1, authz.RoleAdmin)); code != http.StatusOK {
+		t.Errorf("expected an admin to be let in, got %d", code)
+	}
+	req := newReq()
+	req.Header.Set(authz.HeaderServiceName, "ops")
+	if code := get(req); code != http.StatusOK {
+		t.Errorf("expected a service to be let in, got %d", code)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"shared/authz"
+)
+
+const (
+	// idempotencyKeyTTL is how long a key is remembered; a retry after
+	// that is treated as a new request.
+	idempotencyKeyTTL = 24 * time.Hour
+
+	// idempotencyLockTimeout is how long a key may sit claimed without a
+	// stored response before we assume the request that claimed it died.
+	// It comfortably exceeds the server's WriteTimeout.
+	idempotencyLockTimeout = time.Minute
+
+	maxIdempotencyKeyLen = 255
+)
+
+// IdempotencyKey maps to the "idempotency_keys" table. It remembers the
+// response to a request made with an Idempotency-Key header so a retry can
+// be answered without repeating its side effects. Keys are per user:
+// UserID is who sent it (zero for a service). StatusCode is zero while the
+// first request is still being handled.
+type IdempotencyKey struct {
+	UserID      int    `gorm:"primaryKey;autoIncrement:false"`
+	Key         string `gorm:"column:idempotency_key;primaryKey;size:255"`
+	Fingerprint string `gorm:"size:64;not null"`
+	StatusCode  int    `gorm:"not null;default:0"`
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time `gorm:"index"`
+}
+
+// withIdempotency makes a handler safe to retry. A request with an
+// Idempotency-Key header runs once; identical retries get the stored
+// response replayed, a retry with a different body gets 422, and a retry
+// while the original is still running gets 409. Server errors aren't
+// stored, so a retry after a 5xx runs again.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		userID := authz.RequestCaller(r).UserID
+		fingerprint := requestFingerprint(r.Method, r.URL.Path, body)
+		stored, claimed, err := claimIdempotencyKey(userID, key, fingerprint)
+		if err != nil {
+			http.Error(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			switch {
+			case stored.Fingerprint != fingerprint:
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			case stored.StatusCode == 0:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				if stored.ContentType != "" {
+					w.Header().Set("Content-Type", stored.ContentType)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		rec := &capturingWriter{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if rec.status >= 500 {
+			db.Delete(&IdempotencyKey{}, "user_id = ? AND idempotency_key = ?", userID, key)
+			return
+		}
+		db.Model(&IdempotencyKey{}).Where("user_id = ? AND idempotency_key = ?", userID, key).Updates(map[string]any{
+			"status_code":  rec.status,
+			"content_type": w.Header().Get("Content-Type"),
+			"body":         rec.body.Bytes(),
+		})
+	}
+}
+
+// requestFingerprint identifies what a request asks for, so a key reused
+// for a different request can be told apart from a genuine retry.
+func requestFingerprint(method, path string, body []byte) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %s\n%s", method, path, body)))
+	return hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey records userID's key as in progress. If the user
+// has already used the key it returns the stored row instead, unless that row has expired or
+// was abandoned mid-request, in which case the key is taken over.
+func claimIdempotencyKey(userID int, key, fingerprint string) (IdempotencyKey, bool, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		row := IdempotencyKey{UserID: userID, Key: key, Fingerprint: fingerprint}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&row)
+		if result.Error != nil {
+			return IdempotencyKey{}, false, result.Error
+		}
+		if result.RowsAffected == 1 {
+			return row, true, nil
+		}
+
+		var stored IdempotencyKey
+		err := db.Where("user_id = ? AND idempotency_key = ?", userID, key).First(&stored).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue // deleted in between; try to claim again
+		}
+		if err != nil {
+			return IdempotencyKey{}, false, err
+		}
+
+		age := time.Since(stored.CreatedAt)
+		abandoned := stored.StatusCode == 0 && age > idempotencyLockTimeout
+		if age <= idempotencyKeyTTL && !abandoned {
+			return stored, false, nil
+		}
+		// Only delete the exact row we looked at, so two retries racing to
+		// take over can't both win.
+		db.Where("user_id = ? AND idempotency_key = ? AND created_at = ?", userID, key, stored.CreatedAt).Delete(&IdempotencyKey{})
+	}
+	return IdempotencyKey{}, false, errors.New("could not claim idempotency key")
+}
+
+// purgeIdempotencyKeys deletes expired keys once an hour so the table
+// doesn't grow without bound.
+func purgeIdempotencyKeys() {
+	for range time.Tick(time.Hour) {
+		db.Where("created_at < ?", time.Now().Add(-idempotencyKeyTTL)).Delete(&IdempotencyKey{})
+	}
+}
+
+// capturingWriter passes a response through while keeping a copy of its
+// status and body.
+type capturingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturingWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *capturingWriter) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
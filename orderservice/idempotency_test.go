@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postOrderWithKey(t *testing.T, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)), 1)
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+	return rec
+}
+
+func countOrders(t *testing.T) int64 {
+	t.Helper()
+	var count int64
+	db.Model(&Order{}).Count(&count)
+	return count
+}
+
+func TestIdempotentRetryReplaysResponse(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	body := `{"user_id":1,"product_id":2,"quantity":3}`
+
+	first := postOrderWithKey(t, "retry-1", body)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", first.Code, first.Body.String())
+	}
+	second := postOrderWithKey(t, "retry-1", body)
+	if second.Code != http.StatusCreated {
+		t.Fatalf("expected replayed 201, got %d", second.Code)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("expected identical body, got %q vs %q", second.Body.String(), first.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("expected replayed response to be marked")
+	}
+	if second.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected stored content type, got %q", second.Header().Get("Content-Type"))
+	}
+	if n := countOrders(t); n != 1 {
+		t.Errorf("expected 1 order, got %d", n)
+	}
+	if len(inv.reserved) != 1 {
+		t.Errorf("expected stock reserved once, got %v", inv.reserved)
+	}
+}
+
+func TestIdempotencyKeyReusedWithDifferentBody(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+
+	postOrderWithKey(t, "reuse", `{"user_id":1,"product_id":2,"quantity":3}`)
+	rec := postOrderWithKey(t, "reuse", `{"user_id":1,"product_id":2,"quantity":4}`)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d", rec.Code)
+	}
+	if n := countOrders(t); n != 1 {
+		t.Errorf("expected 1 order, got %d", n)
+	}
+}
+
+func TestIdempotencyKeyInProgress(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	body := `{"user_id":1,"product_id":2,"quantity":3}`
+
+	// Claim the key as a concurrent first attempt would.
+	if _, claimed, err := claimIdempotencyKey(1, "busy", requestFingerprint(http.MethodPost, "/orders", []byte(body))); err != nil || !claimed {
+		t.Fatalf("failed to claim key: claimed=%v err=%v", claimed, err)
+	}
+
+	rec := postOrderWithKey(t, "busy", body)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", rec.Code)
+	}
+
+	// Once the claim is old enough to have been abandoned, a retry runs.
+	db.Model(&IdempotencyKey{}).Where("idempotency_key = ?", "busy").
+		Update("created_at", time.Now().Add(-2*idempotencyLockTimeout))
+	rec = postOrderWithKey(t, "busy", body)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected abandoned key to be taken over, got %d", rec.Code)
+	}
+}
+
+func TestIdempotencyServerErrorIsNotStored(t *testing.T) {
+	setupTestDB(t)
+	setFakeBackends(t,
+		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
+		http.StatusServiceUnavailable, `down`,
+	)
+	body := `{"user_id":1,"product_id":2,"quantity":3}`
+
+	rec := postOrderWithKey(t, "flaky", body)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 while productservice is down, got %d", rec.Code)
+	}
+
+	setFakeCatalog(t, testCatalog)
+	rec = postOrderWithKey(t, "flaky", body)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected retry after a 5xx to run again, got %d", rec.Code)
+	}
+}
+
+func TestOrdersWithoutKeyAreNotDeduplicated(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+
+	postOrder(t, `{"user_id":1,"product_id":2,"quantity":3}`)
+	postOrder(t, `{"user_id":1,"product_id":2,"quantity":3}`)
+
+	if n := countOrders(t); n != 2 {
+		t.Errorf("expected 2 orders, got %d", n)
+	}
+}
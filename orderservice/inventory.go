@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Reservation is productservice's hold on stock for one order line.
+type Reservation struct {
+	ID        int    `json:"id"`
+	ProductID int    `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	Status    string `json:"status"`
+}
+
+// errInsufficientStock means productservice refused a reservation because
+// fewer units are available than were asked for.
+var errInsufficientStock = errors.New("insufficient stock")
+
+// reserveStock asks productservice to hold quantity units of a product.
+// The units stay held until commitReservation or releaseReservation.
+func reserveStock(ctx context.Context, productID, quantity int) (Reservation, error) {
+	url := fmt.Sprintf("%s/products/%d/reservations", productServiceURL, productID)
+	payload, _ := json.Marshal(map[string]int{"quantity": quantity})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return Reservation{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := productClient.Do(req)
+	if err != nil {
+		return Reservation{}, fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return Reservation{}, errInsufficientStock
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return Reservation{}, fmt.Errorf("product service returned status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Reservation{}, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	var reservation Reservation
+	if err := json.Unmarshal(body, &reservation); err != nil {
+		return Reservation{}, fmt.Errorf("error unmarshalling reservation JSON: %w", err)
+	}
+	return reservation, nil
+}
+
+// commitReservation turns a stock hold into a sale.
+func commitReservation(ctx context.Context, productID, reservationID int) error {
+	return settleReservation(ctx, productID, reservationID, "commit")
+}
+
+// releaseReservation returns reserved (or committed) units to stock, for
+// orders that failed to save or were later changed or deleted.
+func releaseReservation(ctx context.Context, productID, reservationID int) error {
+	return settleReservation(ctx, productID, reservationID, "release")
+}
+
+func settleReservation(ctx context.Context, productID, reservationID int, action string) error {
+	url := fmt.Sprintf("%s/products/%d/reservations/%d/%s", productServiceURL, productID, reservationID, action)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := productClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("product service returned status: %s", resp.Status)
+	}
+	return nil
+}
+
+// writeReservationError reports a failed reserveStock call to the client.
+func writeReservationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInsufficientStock) {
+		http.Error(w, "Insufficient stock", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		http.Error(w, "Product service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Failed to reserve stock: "+err.Error(), http.StatusInternalServerError)
+}
+
+// releaseStockOrLog releases a reservation on a path that has already
+// decided its response, so a failure can only be logged. The release goes
+// ahead even if ctx's request has been cancelled: a client hanging up
+// mustn't leave the units held.
+func releaseStockOrLog(ctx context.Context, productID, reservationID int) {
+	if err := releaseReservation(context.WithoutCancel(ctx), productID, reservationID); err != nil {
+		log.Printf("failed to release reservation %d for product %d: %v", reservationID, productID, err)
+	}
+}
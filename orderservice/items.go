@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"shared/money"
+)
+
+// maxOrderItems caps the lines in one order; each line costs a product
+// lookup and a stock reservation.
+const maxOrderItems = 50
+
+// OrderItem maps to the "order_items" table: one product line of an order.
+// ProductName and UnitPrice are snapshots taken when the line was priced,
+// so later catalog changes don't alter what the customer was charged (or
+// what the invoice says they bought). ReservationID is productservice's
+// stock reservation for the line.
+type OrderItem struct {
+	ID            int         `json:"id" gorm:"primaryKey"`
+	OrderID       int         `json:"-" gorm:"index;not null"`
+	ProductID     int         `json:"product_id" gorm:"not null"`
+	ProductName   string      `json:"product_name"`
+	Quantity      int         `json:"quantity" gorm:"not null"`
+	UnitPrice     money.Money `json:"unit_price" gorm:"column:unit_price_minor;not null"`
+	LineTotal     money.Money `json:"line_total" gorm:"column:line_total_minor;not null"`
+	ReservationID int         `json:"-"`
+}
+
+// orderRequest is the body of POST /orders and PUT /orders/{id}: an items
+// array, or for clients of the original API a single product_id/quantity.
+// Reprice only applies to PUT; see updateOrderHandler.
+type orderRequest struct {
+	UserID    int           `json:"user_id"`
+	Items     []itemRequest `json:"items"`
+	ProductID int           `json:"product_id"`
+	Quantity  int           `json:"quantity"`
+	Reprice   bool          `json:"reprice"`
+}
+
+type itemRequest struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+// lines returns the requested order lines, folding the legacy single
+// product form into a one-item list. Errors are client-facing.
+func (req orderRequest) lines() ([]itemRequest, error) {
+	items := req.Items
+	if req.ProductID != 0 || req.Quantity != 0 {
+		if len(items) > 0 {
+			return nil, errors.New("Send either items or product_id/quantity, not both")
+		}
+		items = []itemRequest{{ProductID: req.ProductID, Quantity: req.Quantity}}
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("At least one item (ProductID and Quantity) is required")
+	}
+	if len(items) > maxOrderItems {
+		return nil, fmt.Errorf("An order can have at most %d items", maxOrderItems)
+	}
+
+	seen := make(map[int]bool, len(items))
+	for _, it := range items {
+		if it.ProductID == 0 || it.Quantity <= 0 {
+			return nil, errors.New("Every item needs a ProductID and a positive Quantity")
+		}
+		if seen[it.ProductID] {
+			return nil, fmt.Errorf("Product %d appears in more than one item", it.ProductID)
+		}
+		seen[it.ProductID] = true
+	}
+	return items, nil
+}
+
+// priceItems fills in each line's product name, unit price and line
+// total, returning the order total and currency. Lines for products that
+// already appear in snapshot (the order being updated, if any) keep the
+// name and price captured there; everything else is looked up in
+// productservice at its current price, all lines at once. On error, status
+// is the HTTP status to respond with.
+func priceItems(ctx context.Context, lines []itemRequest, snapshot *Order) (items []OrderItem, total money.Money, currency string, status int, err error) {
+	captured := make(map[int]OrderItem)
+	if snapshot != nil {
+		for _, it := range snapshot.Items {
+			captured[it.ProductID] = it
+		}
+	}
+
+	products := make([]Product, len(lines))
+	errs := make([]error, len(lines))
+	var wg sync.WaitGroup
+	for i, line := range lines {
+		if old, ok := captured[line.ProductID]; ok {
+			products[i] = Product{ID: old.ProductID, Name: old.ProductName, Price: old.UnitPrice, Currency: snapshot.Currency}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			products[i], errs[i] = getProduct(ctx, line.ProductID)
+		}()
+	}
+	wg.Wait()
+
+	items = make([]OrderItem, 0, len(lines))
+	for i, line := range lines {
+		product, err := products[i], errs[i]
+		if errors.Is(err, errCircuitOpen) {
+			return nil, 0, "", http.StatusServiceUnavailable, errors.New("Product service unavailable")
+		}
+		if err != nil {
+			return nil, 0, "", http.StatusInternalServerError, errors.New("Error fetching product details: " + err.Error())
+		}
+
+		code, _ := money.NormalizeCurrency(product.Currency)
+		if currency == "" {
+			currency = code
+		} else if code != currency {
+			return nil, 0, "", http.StatusBadRequest, errors.New("All items must be priced in the same currency")
+		}
+
+		lineTotal, err := product.Price.Mul(line.Quantity)
+		if err != nil || lineTotal+total < total {
+			return nil, 0, "", http.StatusBadRequest, errors.New("Order total is out of range")
+		}
+		total += lineTotal
+
+		items = append(items, OrderItem{
+			ProductID:   line.ProductID,
+			ProductName: product.Name,
+			Quantity:    line.Quantity,
+			UnitPrice:   product.Price,
+			LineTotal:   lineTotal,
+		})
+	}
+	return items, total, currency, 0, nil
+}
+
+// reserveItems reserves stock for every item. It's all or nothing: if any
+// line can't be reserved, the reservations made so far are released again.
+func reserveItems(ctx context.Context, items []OrderItem) error {
+	for i := range items {
+		reservation, err := reserveStock(ctx, items[i].ProductID, items[i].Quantity)
+		if err != nil {
+			releaseItems(ctx, items[:i])
+			for j := range items[:i] {
+				items[j].ReservationID = 0
+			}
+			return err
+		}
+		items[i].ReservationID = reservation.ID
+	}
+	return nil
+}
+
+// swapReservations gives the new items of an updated order their stock.
+// Lines that repeat an existing line (same product and quantity) take over
+// its reservation; the rest are reserved afresh and returned as added. The
+// existing lines not carried over are returned as replaced, for the caller
+// to release once the update is saved.
+func swapReservations(ctx context.Context, existing, items []OrderItem) (added, replaced []OrderItem, err error) {
+	carried := make(map[int]bool)
+	var freshIdx []int
+	for i := range items {
+		match := false
+		for _, old := range existing {
+			if !carried[old.ID] && old.ProductID == items[i].ProductID && old.Quantity == items[i].Quantity {
+				items[i].ReservationID = old.ReservationID
+				carried[old.ID] = true
+				match = true
+				break
+			}
+		}
+		if !match {
+			freshIdx = append(freshIdx, i)
+			added = append(added, items[i])
+		}
+	}
+
+	if err := reserveItems(ctx, added); err != nil {
+		return nil, nil, err
+	}
+	for j, i := range freshIdx {
+		items[i] = added[j]
+	}
+
+	for _, old := range existing {
+		if !carried[old.ID] {
+			replaced = append(replaced, old)
+		}
+	}
+	return added, replaced, nil
+}
+
+// commitItems confirms the stock reservations of a saved order. The order
+// is saved either way; a failed commit leaves units held rather than sold,
+// which is safe to reconcile later. Like releaseStockOrLog, it goes ahead
+// even if ctx's request has been cancelled.
+func commitItems(ctx context.Context, orderID int, items []OrderItem) {
+	ctx = context.WithoutCancel(ctx)
+	for _, it := range items {
+		if err := commitReservation(ctx, it.ProductID, it.ReservationID); err != nil {
+			log.Printf("order %d: failed to commit reservation %d: %v", orderID, it.ReservationID, err)
+		}
+	}
+}
+
+// releaseItems returns the items' reserved units to stock. Items from
+// orders placed before stock was tracked have no reservation to release.
+func releaseItems(ctx context.Context, items []OrderItem) {
+	for _, it := range items {
+		if it.ReservationID != 0 {
+			releaseStockOrLog(ctx, it.ProductID, it.ReservationID)
+		}
+	}
+}
+
+// setLegacyFields mirrors the only line of a single-item order into
+// ProductID and Quantity, the shape clients of the original API read.
+func (o *Order) setLegacyFields() {
+	o.ProductID, o.Quantity = 0, 0
+	if len(o.Items) == 1 {
+		o.ProductID, o.Quantity = o.Items[0].ProductID, o.Items[0].Quantity
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// setFakeCatalog points orderservice at a fake userservice that knows
+// every user and a fake productservice serving the given products by ID.
+func setFakeCatalog(t *testing.T, catalog map[int]string) *fakeInventory {
+	t.Helper()
+	useFreshClients(t)
+	inv := &fakeInventory{soldOut: map[int]bool{}}
+	users := fakeService(t, http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`)
+	products := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/reservations") {
+			inv.handle(w, r)
+			return
+		}
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/products/"))
+		body, ok := catalog[id]
+		if !ok {
+			http.Error(w, "Product not found", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	origUser, origProduct := userServiceURL, productServiceURL
+	userServiceURL, productServiceURL = users.URL, products.URL
+	t.Cleanup(func() {
+		userServiceURL, productServiceURL = origUser, origProduct
+		users.Close()
+		products.Close()
+	})
+	return inv
+}
+
+var testCatalog = map[int]string{
+	1: `{"id":1,"name":"Laptop","price":1300}`,
+	2: `{"id":2,"name":"Mouse","price":20}`,
+	3: `{"id":3,"name":"Keyboard","price":75.5}`,
+	9: `{"id":9,"name":"Euro Plug","price":5,"currency":"EUR"}`,
+}
+
+func postOrder(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body)), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+	return rec
+}
+
+func TestCreateMultiItemOrder(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+
+	rec := postOrder(t, `{"user_id":1,"items":[{"product_id":1,"quantity":1},{"product_id":3,"quantity":2}]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var order Order
+	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if order.Total != 145100 {
+		t.Errorf("expected total 1451.00 (1300 + 2 x 75.50), got %s", order.Total)
+	}
+	if len(order.Items) != 2 || order.Items[1].UnitPrice != 7550 || order.Items[1].LineTotal != 15100 {
+		t.Errorf("unexpected items %+v", order.Items)
+	}
+	if order.ProductID != 0 || order.Quantity != 0 {
+		t.Error("legacy fields should only be set on single-item orders")
+	}
+	if len(inv.reserved) != 2 || len(inv.committed) != 2 {
+		t.Errorf("expected a committed reservation per line, got reserved=%v committed=%v", inv.reserved, inv.committed)
+	}
+
+	// GET returns the stored items.
+	req := asUser(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/orders/%d", order.ID), nil), 1)
+	rec = httptest.NewRecorder()
+	ordersRouter(rec, req)
+	var fetched Order
+	json.NewDecoder(rec.Body).Decode(&fetched)
+	if len(fetched.Items) != 2 || fetched.Total != 145100 {
+		t.Errorf("expected stored order with 2 items, got %+v", fetched)
+	}
+}
+
+func TestCreateOrderLegacyPayloadMirrorsFields(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+
+	rec := postOrder(t, `{"user_id":1,"product_id":2,"quantity":3}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var order Order
+	json.NewDecoder(rec.Body).Decode(&order)
+	if order.ProductID != 2 || order.Quantity != 3 || len(order.Items) != 1 {
+		t.Errorf("expected legacy fields and one item, got %+v", order)
+	}
+}
+
+func TestCreateOrderItemValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"both shapes", `{"user_id":1,"product_id":2,"quantity":1,"items":[{"product_id":1,"quantity":1}]}`},
+		{"empty items", `{"user_id":1,"items":[]}`},
+		{"item without quantity", `{"user_id":1,"items":[{"product_id":1}]}`},
+		{"negative quantity", `{"user_id":1,"items":[{"product_id":1,"quantity":-2}]}`},
+		{"duplicate product", `{"user_id":1,"items":[{"product_id":1,"quantity":1},{"product_id":1,"quantity":2}]}`},
+		{"mixed currencies", `{"user_id":1,"items":[{"product_id":1,"quantity":1},{"product_id":9,"quantity":1}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			setFakeCatalog(t, testCatalog)
+
+			rec := postOrder(t, tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+// One unavailable line must not leave the other lines' stock held.
+func TestCreateMultiItemOrderOutOfStockReleasesOthers(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	inv.soldOut[3] = true
+
+	rec := postOrder(t, `{"user_id":1,"items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":1},{"product_id":3,"quantity":1}]}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rec.Code)
+	}
+	if len(inv.reserved) != 2 || len(inv.released) != 2 {
+		t.Errorf("expected both earlier reservations released, got reserved=%v released=%v", inv.reserved, inv.released)
+	}
+	var count int64
+	db.Model(&Order{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no order to be saved, got %d", count)
+	}
+}
+
+func TestUpdateOrderReplacesItems(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	order := seedOrder(t, 2, 1, 2000, 7)
+
+	body := strings.NewReader(`{"items":[{"product_id":2,"quantity":1},{"product_id":3,"quantity":4}]}`)
+	req := asUser(httptest.NewRequest(http.MethodPut, fmt.Sprintf("/orders/%d", order.ID), body), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stored Order
+	db.Preload("Items").First(&stored, order.ID)
+	if len(stored.Items) != 2 || stored.Total != 2000+4*7550 {
+		t.Errorf("expected 2 items totalling %d, got %+v", 2000+4*7550, stored)
+	}
+	// The unchanged mouse line keeps reservation 7; only the keyboard is new.
+	if len(inv.reserved) != 1 || inv.reserved[0] != 4 || len(inv.released) != 0 {
+		t.Errorf("expected only the new line reserved, got reserved=%v released=%v", inv.reserved, inv.released)
+	}
+	var itemCount int64
+	db.Model(&OrderItem{}).Count(&itemCount)
+	if itemCount != 2 {
+		t.Errorf("expected old item rows replaced, got %d rows", itemCount)
+	}
+}
+
+func TestDeleteMultiItemOrderReleasesAllStock(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	order := Order{UserID: 1, Currency: "USD", Items: []OrderItem{
+		{ProductID: 1, Quantity: 1, ReservationID: 11},
+		{ProductID: 2, Quantity: 2, ReservationID: 12},
+	}}
+	db.Create(&order)
+
+	req := asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/orders/%d", order.ID), nil), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if len(inv.released) != 2 {
+		t.Errorf("expected both reservations released, got %v", inv.released)
+	}
+	var itemCount int64
+	db.Model(&OrderItem{}).Count(&itemCount)
+	if itemCount != 2 {
+		t.Errorf("expected the soft-deleted order to keep its items, got %d", itemCount)
+	}
+}
+
+func TestCreateOrderCapturesProductSnapshot(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+
+	rec := postOrder(t, `{"user_id":1,"items":[{"product_id":3,"quantity":2}]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var item OrderItem
+	db.First(&item)
+	if item.ProductName != "Keyboard" || item.UnitPrice != 7550 {
+		t.Errorf("expected Keyboard at 75.50 captured, got %+v", item)
+	}
+}
+
+// putOrder sends PUT /orders/{id} and decodes the updated order.
+func putOrder(t *testing.T, id int, body string) Order {
+	t.Helper()
+	req := asUser(httptest.NewRequest(http.MethodPut, fmt.Sprintf("/orders/%d", id), strings.NewReader(body)), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var order Order
+	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return order
+}
+
+func TestUpdateOrderKeepsCapturedPrice(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	// Ordered when the mouse cost 15.00; the catalog now says 20.00.
+	order := seedOrder(t, 2, 1, 1500, 7)
+
+	updated := putOrder(t, order.ID, `{"items":[{"product_id":2,"quantity":2},{"product_id":3,"quantity":1}]}`)
+
+	if updated.Items[0].UnitPrice != 1500 {
+		t.Errorf("existing line should keep its captured price, got %s", updated.Items[0].UnitPrice)
+	}
+	if updated.Items[1].UnitPrice != 7550 || updated.Items[1].ProductName != "Keyboard" {
+		t.Errorf("new line should be priced from the catalog, got %+v", updated.Items[1])
+	}
+	if updated.Total != 2*1500+7550 {
+		t.Errorf("expected total %d, got %d", 2*1500+7550, updated.Total)
+	}
+}
+
+func TestUpdateOrderRepriceUsesCurrentPrices(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	order := seedOrder(t, 2, 1, 1500, 7)
+
+	updated := putOrder(t, order.ID, `{"product_id":2,"quantity":2,"reprice":true}`)
+
+	if updated.Items[0].UnitPrice != 2000 || updated.Items[0].ProductName != "Mouse" {
+		t.Errorf("expected line repriced to the current 20.00, got %+v", updated.Items[0])
+	}
+	if updated.Total != 4000 {
+		t.Errorf("expected total 4000, got %d", updated.Total)
+	}
+}
+
+func TestReservationsFollowTheRequestContext(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// A client that's gone gets no new holds...
+	items := []OrderItem{{ProductID: 2, Quantity: 1}}
+	if err := reserveItems(ctx, items); err == nil {
+		t.Error("expected reserving for a cancelled request to fail")
+	}
+	if len(inv.reserved) != 0 {
+		t.Errorf("expected nothing reserved, got %v", inv.reserved)
+	}
+
+	// ...but holds it already had are still let go.
+	releaseItems(ctx, []OrderItem{{ProductID: 2, Quantity: 1, ReservationID: 7}})
+	if len(inv.released) != 1 || inv.released[0] != 7 {
+		t.Errorf("expected reservation 7 released, got %v", inv.released)
+	}
+}
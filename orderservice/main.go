@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,22 +18,39 @@ import (
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"shared/authz"
+	"shared/migrate"
+	"shared/money"
 )
 
-// Order maps to the "orders" table.
+// Order maps to the "orders" table. Total is the sum of the items' line
+// totals, held in minor units of Currency (see money.Money). Status moves
+// through the lifecycle in orderTransitions.
 type Order struct {
-	ID        int     `json:"id" gorm:"primaryKey"`
-	UserID    int     `json:"user_id"`
-	ProductID int     `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Total     float64 `json:"total"`
+	ID     int    `json:"id" gorm:"primaryKey"`
+	UserID int    `json:"user_id" gorm:"index"`
+	Status string `json:"status" gorm:"size:20;not null;default:pending;index"`
+
+	// ProductID and Quantity mirror the line of a single-item order for
+	// clients of the original one-product API. They aren't stored.
+	ProductID int `json:"product_id,omitempty" gorm:"-"`
+	Quantity  int `json:"quantity,omitempty" gorm:"-"`
+
+	Items    []OrderItem `json:"items" gorm:"foreignKey:OrderID"`
+	Total    money.Money `json:"total" gorm:"column:total_minor;not null;default:0"`
+	Currency string      `json:"currency" gorm:"size:3;not null;default:USD"`
+
+	CreatedAt time.Time      `json:"created_at" gorm:"index"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"deleted_at,omitzero" gorm:"index"`
 }
 
 // Product and User are used to decode responses from the other services.
 type Product struct {
-	ID    int     `json:"id"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	ID       int         `json:"id"`
+	Name     string      `json:"name"`
+	Price    money.Money `json:"price"`
+	Currency string      `json:"currency"`
 }
 
 type User struct {
@@ -48,6 +66,7 @@ var db *gorm.DB
 var (
 	productServiceURL = envOr("PRODUCT_SERVICE_URL", "http://productservice:8081")
 	userServiceURL    = envOr("USER_SERVICE_URL", "http://userservice:8083")
+	paymentServiceURL = envOr("PAYMENT_SERVICE_URL", "http://paymentservice:8084")
 )
 
 func envOr(key, fallback string) string {
@@ -57,12 +76,13 @@ func envOr(key, fallback string) string {
 	return fallback
 }
 
-// httpClient is used for all calls to other services. The timeout keeps a
-// hung neighbor from stalling order requests indefinitely (the default
-// http.Client waits forever).
-var httpClient = &http.Client{Timeout: 5 * time.Second}
+// migrationFiles holds the versioned schema migrations (see shared/migrate).
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
 
-func initDB() {
+// openDB connects to the database named by the DB_* environment variables.
+func openDB() *gorm.DB {
 	dsn := fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
 		os.Getenv("DB_HOST"),
@@ -72,19 +92,27 @@ func initDB() {
 		os.Getenv("DB_PORT"),
 	)
 
-	var err error
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+	return conn
+}
 
-	if err := db.AutoMigrate(&Order{}); err != nil {
+func initDB() {
+	db = openDB()
+	if err := migrate.OnStartup(db, migrationFiles); err != nil {
 		log.Fatal("Failed to migrate database schema:", err)
 	}
 }
 
-// createOrderHandler handles POST /orders. It validates the user and product
-// against the other services, calculates the total, and saves the order.
+// createOrderHandler handles POST /orders. It validates the user and
+// products against the other services and prices each line, then places
+// the order with a saga (see saga.go) that reserves the stock, authorizes
+// payment and confirms it, undoing what it did if a step fails. Orders
+// for more units than are in stock get a 409, and declined payments a
+// 402. user_id defaults to the caller; only an admin may place an order
+// for someone else.
 func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -93,56 +121,151 @@ func createOrderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	var order Order
-	if err := json.Unmarshal(body, &order); err != nil {
+	var req orderRequest
+	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, "Error unmarshalling JSON", http.StatusBadRequest)
 		return
 	}
 
-	// IDs are assigned by the database, never by the client.
-	order.ID = 0
-
-	if order.UserID == 0 || order.ProductID == 0 || order.Quantity == 0 {
-		http.Error(w, "UserID, ProductID and Quantity are required", http.StatusBadRequest)
+	c := authz.RequestCaller(r)
+	if req.UserID == 0 {
+		req.UserID = c.UserID
+	}
+	if req.UserID != c.UserID && !c.HasRole(authz.RoleAdmin) {
+		http.Error(w, "Cannot place an order for another user", http.StatusForbidden)
 		return
 	}
-
-	_, err = getUser(order.UserID)
+	lines, err := req.lines()
 	if err != nil {
-		http.Error(w, "Invalid user: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	product, err := getProduct(order.ProductID)
+	// The user and the products are looked up at the same time. Both calls
+	// use the request's context, so a client that gives up cancels them.
+	ctx := r.Context()
+	var userErr error
+	userDone := make(chan struct{})
+	go func() {
+		defer close(userDone)
+		_, userErr = getUser(ctx, req.UserID)
+	}()
+	items, total, currency, status, err := priceItems(ctx, lines, nil)
+	<-userDone
+
+	if ctx.Err() != nil {
+		// Nobody is waiting for this response, but a 5xx keeps an
+		// Idempotency-Key free for the client's retry.
+		http.Error(w, "Request cancelled", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(userErr, errCircuitOpen) {
+		http.Error(w, "User service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if userErr != nil {
+		http.Error(w, "Invalid user: "+userErr.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error fetching product details: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	order.Total = product.Price * float64(order.Quantity)
+	// IDs are assigned by the database, never by the client.
+	order := Order{UserID: req.UserID, Status: statusPending, Items: items, Total: total, Currency: currency}
 
-	result := db.Create(&order)
-	if result.Error != nil {
+	p, err := startPlacement(&order)
+	if err != nil {
 		http.Error(w, "Failed to create order", http.StatusInternalServerError)
 		return
 	}
+	// From here the saga runs to the end even if the client goes away, so
+	// it's never left half done.
+	if step, err := p.run(context.WithoutCancel(ctx)); err != nil {
+		writePlacementError(w, step, err)
+		return
+	}
+	order.setLegacyFields()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(order)
 }
 
-// getOrdersHandler handles GET /orders.
+// getOrdersHandler handles GET /orders: the caller's own orders, or every
+// order for support and admins, who can narrow it down with user_id.
+// Results are filtered and paginated as described in parseOrderQuery.
 func getOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	var orders []Order
-	result := db.Find(&orders)
-	if result.Error != nil {
+	oq, err := parseOrderQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if c := authz.RequestCaller(r); !c.HasRole(authz.RoleSupport, authz.RoleAdmin) {
+		if oq.userID != 0 && oq.userID != c.UserID {
+			http.Error(w, "Cannot list another user's orders", http.StatusForbidden)
+			return
+		}
+		oq.userID = c.UserID
+	}
+	listOrders(w, r, oq)
+}
+
+// userOrdersHandler handles GET /users/{id}/orders: one user's order
+// history, with the same filters as GET /orders.
+func userOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/users/"), "/orders")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	oq, err := parseOrderQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	oq.userID = id
+	listOrders(w, r, oq)
+}
+
+// listOrders writes one page of the orders matching oq.
+func listOrders(w http.ResponseWriter, r *http.Request, oq orderQuery) {
+	scope, err := readScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	tx, err := oq.apply(scope.Model(&Order{}).Preload("Items"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orders := []Order{}
+	if err := tx.Find(&orders).Error; err != nil {
 		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
 		return
 	}
 
+	page := orderPage{
+		Items: orders,
+		Page:  pageInfo{Limit: oq.limit, Sort: oq.sort},
+	}
+	if len(orders) > oq.limit {
+		page.Items = orders[:oq.limit]
+		page.Page.HasMore = true
+		page.Page.NextCursor = oq.cursorAfter(page.Items[oq.limit-1])
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextPageURL(r.URL, page.Page.NextCursor)))
+	}
+	for i := range page.Items {
+		page.Items[i].setLegacyFields()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	json.NewEncoder(w).Encode(page)
 }
 
 // getOrderByIDHandler handles GET /orders/{id}.
@@ -153,9 +276,14 @@ func getOrderByIDHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid order ID", http.StatusBadRequest)
 		return
 	}
+	scope, err := readScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	var order Order
-	result := db.First(&order, id)
+	result := scope.Preload("Items").First(&order, id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			http.Error(w, "Order not found", http.StatusNotFound)
@@ -165,11 +293,22 @@ func getOrderByIDHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canViewOrder(authz.RequestCaller(r), order) {
+		http.Error(w, "Order belongs to another user", http.StatusForbidden)
+		return
+	}
+	order.setLegacyFields()
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(order)
 }
 
-// deleteOrderHandler handles DELETE /orders/{id}.
+// deleteOrderHandler handles DELETE /orders/{id}. Only pending and
+// cancelled orders can be deleted. A pending order is cancelled first, so
+// its reserved stock goes back on the shelf and its history shows why
+// (a cancelled one's stock already has). Deletes are soft: the order,
+// its items and its history stay for support to look at, and an admin
+// can restore it.
 func deleteOrderHandler(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/orders/")
 	id, err := strconv.Atoi(idStr)
@@ -178,20 +317,117 @@ func deleteOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result := db.Delete(&Order{}, id)
+	var order Order
+	result := db.Preload("Items").First(&order, id)
 	if result.Error != nil {
-		http.Error(w, "Failed to delete order", http.StatusInternalServerError)
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !canChangeOrder(authz.RequestCaller(r), order) {
+		http.Error(w, "Order belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	if !canDelete(order.Status) {
+		http.Error(w, fmt.Sprintf("Cannot delete an order that is %s", order.Status), http.StatusConflict)
+		return
+	}
+	if !checkPlaced(w, order.ID) {
+		return
+	}
+
+	wasPending := order.Status == statusPending
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if wasPending {
+			if err := transitionOrder(tx, &order, statusCancelled); err != nil {
+				return err
+			}
+		}
+		// Conditional on the status checked above, in case it just changed.
+		result := tx.Where("status = ?", order.Status).Delete(&Order{}, id)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidTransition
+		}
+		return recordOrderEvent(tx, eventOrderDeleted, order)
+	})
+	if errors.Is(err, errInvalidTransition) {
+		http.Error(w, "Order not found or changed status", http.StatusConflict)
 		return
 	}
-	if result.RowsAffected == 0 {
-		http.Error(w, "Order not found", http.StatusNotFound)
+	if err != nil {
+		http.Error(w, "Failed to delete order", http.StatusInternalServerError)
 		return
 	}
+	wakeOutboxRelay()
+
+	if wasPending {
+		releaseItems(r.Context(), order.Items)
+		voidPaymentOrLog(r.Context(), order.ID)
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// updateOrderHandler handles PUT /orders/{id}.
+// restoreOrderHandler handles POST /orders/{id}/restore, bringing back a
+// deleted order. Orders are cancelled on their way out, so it comes back
+// cancelled.
+func restoreOrderHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orders/"), "/restore")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	result := db.Unscoped().Preload("Items").First(&order, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !order.DeletedAt.Valid {
+		http.Error(w, "Order isn't deleted", http.StatusConflict)
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&order).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+		order.DeletedAt = gorm.DeletedAt{}
+		return recordOrderEvent(tx, eventOrderUpdated, order)
+	})
+	if err != nil {
+		http.Error(w, "Failed to restore order", http.StatusInternalServerError)
+		return
+	}
+	wakeOutboxRelay()
+	order.setLegacyFields()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// updateOrderHandler handles PUT /orders/{id}. The body replaces the
+// order's items (same shapes as POST; user_id can't change). Products
+// already on the order keep their captured name and unit price; new ones
+// are priced from the catalog, and {"reprice": true} reprices every line.
+// Only pending orders can be changed, and only before a payment has been
+// authorized for them: paymentservice holds one payment per order, for
+// the total it was placed at, so an order that's been paid for has to be
+// cancelled and placed again instead.
 func updateOrderHandler(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/orders/")
 	id, err := strconv.Atoi(idStr)
@@ -201,7 +437,7 @@ func updateOrderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var existing Order
-	result := db.First(&existing, id)
+	result := db.Preload("Items").First(&existing, id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			http.Error(w, "Order not found", http.StatusNotFound)
@@ -211,6 +447,28 @@ func updateOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canChangeOrder(authz.RequestCaller(r), existing) {
+		http.Error(w, "Order belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	if !canModify(existing.Status) {
+		http.Error(w, fmt.Sprintf("Cannot change an order that is %s", existing.Status), http.StatusConflict)
+		return
+	}
+	if !checkPlaced(w, existing.ID) {
+		return
+	}
+	authorized, err := paymentAuthorized(existing.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if authorized {
+		http.Error(w, "Order has an authorized payment; cancel it and place a new one", http.StatusConflict)
+		return
+	}
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusBadRequest)
@@ -218,47 +476,110 @@ func updateOrderHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	var updateData Order
-	if err := json.Unmarshal(body, &updateData); err != nil {
+	var req orderRequest
+	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	lines, err := req.lines()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if updateData.ProductID == 0 || updateData.Quantity == 0 {
-		http.Error(w, "ProductID and Quantity are required", http.StatusBadRequest)
+	// Lines keep the price the customer was quoted unless the caller asks
+	// for the order to be repriced at current catalog prices.
+	snapshot := &existing
+	if req.Reprice {
+		snapshot = nil
+	}
+	items, total, currency, status, err := priceItems(r.Context(), lines, snapshot)
+	if err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	product, err := getProduct(updateData.ProductID)
+	// New units are held before anything is saved, so a 409 leaves the
+	// order untouched; the units of replaced lines are returned after.
+	added, replaced, err := swapReservations(r.Context(), existing.Items, items)
 	if err != nil {
-		http.Error(w, "Failed to fetch product info: "+err.Error(), http.StatusInternalServerError)
+		writeReservationError(w, err)
 		return
 	}
 
-	existing.ProductID = updateData.ProductID
-	existing.Quantity = updateData.Quantity
-	existing.Total = product.Price * float64(updateData.Quantity)
+	existing.Items = items
+	existing.Total = total
+	existing.Currency = currency
 
-	saveResult := db.Save(&existing)
-	if saveResult.Error != nil {
-		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+	var stale bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Guard against a transition that landed since the check above.
+		result := tx.Model(&Order{}).Where("id = ? AND status = ?", existing.ID, statusPending).
+			Updates(map[string]any{"total_minor": existing.Total, "currency": existing.Currency})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			stale = true
+			return errInvalidTransition
+		}
+		if err := tx.Where("order_id = ?", existing.ID).Delete(&OrderItem{}).Error; err != nil {
+			return err
+		}
+		for i := range existing.Items {
+			existing.Items[i].OrderID = existing.ID
+		}
+		if err := tx.Create(&existing.Items).Error; err != nil {
+			return err
+		}
+		return recordOrderEvent(tx, eventOrderUpdated, existing)
+	})
+	if err != nil {
+		releaseItems(r.Context(), added)
+		if stale {
+			http.Error(w, "Order changed status while being updated", http.StatusConflict)
+		} else {
+			http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		}
 		return
 	}
 
+	wakeOutboxRelay()
+	commitItems(r.Context(), existing.ID, added)
+	releaseItems(r.Context(), replaced)
+	existing.setLegacyFields()
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(existing)
 }
 
-// getProduct fetches product info from productservice.
-func getProduct(productID int) (Product, error) {
+// getProduct fetches product info from productservice, going through
+// catalogCache.
+func getProduct(ctx context.Context, productID int) (Product, error) {
+	cached, ok, fresh := catalogCache.get(productID)
+	if fresh {
+		return cached.product, nil
+	}
+
 	url := fmt.Sprintf("%s/products/%d", productServiceURL, productID)
+	header := http.Header{}
+	if ok && cached.etag != "" {
+		header.Set("If-None-Match", cached.etag)
+	}
 
-	resp, err := httpClient.Get(url)
+	resp, err := productClient.Get(ctx, url, header)
 	if err != nil {
 		return Product{}, fmt.Errorf("error making request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && ok {
+		catalogCache.revalidated(productID)
+		return cached.product, nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		catalogCache.invalidate(productID)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return Product{}, fmt.Errorf("product service returned status: %s", resp.Status)
 	}
@@ -273,14 +594,15 @@ func getProduct(productID int) (Product, error) {
 		return Product{}, fmt.Errorf("error unmarshalling product JSON: %w", err)
 	}
 
+	catalogCache.put(product, resp.Header.Get("ETag"))
 	return product, nil
 }
 
 // getUser fetches user info from userservice.
-func getUser(userID int) (User, error) {
+func getUser(ctx context.Context, userID int) (User, error) {
 	url := fmt.Sprintf("%s/users/%d", userServiceURL, userID)
 
-	resp, err := httpClient.Get(url)
+	resp, err := userClient.Get(ctx, url, nil)
 	if err != nil {
 		return User{}, fmt.Errorf("error calling user service: %w", err)
 	}
@@ -303,11 +625,81 @@ func getUser(userID int) (User, error) {
 	return user, nil
 }
 
-// ordersRouter dispatches /orders requests by method and path.
-func ordersRouter(w http.ResponseWriter, r *http.Request) {
+// permissions lists who may call each route (see shared/authz). Customers
+// are further limited to their own orders by canViewOrder and
+// canChangeOrder.
+var permissions = []authz.Permission{
+	{Method: "GET", Path: "/orders", Allow: []string{authz.RoleCustomer, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "POST", Path: "/orders", Allow: []string{authz.RoleCustomer, authz.RoleAdmin}},
+	{Method: "GET", Path: "/orders/{id}", Allow: []string{authz.RoleCustomer, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "PUT", Path: "/orders/{id}", Allow: []string{authz.RoleCustomer, authz.RoleAdmin}},
+	{Method: "DELETE", Path: "/orders/{id}", Allow: []string{authz.RoleCustomer, authz.RoleAdmin}},
+	{Method: "GET", Path: "/orders/{id}/transitions", Allow: []string{authz.RoleCustomer, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "POST", Path: "/orders/{id}/transitions", Allow: []string{authz.RoleCustomer, authz.RoleAdmin}},
+	{Method: "POST", Path: "/orders/{id}/restore", Allow: []string{authz.RoleAdmin}},
+	{Method: "GET", Path: "/orders/{id}/saga", Allow: []string{authz.RoleCustomer, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "GET", Path: "/users/{id}/orders", Allow: []string{authz.AllowSelf, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "POST", Path: "/product-events", Allow: []string{authz.RoleService}},
+	{Method: "POST", Path: "/payment-events", Allow: []string{authz.RoleService}},
+	{Method: "GET", Path: "/webhooks", Allow: []string{authz.RoleAdmin}},
+	{Method: "POST", Path: "/webhooks", Allow: []string{authz.RoleAdmin}},
+	{Method: "GET", Path: "/webhooks/{id}", Allow: []string{authz.RoleAdmin}},
+	{Method: "DELETE", Path: "/webhooks/{id}", Allow: []string{authz.RoleAdmin}},
+	{Method: "GET", Path: "/webhooks/{id}/deliveries", Allow: []string{authz.RoleAdmin}},
+	{Method: "POST", Path: "/webhooks/{id}/deliveries/{did}/redeliver", Allow: []string{authz.RoleAdmin}},
+	{Method: "GET", Path: "/debug/dependencies", Allow: []string{authz.RoleAdmin, authz.RoleService}},
+}
+
+// canViewOrder reports whether c may read order: it's theirs, or they're
+// support or an admin.
+func canViewOrder(c authz.Caller, order Order) bool {
+	return order.UserID == c.UserID || c.HasRole(authz.RoleSupport, authz.RoleAdmin)
+}
+
+// canChangeOrder reports whether c may change order: it's theirs, or
+// they're an admin.
+func canChangeOrder(c authz.Caller, order Order) bool {
+	return order.UserID == c.UserID || c.HasRole(authz.RoleAdmin)
+}
+
+var errIncludeDeleted = errors.New("Only support and admins can include deleted orders")
+
+// readScope returns what to read orders through for r: db, which hides
+// deleted orders, or, when support or an admin asks for
+// ?include_deleted=true, a handle that shows them too.
+func readScope(r *http.Request) (*gorm.DB, error) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return db, nil
+	}
+	if !authz.RequestCaller(r).HasRole(authz.RoleSupport, authz.RoleAdmin) {
+		return nil, errIncludeDeleted
+	}
+	return db.Unscoped(), nil
+}
+
+// ordersRouter is the /orders entry point: authz.Authorize checks the request
+// against permissions, then routeOrders dispatches it.
+var ordersRouter = authz.Authorize(permissions, routeOrders)
+
+// routeOrders dispatches /orders (and /users/{id}/orders) requests by
+// method and path.
+func routeOrders(w http.ResponseWriter, r *http.Request) {
 	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/users/"):
+		userOrdersHandler(w, r)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/orders/") && strings.HasSuffix(r.URL.Path, "/restore"):
+		restoreOrderHandler(w, r)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/orders/") && strings.HasSuffix(r.URL.Path, "/saga"):
+		sagaHandler(w, r)
+
+	case (r.Method == http.MethodGet || r.Method == http.MethodPost) &&
+		strings.HasPrefix(r.URL.Path, "/orders/") && strings.HasSuffix(r.URL.Path, "/transitions"):
+		transitionsHandler(w, r)
+
 	case r.Method == http.MethodPost && r.URL.Path == "/orders":
-		createOrderHandler(w, r)
+		withIdempotency(createOrderHandler)(w, r)
 
 	case r.Method == http.MethodGet && (r.URL.Path == "/orders" || r.URL.Path == "/orders/"):
 		getOrdersHandler(w, r)
@@ -345,11 +737,28 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(openDB(), migrationFiles, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	initDB()
+	go purgeIdempotencyKeys()
+	go relayOutbox(context.Background(), newBroker())
+	go resumeSagas()
+	go sendWebhooks(context.Background())
 
 	http.HandleFunc("/healthz", healthzHandler)
 	http.HandleFunc("/orders", ordersRouter)
 	http.HandleFunc("/orders/", ordersRouter)
+	http.HandleFunc("/users/", ordersRouter)
+	http.HandleFunc("/product-events", authz.Authorize(permissions, productEventsHandler))
+	http.HandleFunc("/payment-events", authz.Authorize(permissions, paymentEventsHandler))
+	http.HandleFunc("/webhooks", webhooksRouter)
+	http.HandleFunc("/webhooks/", webhooksRouter)
+	http.HandleFunc("/debug/dependencies", authz.Authorize(permissions, dependenciesHandler))
 
 	log.Println("Order Service listening on port 8082")
 	server := &http.Server{
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"shared/authz"
+	"shared/money"
 )
 
 // setupTestDB swaps the package-level db for an in-memory SQLite database.
@@ -24,39 +30,71 @@ func setupTestDB(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open test database: %v", err)
 	}
-	if err := db.AutoMigrate(&Order{}); err != nil {
+	if err := db.AutoMigrate(&Order{}, &OrderItem{}, &OrderTransition{}, &IdempotencyKey{}, &OutboxEvent{}, &OrderSaga{}, &SagaStep{},
+		&WebhookSubscription{}, &WebhookDelivery{}); err != nil {
 		t.Fatalf("failed to migrate: %v", err)
 	}
 }
 
+// asUser adds the identity headers the gateway forwards for a verified
+// token, with the customer role unless other roles are given.
+func asUser(req *http.Request, userID int, roles ...string) *http.Request {
+	if len(roles) == 0 {
+		roles = []string{authz.RoleCustomer}
+	}
+	req.Header.Set(authz.HeaderUserID, strconv.Itoa(userID))
+	req.Header.Set(authz.HeaderUserRoles, strings.Join(roles, ","))
+	return req
+}
+
+// seedOrder stores a single-item order the way createOrderHandler would.
+func seedOrder(t *testing.T, productID, quantity int, unitPrice money.Money, reservationID int) Order {
+	t.Helper()
+	order := Order{
+		UserID: 1,
+		Status: statusPending,
+		Items: []OrderItem{{
+			ProductID:     productID,
+			Quantity:      quantity,
+			UnitPrice:     unitPrice,
+			LineTotal:     unitPrice * money.Money(quantity),
+			ReservationID: reservationID,
+		}},
+		Total:    unitPrice * money.Money(quantity),
+		Currency: "USD",
+	}
+	if err := db.Create(&order).Error; err != nil {
+		t.Fatalf("failed to seed order: %v", err)
+	}
+	return order
+}
+
 func TestGetOrders(t *testing.T) {
 	setupTestDB(t)
-	db.Create(&[]Order{
-		{UserID: 1, ProductID: 1, Quantity: 2, Total: 40},
-		{UserID: 1, ProductID: 3, Quantity: 1, Total: 75},
-	})
+	seedOrder(t, 1, 2, 2000, 0)
+	seedOrder(t, 3, 1, 7500, 0)
 
-	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req := asUser(httptest.NewRequest(http.MethodGet, "/orders", nil), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
 	if rec.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", rec.Code)
 	}
-	var orders []Order
-	if err := json.NewDecoder(rec.Body).Decode(&orders); err != nil {
+	var page orderPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if len(orders) != 2 {
-		t.Errorf("expected 2 orders, got %d", len(orders))
+	if len(page.Items) != 2 {
+		t.Errorf("expected 2 orders, got %d", len(page.Items))
 	}
 }
 
 func TestGetOrderByID(t *testing.T) {
 	setupTestDB(t)
-	db.Create(&Order{UserID: 1, ProductID: 1, Quantity: 2, Total: 40})
+	seedOrder(t, 1, 2, 2000, 0)
 
-	req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	req := asUser(httptest.NewRequest(http.MethodGet, "/orders/1", nil), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -67,15 +105,15 @@ func TestGetOrderByID(t *testing.T) {
 	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if order.Total != 40 {
-		t.Errorf("expected total 40, got %v", order.Total)
+	if order.Total != 4000 {
+		t.Errorf("expected total 4000 cents, got %d", order.Total)
 	}
 }
 
 func TestGetOrderNotFound(t *testing.T) {
 	setupTestDB(t)
 
-	req := httptest.NewRequest(http.MethodGet, "/orders/999", nil)
+	req := asUser(httptest.NewRequest(http.MethodGet, "/orders/999", nil), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -87,7 +125,7 @@ func TestGetOrderNotFound(t *testing.T) {
 func TestGetOrderInvalidID(t *testing.T) {
 	setupTestDB(t)
 
-	req := httptest.NewRequest(http.MethodGet, "/orders/abc", nil)
+	req := asUser(httptest.NewRequest(http.MethodGet, "/orders/abc", nil), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -98,9 +136,10 @@ func TestGetOrderInvalidID(t *testing.T) {
 
 func TestDeleteOrder(t *testing.T) {
 	setupTestDB(t)
-	db.Create(&Order{UserID: 1, ProductID: 1, Quantity: 2, Total: 40})
+	seedOrder(t, 1, 2, 2000, 7)
+	inv := setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
 
-	req := httptest.NewRequest(http.MethodDelete, "/orders/1", nil)
+	req := asUser(httptest.NewRequest(http.MethodDelete, "/orders/1", nil), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -113,12 +152,102 @@ func TestDeleteOrder(t *testing.T) {
 	if count != 0 {
 		t.Errorf("expected order to be deleted, %d remain", count)
 	}
+	if len(inv.released) != 1 || inv.released[0] != 7 {
+		t.Errorf("expected reservation 7 to be released, got %v", inv.released)
+	}
+
+	var stored Order
+	if err := db.Unscoped().First(&stored, 1).Error; err != nil {
+		t.Fatalf("expected the row to be kept: %v", err)
+	}
+	if !stored.DeletedAt.Valid || stored.Status != statusCancelled {
+		t.Errorf("expected a cancelled, soft-deleted order, got %s (deleted %v)", stored.Status, stored.DeletedAt.Valid)
+	}
+	var history []OrderTransition
+	db.Where("order_id = ?", 1).Find(&history)
+	if len(history) != 1 || history[0].To != statusCancelled {
+		t.Errorf("expected the cancellation in the history, got %+v", history)
+	}
+}
+
+func TestDeletedOrdersHiddenUnlessAsked(t *testing.T) {
+	setupTestDB(t)
+	setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+	seedOrder(t, 1, 1, 2000, 0)
+	seedOrder(t, 1, 1, 2000, 0)
+	ordersRouter(httptest.NewRecorder(), asUser(httptest.NewRequest(http.MethodDelete, "/orders/1", nil), 1))
+
+	tests := []struct {
+		name   string
+		path   string
+		roles  []string
+		status int
+		want   string
+	}{
+		{"owner list", "/orders", nil, http.StatusOK, "2"},
+		{"owner get", "/orders/1", nil, http.StatusNotFound, ""},
+		{"owner asks for deleted", "/orders?include_deleted=true", nil, http.StatusForbidden, ""},
+		{"support list", "/orders?include_deleted=true", []string{authz.RoleSupport}, http.StatusOK, "2,1"},
+		{"support history", "/users/1/orders?include_deleted=true", []string{authz.RoleSupport}, http.StatusOK, "2,1"},
+		{"support get", "/orders/1?include_deleted=true", []string{authz.RoleSupport}, http.StatusOK, ""},
+		{"support transitions", "/orders/1/transitions?include_deleted=true", []string{authz.RoleSupport}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ordersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, tt.path, nil), 1, tt.roles...))
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if tt.want == "" {
+				return
+			}
+			var page orderPage
+			json.NewDecoder(rec.Body).Decode(&page)
+			if ids(page.Items) != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, ids(page.Items))
+			}
+		})
+	}
+}
+
+func TestRestoreOrder(t *testing.T) {
+	setupTestDB(t)
+	setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+	seedOrder(t, 1, 1, 2000, 0)
+
+	restore := func(roles ...string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ordersRouter(rec, asUser(httptest.NewRequest(http.MethodPost, "/orders/1/restore", nil), 1, roles...))
+		return rec
+	}
+
+	if rec := restore(authz.RoleAdmin); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 restoring a live order, got %d", rec.Code)
+	}
+	ordersRouter(httptest.NewRecorder(), asUser(httptest.NewRequest(http.MethodDelete, "/orders/1", nil), 1))
+	if rec := restore(); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a customer, got %d", rec.Code)
+	}
+
+	rec := restore(authz.RoleAdmin)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var order Order
+	json.NewDecoder(rec.Body).Decode(&order)
+	if order.Status != statusCancelled || order.DeletedAt.Valid {
+		t.Errorf("expected the order back as cancelled, got %s (deleted %v)", order.Status, order.DeletedAt.Valid)
+	}
+	if err := db.First(&Order{}, 1).Error; err != nil {
+		t.Errorf("expected the restored order to be visible again: %v", err)
+	}
 }
 
 func TestDeleteOrderNotFound(t *testing.T) {
 	setupTestDB(t)
 
-	req := httptest.NewRequest(http.MethodDelete, "/orders/999", nil)
+	req := asUser(httptest.NewRequest(http.MethodDelete, "/orders/999", nil), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -137,10 +266,90 @@ func fakeService(t *testing.T, status int, body string) *httptest.Server {
 	}))
 }
 
-func setFakeBackends(t *testing.T, userStatus int, userBody string, productStatus int, productBody string) {
+// fakeInventory records the stock reservation calls orderservice makes
+// against the fake productservice.
+type fakeInventory struct {
+	mu          sync.Mutex
+	outOfStock  bool
+	soldOut     map[int]bool // product IDs out of stock even when outOfStock is false
+	releaseDown bool         // releases fail with a 500
+	reserved    []int        // quantities, in call order; reservation IDs are index+1
+	committed   []int
+	released    []int
+}
+
+func (inv *fakeInventory) handle(w http.ResponseWriter, r *http.Request) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	// /products/{id}/reservations[/{rid}/{action}]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/products/"), "/")
+	if len(parts) == 2 {
+		productID, _ := strconv.Atoi(parts[0])
+		if inv.outOfStock || inv.soldOut[productID] {
+			http.Error(w, "Insufficient stock", http.StatusConflict)
+			return
+		}
+		var req struct{ Quantity int }
+		json.NewDecoder(r.Body).Decode(&req)
+		inv.reserved = append(inv.reserved, req.Quantity)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"id":%d,"product_id":%s,"quantity":%d,"status":"reserved"}`, len(inv.reserved), parts[0], req.Quantity)
+		return
+	}
+
+	rid, _ := strconv.Atoi(parts[2])
+	switch parts[3] {
+	case "commit":
+		inv.committed = append(inv.committed, rid)
+	case "release":
+		if inv.releaseDown {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		inv.released = append(inv.released, rid)
+	}
+	fmt.Fprint(w, `{}`)
+}
+
+// fakeProductService stands in for productservice: product lookups get the
+// given status and body, and reservation calls are handled by inv.
+func fakeProductService(t *testing.T, status int, body string, inv *fakeInventory) *httptest.Server {
 	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/reservations") {
+			inv.handle(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+// useFreshClients gives the test its own dependency clients and product
+// cache, so breaker state and cached products don't leak between tests, with backoff short enough not to slow
+// the suite down. Payments go to a fakePayments that approves everything.
+func useFreshClients(t *testing.T) {
+	t.Helper()
+	origProduct, origUser, origPayment, origCache := productClient, userClient, paymentClient, catalogCache
+	productClient, userClient = newResilientClient("productservice"), newResilientClient("userservice")
+	productClient.baseDelay, userClient.baseDelay = time.Millisecond, time.Millisecond
+	paymentClient = newResilientClient("paymentservice")
+	catalogCache = newProductCache(productCacheTTL, productCacheSize)
+	origPayments := payments
+	payments = &fakePayments{}
+	t.Cleanup(func() {
+		productClient, userClient, paymentClient, catalogCache = origProduct, origUser, origPayment, origCache
+		payments = origPayments
+	})
+}
+
+func setFakeBackends(t *testing.T, userStatus int, userBody string, productStatus int, productBody string) *fakeInventory {
+	t.Helper()
+	useFreshClients(t)
+	inv := &fakeInventory{}
 	users := fakeService(t, userStatus, userBody)
-	products := fakeService(t, productStatus, productBody)
+	products := fakeProductService(t, productStatus, productBody, inv)
 	origUser, origProduct := userServiceURL, productServiceURL
 	userServiceURL, productServiceURL = users.URL, products.URL
 	t.Cleanup(func() {
@@ -148,17 +357,18 @@ func setFakeBackends(t *testing.T, userStatus int, userBody string, productStatu
 		users.Close()
 		products.Close()
 	})
+	return inv
 }
 
 func TestCreateOrderSuccess(t *testing.T) {
 	setupTestDB(t)
-	setFakeBackends(t,
+	inv := setFakeBackends(t,
 		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
 		http.StatusOK, `{"id":2,"name":"Mouse","price":20}`,
 	)
 
 	body := strings.NewReader(`{"user_id":1,"product_id":2,"quantity":3}`)
-	req := httptest.NewRequest(http.MethodPost, "/orders", body)
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", body), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -169,12 +379,62 @@ func TestCreateOrderSuccess(t *testing.T) {
 	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if order.Total != 60 {
-		t.Errorf("expected total 60 (3 x 20), got %v", order.Total)
+	if order.Total != 6000 || order.Currency != "USD" {
+		t.Errorf("expected total 6000 USD cents (3 x 20.00), got %d %s", order.Total, order.Currency)
 	}
 	if order.ID == 0 {
 		t.Error("expected database-assigned ID, got 0")
 	}
+	if len(inv.reserved) != 1 || inv.reserved[0] != 3 {
+		t.Errorf("expected one reservation of 3 units, got %v", inv.reserved)
+	}
+	if len(inv.committed) != 1 || len(inv.released) != 0 {
+		t.Errorf("expected reservation to be committed, got committed=%v released=%v", inv.committed, inv.released)
+	}
+}
+
+// 3 x 0.10 is 0.30000000000000004 in float64; totals must come out exact.
+func TestCreateOrderTotalIsExact(t *testing.T) {
+	setupTestDB(t)
+	setFakeBackends(t,
+		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
+		http.StatusOK, `{"id":5,"name":"Sticker","price":0.1,"currency":"EUR"}`,
+	)
+
+	body := strings.NewReader(`{"user_id":1,"product_id":5,"quantity":3}`)
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", body), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), `"total":0.3,"currency":"EUR"`) {
+		t.Errorf("expected total 0.3 EUR in response, got %s", rec.Body.String())
+	}
+}
+
+func TestCreateOrderInsufficientStock(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeBackends(t,
+		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
+		http.StatusOK, `{"id":2,"name":"Mouse","price":20}`,
+	)
+	inv.outOfStock = true
+
+	body := strings.NewReader(`{"user_id":1,"product_id":2,"quantity":3}`)
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", body), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var count int64
+	db.Model(&Order{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no order to be saved, got %d", count)
+	}
 }
 
 func TestCreateOrderUnknownUser(t *testing.T) {
@@ -184,8 +444,10 @@ func TestCreateOrderUnknownUser(t *testing.T) {
 		http.StatusOK, `{"id":2,"name":"Mouse","price":20}`,
 	)
 
+	// Only an admin can name another user, so only an admin can name one
+	// that doesn't exist.
 	body := strings.NewReader(`{"user_id":999,"product_id":2,"quantity":1}`)
-	req := httptest.NewRequest(http.MethodPost, "/orders", body)
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", body), 1, authz.RoleAdmin)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -194,16 +456,116 @@ func TestCreateOrderUnknownUser(t *testing.T) {
 	}
 }
 
+// blockingBackends points orderservice at fake user and product services
+// that don't answer until every one of them has a request in flight (or
+// the request is cancelled), so the lookups only finish if they run
+// concurrently.
+func blockingBackends(t *testing.T, inFlight int) (cancelled chan struct{}) {
+	t.Helper()
+	useFreshClients(t)
+	var arrived sync.WaitGroup
+	arrived.Add(inFlight)
+	allArrived := make(chan struct{})
+	go func() { arrived.Wait(); close(allArrived) }()
+	cancelled = make(chan struct{}, inFlight)
+
+	handler := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/reservations") {
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"id":1,"status":"reserved"}`)
+				return
+			}
+			arrived.Done()
+			select {
+			case <-allArrived:
+				fmt.Fprint(w, body)
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+			case <-time.After(2 * time.Second):
+				http.Error(w, "lookups were not concurrent", http.StatusGatewayTimeout)
+			}
+		}
+	}
+	users := httptest.NewServer(handler(`{"id":1,"name":"Demo User","email":"demo@example.com"}`))
+	products := httptest.NewServer(handler(`{"id":2,"name":"Mouse","price":20}`))
+	origUser, origProduct := userServiceURL, productServiceURL
+	userServiceURL, productServiceURL = users.URL, products.URL
+	t.Cleanup(func() {
+		userServiceURL, productServiceURL = origUser, origProduct
+		users.Close()
+		products.Close()
+	})
+	return cancelled
+}
+
+func TestCreateOrderLooksUpUserAndProductsConcurrently(t *testing.T) {
+	setupTestDB(t)
+	blockingBackends(t, 3)
+
+	body := strings.NewReader(`{"user_id":1,"items":[{"product_id":2,"quantity":1},{"product_id":3,"quantity":1}]}`)
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", body), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreateOrderCancelledByClient(t *testing.T) {
+	setupTestDB(t)
+	// Three lookups are expected but only two are made, so neither answers.
+	cancelled := blockingBackends(t, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	body := strings.NewReader(`{"user_id":1,"product_id":2,"quantity":1}`)
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", body), 1).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		ordersRouter(rec, req)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("handler kept waiting after the client went away")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatalf("expected both downstream calls to be cancelled, saw %d", i)
+		}
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for a cancelled request, got %d", rec.Code)
+	}
+	if s := productClient.status(); s.Failures != 0 || s.Retries != 0 {
+		t.Errorf("cancelled call shouldn't count against productservice: %+v", s)
+	}
+	var count int64
+	db.Model(&Order{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no order to be saved, got %d", count)
+	}
+}
+
 func TestUpdateOrderRecalculatesTotal(t *testing.T) {
 	setupTestDB(t)
-	db.Create(&Order{UserID: 1, ProductID: 2, Quantity: 1, Total: 20})
+	seedOrder(t, 2, 1, 2000, 0)
 	setFakeBackends(t,
 		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
 		http.StatusOK, `{"id":2,"name":"Mouse","price":20}`,
 	)
 
 	body := strings.NewReader(`{"product_id":2,"quantity":5}`)
-	req := httptest.NewRequest(http.MethodPut, "/orders/1", body)
+	req := asUser(httptest.NewRequest(http.MethodPut, "/orders/1", body), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -214,8 +576,59 @@ func TestUpdateOrderRecalculatesTotal(t *testing.T) {
 	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if order.Total != 100 {
-		t.Errorf("expected total 100 (5 x 20), got %v", order.Total)
+	if order.Total != 10000 {
+		t.Errorf("expected total 10000 cents (5 x 20.00), got %d", order.Total)
+	}
+}
+
+func TestUpdateOrderSwapsReservation(t *testing.T) {
+	setupTestDB(t)
+	seedOrder(t, 2, 1, 2000, 7)
+	inv := setFakeBackends(t,
+		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
+		http.StatusOK, `{"id":2,"name":"Mouse","price":20}`,
+	)
+
+	body := strings.NewReader(`{"product_id":2,"quantity":5}`)
+	req := asUser(httptest.NewRequest(http.MethodPut, "/orders/1", body), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(inv.reserved) != 1 || inv.reserved[0] != 5 || len(inv.committed) != 1 {
+		t.Errorf("expected a committed reservation of 5, got reserved=%v committed=%v", inv.reserved, inv.committed)
+	}
+	if len(inv.released) != 1 || inv.released[0] != 7 {
+		t.Errorf("expected old reservation 7 to be released, got %v", inv.released)
+	}
+}
+
+func TestUpdateOrderInsufficientStock(t *testing.T) {
+	setupTestDB(t)
+	seedOrder(t, 2, 1, 2000, 7)
+	inv := setFakeBackends(t,
+		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
+		http.StatusOK, `{"id":2,"name":"Mouse","price":20}`,
+	)
+	inv.outOfStock = true
+
+	body := strings.NewReader(`{"product_id":2,"quantity":50}`)
+	req := asUser(httptest.NewRequest(http.MethodPut, "/orders/1", body), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rec.Code)
+	}
+	var stored Order
+	db.Preload("Items").First(&stored, 1)
+	if len(stored.Items) != 1 || stored.Items[0].Quantity != 1 || stored.Items[0].ReservationID != 7 {
+		t.Errorf("rejected update should leave the order alone, got %+v", stored)
+	}
+	if len(inv.released) != 0 {
+		t.Errorf("old reservation should be kept, got released=%v", inv.released)
 	}
 }
 
@@ -226,7 +639,6 @@ func TestCreateOrderValidation(t *testing.T) {
 		body string
 	}{
 		{"invalid JSON", `{not json`},
-		{"missing user_id", `{"product_id":1,"quantity":2}`},
 		{"missing product_id", `{"user_id":1,"quantity":2}`},
 		{"missing quantity", `{"user_id":1,"product_id":1}`},
 	}
@@ -234,7 +646,7 @@ func TestCreateOrderValidation(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			setupTestDB(t)
 
-			req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tt.body))
+			req := asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(tt.body)), 1)
 			rec := httptest.NewRecorder()
 			ordersRouter(rec, req)
 
@@ -249,7 +661,7 @@ func TestUpdateOrderNotFound(t *testing.T) {
 	setupTestDB(t)
 
 	body := strings.NewReader(`{"product_id":1,"quantity":2}`)
-	req := httptest.NewRequest(http.MethodPut, "/orders/999", body)
+	req := asUser(httptest.NewRequest(http.MethodPut, "/orders/999", body), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
@@ -261,7 +673,7 @@ func TestUpdateOrderNotFound(t *testing.T) {
 func TestOrdersRouterMethodNotAllowed(t *testing.T) {
 	setupTestDB(t)
 
-	req := httptest.NewRequest(http.MethodPatch, "/orders/1", nil)
+	req := asUser(httptest.NewRequest(http.MethodPatch, "/orders/1", nil), 1)
 	rec := httptest.NewRecorder()
 	ordersRouter(rec, req)
 
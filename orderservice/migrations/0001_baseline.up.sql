@@ -0,0 +1,14 @@
+-- The schema orderservice started with, when an order was for a single
+-- product. Every migration is written to also run against a database
+-- AutoMigrate built at some later release, so an existing database is
+-- brought forward, data and all, from wherever it is: tables and columns
+-- are added only if missing, and data in an old shape is converted when
+-- it's found.
+
+CREATE TABLE IF NOT EXISTS orders (
+    id bigserial PRIMARY KEY,
+    user_id bigint,
+    product_id bigint,
+    quantity bigint,
+    total decimal
+);
@@ -0,0 +1,3 @@
+-- The stock reservation held for an order, released if it's cancelled.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS reservation_id bigint;
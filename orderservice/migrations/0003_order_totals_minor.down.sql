@@ -0,0 +1,4 @@
+ALTER TABLE orders ADD COLUMN total decimal;
+UPDATE orders SET total = total_minor / 100.0;
+ALTER TABLE orders DROP COLUMN total_minor;
+ALTER TABLE orders DROP COLUMN currency;
@@ -0,0 +1,11 @@
+-- Totals move from a float of major units in "total" to integer minor
+-- units (cents) in "total_minor", with a currency. The float column is
+-- added first if it's missing, so the conversion is a no-op on a database
+-- that was already converted.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS total_minor bigint NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS currency varchar(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS total decimal;
+
+UPDATE orders SET total_minor = ROUND(total * 100) WHERE total IS NOT NULL;
+ALTER TABLE orders DROP COLUMN total;
@@ -0,0 +1,15 @@
+-- An order keeps only its first item; the others are lost.
+
+ALTER TABLE orders ADD COLUMN product_id bigint;
+ALTER TABLE orders ADD COLUMN quantity bigint;
+ALTER TABLE orders ADD COLUMN reservation_id bigint;
+
+UPDATE orders SET product_id = first.product_id, quantity = first.quantity, reservation_id = first.reservation_id
+FROM (
+    SELECT DISTINCT ON (order_id) order_id, product_id, quantity, reservation_id
+    FROM order_items
+    ORDER BY order_id, id
+) AS first
+WHERE first.order_id = orders.id;
+
+DROP TABLE order_items;
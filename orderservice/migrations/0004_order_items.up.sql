@@ -0,0 +1,34 @@
+-- Orders hold any number of lines in order_items. Each order from when an
+-- order held a single product_id/quantity becomes an order with one item,
+-- then those columns are dropped. As with the totals, the legacy columns
+-- are added first if they're missing, which makes the conversion a no-op
+-- on a database that was already converted.
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id bigserial PRIMARY KEY,
+    order_id bigint NOT NULL,
+    product_id bigint NOT NULL,
+    quantity bigint NOT NULL,
+    unit_price_minor bigint NOT NULL,
+    line_total_minor bigint NOT NULL,
+    reservation_id bigint
+);
+CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items (order_id);
+ALTER TABLE order_items DROP CONSTRAINT IF EXISTS fk_orders_items;
+ALTER TABLE order_items ADD CONSTRAINT fk_orders_items FOREIGN KEY (order_id) REFERENCES orders (id);
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS product_id bigint;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS quantity bigint;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS reservation_id bigint;
+
+INSERT INTO order_items (order_id, product_id, quantity, unit_price_minor, line_total_minor, reservation_id)
+SELECT id, product_id, quantity,
+    CASE WHEN quantity > 0 THEN total_minor / quantity ELSE 0 END,
+    total_minor, COALESCE(reservation_id, 0)
+FROM orders
+WHERE product_id IS NOT NULL
+    AND id NOT IN (SELECT order_id FROM order_items);
+
+ALTER TABLE orders DROP COLUMN product_id;
+ALTER TABLE orders DROP COLUMN quantity;
+ALTER TABLE orders DROP COLUMN reservation_id;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS order_transitions;
+DROP INDEX IF EXISTS idx_orders_status;
+ALTER TABLE orders DROP COLUMN status;
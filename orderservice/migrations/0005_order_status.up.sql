@@ -0,0 +1,13 @@
+-- Order status, and the history of its changes.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status varchar(20) NOT NULL DEFAULT 'pending';
+CREATE INDEX IF NOT EXISTS idx_orders_status ON orders (status);
+
+CREATE TABLE IF NOT EXISTS order_transitions (
+    id bigserial PRIMARY KEY,
+    order_id bigint NOT NULL,
+    from_status varchar(20),
+    to_status varchar(20) NOT NULL,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_order_transitions_order_id ON order_transitions (order_id);
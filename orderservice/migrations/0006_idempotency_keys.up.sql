@@ -0,0 +1,11 @@
+-- Responses to POST /orders, kept by Idempotency-Key for replay.
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key varchar(255) PRIMARY KEY,
+    fingerprint varchar(64) NOT NULL,
+    status_code bigint NOT NULL DEFAULT 0,
+    content_type text,
+    body bytea,
+    created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
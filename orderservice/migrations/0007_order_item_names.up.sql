@@ -0,0 +1,3 @@
+-- Each item keeps the product's name as it was when the order was placed.
+
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS product_name text;
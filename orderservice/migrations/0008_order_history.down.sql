@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_created_at;
+DROP INDEX IF EXISTS idx_orders_user_id;
+ALTER TABLE orders DROP COLUMN created_at;
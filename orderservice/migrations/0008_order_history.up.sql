@@ -0,0 +1,12 @@
+-- Indexes for listing a user's orders newest first. Orders stored before
+-- created_at existed get the time of their first recorded transition, or
+-- now if they're older than the transition history.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS created_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_orders_user_id ON orders (user_id);
+CREATE INDEX IF NOT EXISTS idx_orders_created_at ON orders (created_at);
+
+UPDATE orders SET created_at = COALESCE(
+    (SELECT MIN(created_at) FROM order_transitions WHERE order_id = orders.id),
+    CURRENT_TIMESTAMP)
+WHERE created_at IS NULL;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_orders_deleted_at;
+ALTER TABLE orders DROP COLUMN deleted_at;
+ALTER TABLE orders DROP COLUMN updated_at;
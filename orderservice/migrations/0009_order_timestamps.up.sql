@@ -0,0 +1,12 @@
+-- When an order last changed, and soft delete. Orders stored before
+-- updated_at existed get the time of their last recorded transition, or
+-- their creation time.
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS updated_at timestamptz;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_orders_deleted_at ON orders (deleted_at);
+
+UPDATE orders SET updated_at = COALESCE(
+    (SELECT MAX(created_at) FROM order_transitions WHERE order_id = orders.id),
+    created_at)
+WHERE updated_at IS NULL;
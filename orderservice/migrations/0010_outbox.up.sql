@@ -0,0 +1,14 @@
+-- Order events waiting for the relay, written in the same transaction as
+-- the change they describe.
+
+CREATE TABLE outbox_events (
+    id bigserial PRIMARY KEY,
+    type varchar(64) NOT NULL,
+    order_id bigint NOT NULL,
+    payload text NOT NULL,
+    created_at timestamptz NOT NULL,
+    published_at timestamptz,
+    attempts bigint NOT NULL DEFAULT 0,
+    last_error text
+);
+CREATE INDEX idx_outbox_events_published_at ON outbox_events (published_at);
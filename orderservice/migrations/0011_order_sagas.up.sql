@@ -0,0 +1,24 @@
+-- Order placement sagas and their steps (see saga.go).
+
+CREATE TABLE order_sagas (
+    id bigserial PRIMARY KEY,
+    order_id bigint NOT NULL,
+    status varchar(20) NOT NULL,
+    payment_id varchar(64),
+    error text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE UNIQUE INDEX idx_order_sagas_order_id ON order_sagas (order_id);
+CREATE INDEX idx_order_sagas_status ON order_sagas (status);
+
+CREATE TABLE saga_steps (
+    id bigserial PRIMARY KEY,
+    saga_id bigint NOT NULL,
+    name varchar(32) NOT NULL,
+    status varchar(20) NOT NULL DEFAULT 'pending',
+    error text,
+    updated_at timestamptz,
+    CONSTRAINT fk_order_sagas_steps FOREIGN KEY (saga_id) REFERENCES order_sagas (id)
+);
+CREATE INDEX idx_saga_steps_saga_id ON saga_steps (saga_id);
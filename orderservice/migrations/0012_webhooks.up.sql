@@ -0,0 +1,31 @@
+-- Partner webhooks (see webhooks.go): subscriptions, and each event's
+-- delivery to each of them, queued in the same transaction as the event.
+
+CREATE TABLE webhook_subscriptions (
+    id bigserial PRIMARY KEY,
+    url text NOT NULL,
+    secret text NOT NULL,
+    event_types text NOT NULL,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz
+);
+CREATE INDEX idx_webhook_subscriptions_deleted_at ON webhook_subscriptions (deleted_at);
+
+CREATE TABLE webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    subscription_id bigint NOT NULL,
+    event_id bigint NOT NULL,
+    event_type varchar(64) NOT NULL,
+    payload text NOT NULL,
+    status varchar(20) NOT NULL,
+    attempts bigint NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL,
+    last_status_code bigint,
+    last_error text,
+    delivered_at timestamptz,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_webhook_deliveries_subscription_id ON webhook_deliveries (subscription_id);
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at);
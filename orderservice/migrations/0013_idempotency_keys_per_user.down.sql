@@ -0,0 +1,7 @@
+-- Where users shared a key, only the lowest user's row is kept.
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+DELETE FROM idempotency_keys a USING idempotency_keys b
+WHERE a.idempotency_key = b.idempotency_key AND a.user_id > b.user_id;
+ALTER TABLE idempotency_keys DROP COLUMN user_id;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (idempotency_key);
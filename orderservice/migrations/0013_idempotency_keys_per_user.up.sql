@@ -0,0 +1,7 @@
+-- Idempotency keys belong to the user who sent them, so two users who
+-- happen to pick the same key don't collide. Keys stored before this get
+-- user 0, which no customer has; they lapse within a day.
+
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS user_id bigint NOT NULL DEFAULT 0;
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (user_id, idempotency_key);
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"shared/migrate"
+	"shared/pgtest"
+)
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := migrate.Load(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "baseline" {
+		t.Errorf("expected the baseline first, got %+v", migrations)
+	}
+}
+
+// The tests below run the real migrations, so they need Postgres (see
+// pgtest.DSNVar) and are skipped without it.
+
+// schemaModels are the models orderservice stores.
+var schemaModels = []any{&Order{}, &OrderItem{}, &OrderTransition{}, &IdempotencyKey{}, &OutboxEvent{}, &OrderSaga{}, &SagaStep{},
+	&WebhookSubscription{}, &WebhookDelivery{}}
+
+func TestMigrationsBuildTheModels(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+	pgtest.CheckColumns(t, conn, schemaModels...)
+
+	// Every down has to undo its up, so the schema can go all the way
+	// down and back up.
+	if err := migrate.Command(conn, migrationFiles, []string{"down", "100"}, io.Discard); err != nil {
+		t.Fatalf("migrating down: %v", err)
+	}
+	if conn.Migrator().HasTable(&Order{}) {
+		t.Error("expected no orders table at version 0")
+	}
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatalf("migrating up again: %v", err)
+	}
+	pgtest.CheckColumns(t, conn, schemaModels...)
+	order := Order{UserID: 1, Status: statusPending, Total: 2000, Currency: "USD",
+		Items: []OrderItem{{ProductID: 1, ProductName: "Laptop", Quantity: 1, UnitPrice: 2000, LineTotal: 2000}}}
+	if err := conn.Create(&order).Error; err != nil {
+		t.Errorf("expected to store an order: %v", err)
+	}
+}
+
+// legacyOrder is an order as first stored: one product, a float total,
+// and later the stock reservation it held.
+type legacyOrder struct {
+	ID            int `gorm:"primaryKey"`
+	UserID        int
+	ProductID     int
+	Quantity      int
+	Total         float64
+	ReservationID *int
+}
+
+func (legacyOrder) TableName() string { return "orders" }
+
+func TestMigrationsConvertSingleProductOrders(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := conn.AutoMigrate(&legacyOrder{}); err != nil {
+		t.Fatal(err)
+	}
+	reservation := 7
+	conn.Create(&[]legacyOrder{
+		{UserID: 1, ProductID: 2, Quantity: 3, Total: 60, ReservationID: &reservation},
+		{UserID: 1, ProductID: 5, Quantity: 3, Total: 0.30000000000000004},
+	})
+
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	var orders []Order
+	conn.Preload("Items").Order("id").Find(&orders)
+	if len(orders) != 2 || len(orders[0].Items) != 1 || len(orders[1].Items) != 1 {
+		t.Fatalf("expected one item per legacy order, got %+v", orders)
+	}
+	if orders[0].Total != 6000 || orders[1].Total != 30 {
+		t.Errorf("expected totals in cents, got %d and %d", orders[0].Total, orders[1].Total)
+	}
+	first := orders[0].Items[0]
+	if first.ProductID != 2 || first.Quantity != 3 || first.UnitPrice != 2000 || first.LineTotal != 6000 || first.ReservationID != 7 {
+		t.Errorf("unexpected migrated item %+v", first)
+	}
+	if o := orders[1]; o.Status != statusPending || o.Currency != "USD" || o.CreatedAt.IsZero() || o.UpdatedAt.IsZero() {
+		t.Errorf("expected defaults for the new columns, got %+v", o)
+	}
+	for _, column := range []string{"product_id", "quantity", "reservation_id", "total"} {
+		if conn.Migrator().HasColumn(&Order{}, column) {
+			t.Errorf("expected legacy column %s to be dropped", column)
+		}
+	}
+}
+
+// statusOrder is an order from when it had a status and items but no
+// timestamps.
+type statusOrder struct {
+	ID       int    `gorm:"primaryKey"`
+	UserID   int    `gorm:"index"`
+	Status   string `gorm:"size:20;not null;default:pending;index"`
+	Total    int64  `gorm:"column:total_minor;not null;default:0"`
+	Currency string `gorm:"size:3;not null;default:USD"`
+}
+
+func (statusOrder) TableName() string { return "orders" }
+
+func TestMigrationsBackfillOrderTimestamps(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := conn.AutoMigrate(&statusOrder{}, &OrderItem{}, &OrderTransition{}); err != nil {
+		t.Fatal(err)
+	}
+	order := statusOrder{UserID: 1, Status: statusPaid, Total: 2000}
+	conn.Create(&order)
+	conn.Create(&OrderItem{OrderID: order.ID, ProductID: 1, Quantity: 1, UnitPrice: 2000, LineTotal: 2000})
+	placed := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	paid := placed.Add(time.Hour)
+	conn.Create(&OrderTransition{OrderID: order.ID, To: statusPending, CreatedAt: placed})
+	conn.Create(&OrderTransition{OrderID: order.ID, From: statusPending, To: statusPaid, CreatedAt: paid})
+
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored Order
+	if err := conn.Preload("Items").First(&stored, order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != statusPaid || stored.Total != 2000 || len(stored.Items) != 1 {
+		t.Errorf("expected the order unchanged, got %+v", stored)
+	}
+	if !stored.CreatedAt.Equal(placed) {
+		t.Errorf("expected created_at from the first transition (%s), got %s", placed, stored.CreatedAt)
+	}
+	if !stored.UpdatedAt.Equal(paid) {
+		t.Errorf("expected updated_at from the last transition (%s), got %s", paid, stored.UpdatedAt)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Events other services can subscribe to. Each is written to the outbox
+// in the same transaction as the change it describes, so an event is
+// never lost after a commit or sent for a change that rolled back.
+const (
+	eventOrderCreated   = "order.created"
+	eventOrderUpdated   = "order.updated"   // items, status or restored
+	eventOrderCancelled = "order.cancelled" // including on the way to a delete
+	eventOrderDeleted   = "order.deleted"
+)
+
+const (
+	outboxBatchSize    = 100
+	outboxPollInterval = time.Second
+	// Published events are kept this long for debugging, then purged.
+	outboxRetention = 7 * 24 * time.Hour
+)
+
+// OutboxEvent maps to the "outbox_events" table: events waiting for the
+// relay (PublishedAt is nil), and for a while, those it has published.
+// Payload is the order as it was after the change, in its API JSON form.
+type OutboxEvent struct {
+	ID          int        `gorm:"primaryKey"`
+	Type        string     `gorm:"size:64;not null"`
+	OrderID     int        `gorm:"not null"`
+	Payload     string     `gorm:"not null"`
+	CreatedAt   time.Time  `gorm:"not null"`
+	PublishedAt *time.Time `gorm:"index"`
+	Attempts    int        `gorm:"not null;default:0"`
+	LastError   string
+}
+
+// orderEvent is an event as subscribers receive it. ID is the outbox
+// row's, the same on every delivery, so subscribers can drop repeats.
+type orderEvent struct {
+	ID         int             `json:"id"`
+	Type       string          `json:"type"`
+	OrderID    int             `json:"order_id"`
+	Order      json.RawMessage `json:"order,omitempty"`
+	OccurredAt time.Time       `json:"occurred_at"`
+}
+
+func (e OutboxEvent) message() orderEvent {
+	return orderEvent{ID: e.ID, Type: e.Type, OrderID: e.OrderID, Order: json.RawMessage(e.Payload), OccurredAt: e.CreatedAt}
+}
+
+// recordOrderEvent adds an event about order to the outbox, and queues
+// its webhook deliveries (see webhooks.go). tx must be the transaction
+// making the change.
+func recordOrderEvent(tx *gorm.DB, eventType string, order Order) error {
+	order.setLegacyFields()
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	ev := OutboxEvent{Type: eventType, OrderID: order.ID, Payload: string(payload)}
+	if err := tx.Create(&ev).Error; err != nil {
+		return err
+	}
+	return queueWebhooks(tx, ev)
+}
+
+// outboxWake nudges the relay to publish now rather than at its next poll.
+var outboxWake = make(chan struct{}, 1)
+
+// wakeOutboxRelay is called after a transaction that recorded events
+// commits. It wakes the webhook sender too, which may have deliveries of
+// the same events.
+func wakeOutboxRelay() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+	wakeWebhookSender()
+}
+
+// broker delivers order events. Publish returns nil once the broker has
+// taken ev; on an error the relay publishes it again later. Delivery is
+// therefore at least once: subscribers may see an event twice.
+type broker interface {
+	Publish(ctx context.Context, ev orderEvent) error
+}
+
+// newBroker returns the broker named by OUTBOX_BROKER: "memory" (the
+// default) or "postgres".
+func newBroker() broker {
+	switch name := envOr("OUTBOX_BROKER", "memory"); name {
+	case "postgres":
+		return pgNotifyBroker{db: db, channel: envOr("OUTBOX_CHANNEL", "order_events")}
+	case "memory":
+		return &memoryBroker{}
+	default:
+		log.Fatalf("Unknown OUTBOX_BROKER %q (want memory or postgres)", name)
+		return nil
+	}
+}
+
+// relayOutbox publishes outbox events to b until ctx is done, polling
+// every outboxPollInterval and whenever woken, and purges old published
+// events once an hour.
+func relayOutbox(ctx context.Context, b broker) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+	for {
+		if _, err := publishOutbox(ctx, b); err != nil {
+			log.Printf("outbox: %v", err)
+		}
+		if time.Since(lastPurge) > time.Hour {
+			db.Where("published_at < ?", time.Now().Add(-outboxRetention)).Delete(&OutboxEvent{})
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-outboxWake:
+		}
+	}
+}
+
+// publishOutbox publishes up to a batch of pending events, oldest first,
+// and returns how many went out. It stops at the first failure, so events
+// about an order are never published out of order; the failed event's
+// attempts and last error are recorded and it's first in line next time.
+// The batch stays locked (SELECT ... FOR UPDATE) until it's done, so
+// relays in other replicas wait rather than publish the same events.
+func publishOutbox(ctx context.Context, b broker) (int, error) {
+	published := 0
+	var publishErr error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var pending []OutboxEvent
+		err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where("published_at IS NULL").Order("id").Limit(outboxBatchSize).
+			Find(&pending).Error
+		if err != nil {
+			return err
+		}
+
+		for _, ev := range pending {
+			if publishErr = b.Publish(ctx, ev.message()); publishErr != nil {
+				return tx.Model(&ev).Updates(map[string]any{
+					"attempts":   gorm.Expr("attempts + 1"),
+					"last_error": publishErr.Error(),
+				}).Error
+			}
+			if err := tx.Model(&ev).Update("published_at", time.Now()).Error; err != nil {
+				return err
+			}
+			published++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return published, publishErr
+}
+
+// memoryBroker hands events to subscribers in the same process. It's for
+// local use and tests; with no subscribers, events are simply dropped.
+type memoryBroker struct {
+	mu   sync.Mutex
+	subs []chan orderEvent
+}
+
+// Subscribe returns a channel receiving every event published from now on.
+// Publishing waits for room in it, so a subscriber must keep reading.
+func (b *memoryBroker) Subscribe(buffer int) <-chan orderEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan orderEvent, buffer)
+	b.subs = append(b.subs, ch)
+	return ch
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, ev orderEvent) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// maxNotifyPayload is just under Postgres's 8000-byte NOTIFY limit.
+const maxNotifyPayload = 7999
+
+// pgNotifyBroker publishes each event as a NOTIFY on channel in
+// orderservice's own database, so anything that can LISTEN there can
+// follow orders without more infrastructure.
+type pgNotifyBroker struct {
+	db      *gorm.DB
+	channel string
+}
+
+func (b pgNotifyBroker) Publish(ctx context.Context, ev orderEvent) error {
+	return b.db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", b.channel, notifyPayload(ev)).Error
+}
+
+// notifyPayload is ev as JSON, without the order if that would make it
+// too big for a NOTIFY. Listeners then fetch the order by ID.
+func notifyPayload(ev orderEvent) string {
+	payload, _ := json.Marshal(ev)
+	if len(payload) > maxNotifyPayload {
+		ev.Order = nil
+		payload, _ = json.Marshal(ev)
+	}
+	return string(payload)
+}
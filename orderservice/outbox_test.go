@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+	"shared/authz"
+)
+
+// outboxTypes returns the types of the events in the outbox, oldest first.
+func outboxTypes(t *testing.T) []string {
+	t.Helper()
+	var events []OutboxEvent
+	if err := db.Order("id").Find(&events).Error; err != nil {
+		t.Fatalf("failed to read outbox: %v", err)
+	}
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+	}
+	return types
+}
+
+func TestOrderChangesRecordEvents(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+
+	rec := postOrder(t, `{"user_id":1,"product_id":2,"quantity":1}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := postTransition(t, 1, statusCancelled); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodDelete, "/orders/1", nil), 1))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodPost, "/orders/1/restore", nil), 9, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	want := []string{eventOrderCreated, eventOrderCancelled, eventOrderDeleted, eventOrderUpdated}
+	if got := outboxTypes(t); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected events %v, got %v", want, got)
+	}
+
+	var created OutboxEvent
+	db.First(&created)
+	var order Order
+	if err := json.Unmarshal([]byte(created.Payload), &order); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	if created.OrderID != 1 || order.ID != 1 || order.Status != statusPending || len(order.Items) != 1 {
+		t.Errorf("expected the new order in the payload, got %+v", order)
+	}
+}
+
+// Orders placed through the saga can't be edited once paid for, so the
+// update is made to an order seeded without a payment.
+func TestUpdatingOrderRecordsEvent(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	seedOrder(t, 2, 1, 2000, 7)
+
+	putOrder(t, 1, `{"items":[{"product_id":2,"quantity":2}]}`)
+
+	if got := strings.Join(outboxTypes(t), ","); got != eventOrderUpdated {
+		t.Errorf("expected an %s event, got %s", eventOrderUpdated, got)
+	}
+}
+
+func TestDeletingPendingOrderRecordsCancelThenDelete(t *testing.T) {
+	setupTestDB(t)
+	seedOrder(t, 1, 1, 2000, 0)
+	setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodDelete, "/orders/1", nil), 1))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if got := strings.Join(outboxTypes(t), ","); got != eventOrderCancelled+","+eventOrderDeleted {
+		t.Errorf("expected cancelled then deleted, got %s", got)
+	}
+}
+
+func TestRolledBackChangeRecordsNoEvent(t *testing.T) {
+	setupTestDB(t)
+	order := seedOrder(t, 1, 1, 2000, 0)
+
+	boom := errors.New("boom")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := transitionOrder(tx, &order, statusPaid); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected the transaction to fail, got %v", err)
+	}
+	if got := outboxTypes(t); len(got) != 0 {
+		t.Errorf("expected no events from a rolled-back change, got %v", got)
+	}
+}
+
+func TestPublishOutboxDeliversInOrder(t *testing.T) {
+	setupTestDB(t)
+	for i := 0; i < 3; i++ {
+		order := seedOrder(t, 1, 1, 2000, 0)
+		if err := recordOrderEvent(db, eventOrderCreated, order); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &memoryBroker{}
+	events := b.Subscribe(10)
+	n, err := publishOutbox(context.Background(), b)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 events published, got %d: %v", n, err)
+	}
+	for want := 1; want <= 3; want++ {
+		ev := <-events
+		if ev.ID != want || ev.OrderID != want || ev.Type != eventOrderCreated || len(ev.Order) == 0 {
+			t.Errorf("expected event %d for order %d, got %+v", want, want, ev)
+		}
+	}
+
+	var pending int64
+	db.Model(&OutboxEvent{}).Where("published_at IS NULL").Count(&pending)
+	if pending != 0 {
+		t.Errorf("expected every event marked published, %d pending", pending)
+	}
+	if n, err := publishOutbox(context.Background(), b); err != nil || n != 0 {
+		t.Errorf("expected nothing left to publish, got %d: %v", n, err)
+	}
+}
+
+// flakyBroker fails its first few publishes, then keeps what it is given.
+type flakyBroker struct {
+	failures int
+	got      []orderEvent
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, ev orderEvent) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("broker unavailable")
+	}
+	b.got = append(b.got, ev)
+	return nil
+}
+
+func TestPublishOutboxRetriesFailedEvents(t *testing.T) {
+	setupTestDB(t)
+	for i := 0; i < 2; i++ {
+		order := seedOrder(t, 1, 1, 2000, 0)
+		recordOrderEvent(db, eventOrderCreated, order)
+	}
+
+	b := &flakyBroker{failures: 1}
+	if n, err := publishOutbox(context.Background(), b); err == nil || n != 0 {
+		t.Fatalf("expected the first publish to fail, got %d: %v", n, err)
+	}
+	var first OutboxEvent
+	db.First(&first)
+	if first.PublishedAt != nil || first.Attempts != 1 || first.LastError != "broker unavailable" {
+		t.Errorf("expected the failure recorded, got %+v", first)
+	}
+
+	if n, err := publishOutbox(context.Background(), b); err != nil || n != 2 {
+		t.Fatalf("expected both events on the retry, got %d: %v", n, err)
+	}
+	if len(b.got) != 2 || b.got[0].ID != 1 || b.got[1].ID != 2 {
+		t.Errorf("expected events 1 and 2 in order, got %+v", b.got)
+	}
+}
+
+func TestNotifyPayloadDropsLargeOrders(t *testing.T) {
+	small := orderEvent{ID: 1, Type: eventOrderCreated, OrderID: 1, Order: json.RawMessage(`{"id":1}`)}
+	if !strings.Contains(notifyPayload(small), `"order":{"id":1}`) {
+		t.Errorf("expected a small order to be sent whole, got %s", notifyPayload(small))
+	}
+
+	big := small
+	big.Order = json.RawMessage(`{"note":"` + strings.Repeat("x", maxNotifyPayload) + `"}`)
+	payload := notifyPayload(big)
+	if len(payload) > maxNotifyPayload || strings.Contains(payload, `"order"`) {
+		t.Errorf("expected the order dropped to fit a NOTIFY, got %d bytes", len(payload))
+	}
+	var ev orderEvent
+	if err := json.Unmarshal([]byte(payload), &ev); err != nil || ev.ID != 1 || ev.OrderID != 1 {
+		t.Errorf("expected the event's IDs kept, got %+v: %v", ev, err)
+	}
+}
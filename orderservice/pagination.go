@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"shared/money"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// sortColumns maps the ?sort= values clients may use to their columns.
+// Every sort is tie-broken by id so the ordering is total, which keyset
+// pagination needs to never skip or repeat a row.
+var sortColumns = map[string]string{
+	"id":         "id",
+	"created_at": "created_at",
+	"total":      "total_minor",
+}
+
+// orderPage is the envelope returned by GET /orders and
+// GET /users/{id}/orders.
+type orderPage struct {
+	Items []Order  `json:"items"`
+	Page  pageInfo `json:"page"`
+}
+
+type pageInfo struct {
+	Limit      int    `json:"limit"`
+	Sort       string `json:"sort"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// orderQuery is a parsed, validated order list query string.
+type orderQuery struct {
+	limit         int
+	sort          string // as given by the client, e.g. "-created_at"
+	column        string
+	desc          bool
+	userID        int
+	productID     int
+	statuses      []string
+	createdAfter  *time.Time
+	createdBefore *time.Time
+	minTotal      *money.Money
+	maxTotal      *money.Money
+	after         *cursor
+}
+
+// cursor marks the last row of the previous page. It's handed to clients
+// base64-encoded and should be treated by them as opaque.
+type cursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    int             `json:"id"`
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var c cursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return &c, nil
+}
+
+// parseOrderQuery validates the list parameters. Newest orders come
+// first unless another sort is asked for. Errors are meant to be shown to
+// the client as-is.
+func parseOrderQuery(q url.Values) (orderQuery, error) {
+	oq := orderQuery{limit: defaultPageLimit, sort: "-created_at", column: "created_at", desc: true}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return oq, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		oq.limit = n
+	}
+
+	if v := q.Get("sort"); v != "" {
+		column, ok := sortColumns[strings.TrimPrefix(v, "-")]
+		if !ok {
+			return oq, errors.New("sort must be one of id, created_at, total (prefix with - for descending)")
+		}
+		oq.sort, oq.column, oq.desc = v, column, strings.HasPrefix(v, "-")
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"user_id", &oq.userID}, {"product_id", &oq.productID}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return oq, fmt.Errorf("%s must be a positive integer", p.name)
+		}
+		*p.dst = n
+	}
+
+	if v := q.Get("status"); v != "" {
+		for _, status := range strings.Split(v, ",") {
+			if _, known := orderTransitions[status]; !known {
+				return oq, fmt.Errorf("Unknown status %q", status)
+			}
+			oq.statuses = append(oq.statuses, status)
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"created_after", &oq.createdAfter}, {"created_before", &oq.createdBefore}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return oq, fmt.Errorf("%s must be an RFC 3339 time like 2024-05-01T00:00:00Z", p.name)
+		}
+		*p.dst = &t
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **money.Money
+	}{{"min_total", &oq.minTotal}, {"max_total", &oq.maxTotal}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		m, err := money.Parse(v)
+		if err != nil {
+			return oq, fmt.Errorf("%s must be an amount like 12.50", p.name)
+		}
+		*p.dst = &m
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return oq, err
+		}
+		// A cursor is a position within one particular ordering.
+		if c.Sort != oq.sort {
+			return oq, errors.New("cursor was issued for a different sort")
+		}
+		oq.after = c
+	}
+
+	return oq, nil
+}
+
+// apply adds the filters, keyset condition, ordering and limit to tx. It
+// fetches one row more than the page size so the caller can tell whether
+// another page exists without a separate count query.
+func (oq orderQuery) apply(tx *gorm.DB) (*gorm.DB, error) {
+	if oq.userID != 0 {
+		tx = tx.Where("user_id = ?", oq.userID)
+	}
+	if oq.productID != 0 {
+		tx = tx.Where("id IN (SELECT order_id FROM order_items WHERE product_id = ?)", oq.productID)
+	}
+	if len(oq.statuses) > 0 {
+		tx = tx.Where("status IN ?", oq.statuses)
+	}
+	if oq.createdAfter != nil {
+		tx = tx.Where("created_at >= ?", *oq.createdAfter)
+	}
+	if oq.createdBefore != nil {
+		tx = tx.Where("created_at < ?", *oq.createdBefore)
+	}
+	if oq.minTotal != nil {
+		tx = tx.Where("total_minor >= ?", int64(*oq.minTotal))
+	}
+	if oq.maxTotal != nil {
+		tx = tx.Where("total_minor <= ?", int64(*oq.maxTotal))
+	}
+
+	op, dir := ">", "ASC"
+	if oq.desc {
+		op, dir = "<", "DESC"
+	}
+
+	if oq.after != nil {
+		if oq.column == "id" {
+			tx = tx.Where("id "+op+" ?", oq.after.ID)
+		} else {
+			v, err := oq.cursorValue()
+			if err != nil {
+				return nil, err
+			}
+			tx = tx.Where(
+				fmt.Sprintf("(%[1]s %[2]s ?) OR (%[1]s = ? AND id %[2]s ?)", oq.column, op),
+				v, v, oq.after.ID,
+			)
+		}
+	}
+
+	if oq.column != "id" {
+		tx = tx.Order(oq.column + " " + dir)
+	}
+	return tx.Order("id " + dir).Limit(oq.limit + 1), nil
+}
+
+// cursorValue decodes the cursor's sort value into the column's type, so
+// times compare as times rather than strings.
+func (oq orderQuery) cursorValue() (any, error) {
+	var err error
+	var v any
+	switch oq.column {
+	case "created_at":
+		var t time.Time
+		err = json.Unmarshal(oq.after.Value, &t)
+		v = t
+	default:
+		var n int64
+		err = json.Unmarshal(oq.after.Value, &n)
+		v = n
+	}
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return v, nil
+}
+
+// cursorAfter returns the cursor pointing just past o in this ordering.
+func (oq orderQuery) cursorAfter(o Order) string {
+	var v any
+	switch oq.column {
+	case "created_at":
+		v = o.CreatedAt
+	case "total_minor":
+		// Minor units, matching the column rather than the JSON form.
+		v = int64(o.Total)
+	}
+	raw, _ := json.Marshal(v)
+	return encodeCursor(cursor{Sort: oq.sort, Value: raw, ID: o.ID})
+}
+
+// nextPageURL is the request URL with its cursor swapped for next, used for
+// the Link header so clients can follow pages without building URLs.
+func nextPageURL(u *url.URL, next string) string {
+	q := u.Query()
+	q.Set("cursor", next)
+	return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"shared/authz"
+	"shared/money"
+)
+
+var historyStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// seedHistory stores orders one day apart, starting at historyStart:
+//
+//	id  user  product  total   status
+//	1   1     1        20.00   pending
+//	2   1     3        75.00   paid
+//	3   2     1        40.00   pending
+//	4   1     2        20.00   cancelled
+//	5   1     1        60.00   shipped
+func seedHistory(t *testing.T) {
+	t.Helper()
+	rows := []struct {
+		user, product int
+		total         money.Money
+		status        string
+	}{
+		{1, 1, 2000, statusPending},
+		{1, 3, 7500, statusPaid},
+		{2, 1, 4000, statusPending},
+		{1, 2, 2000, statusCancelled},
+		{1, 1, 6000, statusShipped},
+	}
+	for i, row := range rows {
+		order := Order{
+			UserID: row.user,
+			Status: row.status,
+			Items: []OrderItem{{
+				ProductID: row.product, Quantity: 1, UnitPrice: row.total, LineTotal: row.total,
+			}},
+			Total:     row.total,
+			Currency:  "USD",
+			CreatedAt: historyStart.AddDate(0, 0, i),
+		}
+		if err := db.Create(&order).Error; err != nil {
+			t.Fatalf("failed to seed order: %v", err)
+		}
+	}
+}
+
+// listOrdersAs calls path with the given identity and decodes the page.
+func listOrdersAs(t *testing.T, path string, userID int, roles ...string) (orderPage, *httptest.ResponseRecorder) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, path, nil), userID, roles...))
+
+	var page orderPage
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return page, rec
+}
+
+func ids(orders []Order) string {
+	var out []string
+	for _, o := range orders {
+		out = append(out, fmt.Sprint(o.ID))
+	}
+	return strings.Join(out, ",")
+}
+
+func TestListOrdersFilters(t *testing.T) {
+	setupTestDB(t)
+	seedHistory(t)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "5,4,3,2,1"},
+		{"sort=id", "1,2,3,4,5"},
+		{"sort=-total", "2,5,3,4,1"},
+		{"user_id=1", "5,4,2,1"},
+		{"product_id=1", "5,3,1"},
+		{"status=pending,paid", "3,2,1"},
+		{"created_after=2024-05-02T12:00:00Z", "5,4,3,2"},
+		{"created_after=2024-05-02T00:00:00Z&created_before=2024-05-04T00:00:00Z", "3,2"},
+		{"min_total=20.01", "5,3,2"},
+		{"min_total=40&max_total=60", "5,3"},
+		{"user_id=1&product_id=1&status=shipped", "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			page, rec := listOrdersAs(t, "/orders?"+tt.query, 9, authz.RoleAdmin)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := ids(page.Items); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestListOrdersValidation(t *testing.T) {
+	setupTestDB(t)
+
+	for _, query := range []string{
+		"limit=0", "limit=101", "sort=status", "user_id=abc", "product_id=-1",
+		"status=lost", "created_after=yesterday", "max_total=lots", "cursor=bm9wZQ",
+	} {
+		if _, rec := listOrdersAs(t, "/orders?"+query, 1, authz.RoleAdmin); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestListOrdersWalksAllPages(t *testing.T) {
+	setupTestDB(t)
+	seedHistory(t)
+
+	// Orders 1 and 4 share a total, so this also checks the id tie-breaker
+	// keeps rows from being skipped or repeated at a page boundary.
+	for _, sort := range []string{"-created_at", "total"} {
+		var got []Order
+		query := "limit=2&sort=" + sort
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatal("pagination did not terminate")
+			}
+			page, rec := listOrdersAs(t, "/orders?"+query, 9, authz.RoleAdmin)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			got = append(got, page.Items...)
+			if !page.Page.HasMore {
+				break
+			}
+			if !strings.Contains(rec.Header().Get("Link"), `rel="next"`) {
+				t.Errorf("expected next Link header, got %q", rec.Header().Get("Link"))
+			}
+			query = "limit=2&sort=" + sort + "&cursor=" + url.QueryEscape(page.Page.NextCursor)
+		}
+
+		want := map[string]string{"-created_at": "5,4,3,2,1", "total": "1,4,3,5,2"}[sort]
+		if ids(got) != want {
+			t.Errorf("sort=%s: expected %s, got %s", sort, want, ids(got))
+		}
+	}
+}
+
+func TestCustomerListsOnlyOwnOrders(t *testing.T) {
+	setupTestDB(t)
+	seedHistory(t)
+
+	page, rec := listOrdersAs(t, "/orders?status=pending", 2)
+	if rec.Code != http.StatusOK || ids(page.Items) != "3" {
+		t.Errorf("expected user 2's pending order, got %d %s", rec.Code, ids(page.Items))
+	}
+	if _, rec := listOrdersAs(t, "/orders?user_id=1", 2); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 asking for another user's orders, got %d", rec.Code)
+	}
+}
+
+func TestUserOrderHistory(t *testing.T) {
+	setupTestDB(t)
+	seedHistory(t)
+
+	page, rec := listOrdersAs(t, "/users/1/orders?status=pending,paid", 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ids(page.Items) != "2,1" {
+		t.Errorf("expected user 1's pending and paid orders, got %s", ids(page.Items))
+	}
+
+	if _, rec := listOrdersAs(t, "/users/1/orders", 2); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for another customer's history, got %d", rec.Code)
+	}
+	if page, rec := listOrdersAs(t, "/users/2/orders", 1, authz.RoleSupport); rec.Code != http.StatusOK || ids(page.Items) != "3" {
+		t.Errorf("expected support to read any history, got %d %s", rec.Code, ids(page.Items))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// paymentGateway authorizes payment for orders, and voids authorizations
+// for orders that then fail to be placed or are cancelled.
+type paymentGateway interface {
+	Authorize(ctx context.Context, order Order) (authorizationID string, err error)
+	Void(ctx context.Context, authorizationID string) error
+}
+
+var errPaymentDeclined = errors.New("payment declined")
+
+// payments is the gateway the saga uses: paymentservice.
+var payments paymentGateway = paymentService{}
+
+// paymentService is the paymentGateway backed by paymentservice. An
+// authorization's ID is the ID of its payment there.
+type paymentService struct{}
+
+// Authorize asks paymentservice to hold the order's total. paymentservice
+// keeps one payment per order, so asking again for the same order gets
+// the same payment rather than a second hold.
+func (paymentService) Authorize(ctx context.Context, order Order) (string, error) {
+	payload, _ := json.Marshal(map[string]any{
+		"order_id": order.ID,
+		"user_id":  order.UserID,
+		"amount":   order.Total,
+		"currency": order.Currency,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentServiceURL+"/payments", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := paymentClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+	case http.StatusPaymentRequired:
+		return "", errPaymentDeclined
+	default:
+		return "", fmt.Errorf("payment service returned status: %s", resp.Status)
+	}
+
+	var payment struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payment); err != nil {
+		return "", fmt.Errorf("error decoding payment JSON: %w", err)
+	}
+	return strconv.Itoa(payment.ID), nil
+}
+
+// Void lets an authorization go. Voiding one twice is fine.
+func (paymentService) Void(ctx context.Context, authorizationID string) error {
+	url := fmt.Sprintf("%s/payments/%s/void", paymentServiceURL, authorizationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := paymentClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("payment service returned status: %s", resp.Status)
+	}
+	return nil
+}
+
+// paymentAuthorized reports whether a payment has been authorized for
+// orderID. Orders placed before payments have none.
+func paymentAuthorized(orderID int) (bool, error) {
+	var n int64
+	err := db.Model(&OrderSaga{}).Where("order_id = ? AND payment_id <> ''", orderID).Count(&n).Error
+	return n > 0, err
+}
+
+// voidPaymentOrLog voids the authorization made when orderID was placed,
+// if there is one, on a path that has already decided its response, so a
+// failure can only be logged.
+func voidPaymentOrLog(ctx context.Context, orderID int) {
+	var saga OrderSaga
+	if err := db.Where("order_id = ?", orderID).First(&saga).Error; err != nil || saga.PaymentID == "" {
+		return
+	}
+	if err := payments.Void(ctx, saga.PaymentID); err != nil {
+		log.Printf("failed to void payment %s for order %d: %v", saga.PaymentID, orderID, err)
+	}
+}
+
+// Payment event types that move an order; paymentservice sends others
+// too, which need nothing from us.
+const (
+	paymentCaptured = "payment.captured"
+	paymentRefunded = "payment.refunded"
+)
+
+// paymentEvent is what paymentservice POSTs to /payment-events when a
+// payment changes status.
+type paymentEvent struct {
+	Type      string `json:"type"`
+	PaymentID int    `json:"payment_id"`
+	OrderID   int    `json:"order_id"`
+}
+
+// paymentEventsHandler handles POST /payment-events from paymentservice,
+// moving the order to paid when its payment is captured and to refunded
+// when it's refunded. Events may repeat, so one for a move already made
+// is a no-op. paymentservice retries 5xx responses, which is what an
+// order still being placed gets.
+func paymentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var event paymentEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil || event.OrderID == 0 {
+		http.Error(w, "Invalid payment event", http.StatusBadRequest)
+		return
+	}
+	to := map[string]string{paymentCaptured: statusPaid, paymentRefunded: statusRefunded}[event.Type]
+	if to == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var order Order
+	if err := db.First(&order, event.OrderID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	placing, err := stillPlacing(event.OrderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if placing {
+		http.Error(w, "Order is still being placed", http.StatusServiceUnavailable)
+		return
+	}
+	if order.Status == to {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	from := order.Status
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return transitionOrder(tx, &order, to)
+	})
+	if errors.Is(err, errInvalidTransition) {
+		log.Printf("%s for order %d, which is %s", event.Type, order.ID, from)
+		http.Error(w, fmt.Sprintf("Cannot move order from %s to %s", from, to), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update order status", http.StatusInternalServerError)
+		return
+	}
+	wakeOutboxRelay()
+	w.WriteHeader(http.StatusNoContent)
+}
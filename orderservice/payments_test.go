@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shared/authz"
+)
+
+// paymentVoided is sent by paymentservice but moves no order.
+const paymentVoided = "payment.voided"
+
+// fakePayments stands in for paymentservice, recording what the saga
+// asks of it.
+type fakePayments struct {
+	mu         sync.Mutex
+	decline    bool
+	authorized []int // order IDs
+	voided     []string
+}
+
+func (f *fakePayments) Authorize(ctx context.Context, order Order) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.decline {
+		return "", errPaymentDeclined
+	}
+	f.authorized = append(f.authorized, order.ID)
+	return fmt.Sprintf("auth_%d", order.ID), nil
+}
+
+func (f *fakePayments) Void(ctx context.Context, authorizationID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.voided = append(f.voided, authorizationID)
+	return nil
+}
+
+func useFakePayments(t *testing.T) *fakePayments {
+	t.Helper()
+	fake := &fakePayments{}
+	orig := payments
+	payments = fake
+	t.Cleanup(func() { payments = orig })
+	return fake
+}
+
+// fakePaymentService stands in for paymentservice, answering POST
+// /payments with status and recording the requests it got.
+func fakePaymentService(t *testing.T, status int) *[]*http.Request {
+	t.Helper()
+	var mu sync.Mutex
+	var got []*http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Clone(context.Background()))
+		mu.Unlock()
+		if r.URL.Path == "/payments" {
+			var body map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["order_id"] != 1.0 || body["user_id"] != 2.0 || body["amount"] != 40.0 || body["currency"] != "EUR" {
+				http.Error(w, fmt.Sprintf("unexpected payment %v", body), http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"id":5}`)
+	}))
+	orig := paymentServiceURL
+	paymentServiceURL = srv.URL
+	t.Cleanup(func() {
+		paymentServiceURL = orig
+		srv.Close()
+	})
+	return &got
+}
+
+func TestPaymentServiceAuthorize(t *testing.T) {
+	order := Order{ID: 1, UserID: 2, Total: 4000, Currency: "EUR"}
+	for _, tt := range []struct {
+		status  int
+		wantID  string
+		wantErr string
+	}{
+		{http.StatusCreated, "5", ""},
+		{http.StatusOK, "5", ""}, // already authorized
+		{http.StatusPaymentRequired, "", "payment declined"},
+		{http.StatusBadGateway, "", "502"},
+	} {
+		useFreshClients(t)
+		got := fakePaymentService(t, tt.status)
+
+		id, err := paymentService{}.Authorize(context.Background(), order)
+		if id != tt.wantID || (err == nil) != (tt.wantErr == "") || err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("status %d: expected %q, %q; got %q, %v", tt.status, tt.wantID, tt.wantErr, id, err)
+		}
+		if len(*got) != 1 || (*got)[0].Header.Get(authz.HeaderServiceName) != serviceName {
+			t.Errorf("status %d: expected one call identifying orderservice, got %d", tt.status, len(*got))
+		}
+	}
+}
+
+func TestPaymentServiceVoid(t *testing.T) {
+	useFreshClients(t)
+	got := fakePaymentService(t, http.StatusOK)
+
+	if err := (paymentService{}).Void(context.Background(), "5"); err != nil {
+		t.Fatalf("expected the void to succeed, got %v", err)
+	}
+	if len(*got) != 1 || (*got)[0].Method != http.MethodPost || (*got)[0].URL.Path != "/payments/5/void" {
+		t.Errorf("expected POST /payments/5/void, got %+v", *got)
+	}
+}
+
+func TestCancellingOrderVoidsPayment(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	pay := useFakePayments(t)
+
+	if rec := postOrder(t, `{"product_id":2,"quantity":1}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := postTransition(t, 1, statusCancelled); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(pay.voided) != 1 || pay.voided[0] != "auth_1" {
+		t.Errorf("expected the order's payment voided, got %v", pay.voided)
+	}
+}
+
+func postPaymentEvent(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/payment-events", strings.NewReader(body))
+	req.Header.Set(authz.HeaderServiceName, "paymentservice")
+	rec := httptest.NewRecorder()
+	authz.Authorize(permissions, paymentEventsHandler)(rec, req)
+	return rec
+}
+
+func TestPaymentEventsMoveOrder(t *testing.T) {
+	setupTestDB(t)
+	seedOrder(t, 1, 1, 2000, 0)
+
+	for _, tt := range []struct {
+		event string
+		want  int
+		to    string
+	}{
+		{paymentVoided, http.StatusNoContent, statusPending}, // nothing to do
+		{paymentCaptured, http.StatusNoContent, statusPaid},
+		{paymentCaptured, http.StatusNoContent, statusPaid}, // a repeat
+		{paymentRefunded, http.StatusNoContent, statusRefunded},
+		{paymentCaptured, http.StatusConflict, statusRefunded},
+	} {
+		rec := postPaymentEvent(t, fmt.Sprintf(`{"type":%q,"payment_id":5,"order_id":1}`, tt.event))
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.event, tt.want, rec.Code, rec.Body.String())
+		}
+		var order Order
+		db.First(&order, 1)
+		if order.Status != tt.to {
+			t.Errorf("after %s: expected %s, got %s", tt.event, tt.to, order.Status)
+		}
+	}
+
+	if got := strings.Join(outboxTypes(t), ","); got != eventOrderUpdated+","+eventOrderUpdated {
+		t.Errorf("expected an event for each move, got %s", got)
+	}
+}
+
+func TestPaymentEventsRejected(t *testing.T) {
+	setupTestDB(t)
+	seedAbandonedSaga(t, time.Now())
+
+	for _, tt := range []struct {
+		name string
+		body string
+		want int
+	}{
+		{"no order", `{"type":"payment.captured"}`, http.StatusBadRequest},
+		{"unknown order", `{"type":"payment.captured","order_id":99}`, http.StatusNotFound},
+		{"still placing", `{"type":"payment.captured","order_id":1}`, http.StatusServiceUnavailable},
+	} {
+		if rec := postPaymentEvent(t, tt.body); rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/payment-events", strings.NewReader(`{}`))
+	authz.Authorize(permissions, paymentEventsHandler)(rec, asUser(req, 1, authz.RoleAdmin))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected only services to send payment events, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Product lookups are cached for productCacheTTL. An expired entry is
+// revalidated with If-None-Match rather than dropped, so an unchanged
+// product costs a 304 instead of a full fetch. productservice also tells
+// us when a product changes (POST /product-events), which evicts it early.
+const (
+	productCacheTTL  = 30 * time.Second
+	productCacheSize = 1000
+)
+
+// productCache is a TTL cache of products by ID, evicting the least
+// recently used entry once it holds capacity products.
+type productCache struct {
+	ttl      time.Duration
+	capacity int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[int]*list.Element
+	lru     *list.List // of *cachedProduct, most recently used first
+	stats   cacheStats
+}
+
+type cachedProduct struct {
+	product Product
+	etag    string
+	expires time.Time
+}
+
+// cacheStats are reported under productservice on GET /debug/dependencies.
+type cacheStats struct {
+	Size          int   `json:"size"`
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Revalidated   int64 `json:"revalidated"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+func newProductCache(ttl time.Duration, capacity int) *productCache {
+	return &productCache{
+		ttl:      ttl,
+		capacity: capacity,
+		now:      time.Now,
+		entries:  make(map[int]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+var catalogCache = newProductCache(productCacheTTL, productCacheSize)
+
+// get returns the cached entry for id, if any, and whether it's still
+// fresh. A stale entry is returned so its ETag can be revalidated.
+func (c *productCache) get(id int) (cachedProduct, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok {
+		c.stats.Misses++
+		return cachedProduct{}, false, false
+	}
+	c.lru.MoveToFront(el)
+	entry := *el.Value.(*cachedProduct)
+	if c.now().Before(entry.expires) {
+		c.stats.Hits++
+		return entry, true, true
+	}
+	c.stats.Misses++
+	return entry, true, false
+}
+
+// put stores product, starting a new TTL.
+func (c *productCache) put(product Product, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedProduct{product: product, etag: etag, expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[product.ID]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[product.ID] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedProduct).product.ID)
+		c.stats.Evictions++
+	}
+}
+
+// revalidated restarts the TTL of an entry productservice confirmed is
+// unchanged.
+func (c *productCache) revalidated(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[id]; ok {
+		el.Value.(*cachedProduct).expires = c.now().Add(c.ttl)
+		c.stats.Revalidated++
+	}
+}
+
+// invalidate drops id from the cache.
+func (c *productCache) invalidate(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[id]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+		c.stats.Invalidations++
+	}
+}
+
+func (c *productCache) snapshot() cacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.stats
+	s.Size = c.lru.Len()
+	return s
+}
+
+// productEvent is the notification productservice sends when a product
+// changes or is deleted.
+type productEvent struct {
+	Type      string `json:"type"`
+	ProductID int    `json:"product_id"`
+}
+
+// productEventsHandler handles POST /product-events from productservice.
+// Every event type means the same thing here: our copy may be out of date.
+func productEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var event productEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil || event.ProductID == 0 {
+		http.Error(w, "Invalid product event", http.StatusBadRequest)
+		return
+	}
+
+	catalogCache.invalidate(event.ProductID)
+	w.WriteHeader(http.StatusNoContent)
+}
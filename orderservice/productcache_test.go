@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// etagProductService serves product 2 with an ETag, answering a matching
+// If-None-Match with a 304. It counts full responses and 304s separately.
+func etagProductService(t *testing.T) (full, notModified *atomic.Int32) {
+	t.Helper()
+	useFreshClients(t)
+	full, notModified = &atomic.Int32{}, &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Write([]byte(`{"id":2,"name":"Mouse","price":20}`))
+	}))
+	orig := productServiceURL
+	productServiceURL = srv.URL
+	t.Cleanup(func() {
+		productServiceURL = orig
+		srv.Close()
+	})
+	return full, notModified
+}
+
+func TestGetProductServedFromCache(t *testing.T) {
+	full, _ := etagProductService(t)
+
+	for i := 0; i < 3; i++ {
+		product, err := getProduct(context.Background(), 2)
+		if err != nil || product.Price != 2000 {
+			t.Fatalf("lookup %d: got %+v, %v", i, product, err)
+		}
+	}
+
+	if full.Load() != 1 {
+		t.Errorf("expected 1 request to productservice, got %d", full.Load())
+	}
+	if s := catalogCache.snapshot(); s.Hits != 2 || s.Misses != 1 || s.Size != 1 {
+		t.Errorf("unexpected cache stats: %+v", s)
+	}
+}
+
+func TestGetProductRevalidatesExpiredEntry(t *testing.T) {
+	full, notModified := etagProductService(t)
+	now := time.Now()
+	catalogCache.now = func() time.Time { return now }
+
+	if _, err := getProduct(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(productCacheTTL)
+	product, err := getProduct(context.Background(), 2)
+	if err != nil || product.Name != "Mouse" {
+		t.Fatalf("got %+v, %v", product, err)
+	}
+
+	if full.Load() != 1 || notModified.Load() != 1 {
+		t.Errorf("expected 1 full fetch and 1 revalidation, got %d and %d", full.Load(), notModified.Load())
+	}
+	// The 304 restarted the TTL.
+	if _, err := getProduct(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if s := catalogCache.snapshot(); s.Revalidated != 1 || s.Hits != 1 {
+		t.Errorf("unexpected cache stats: %+v", s)
+	}
+}
+
+func TestProductEventInvalidatesCache(t *testing.T) {
+	full, _ := etagProductService(t)
+	if _, err := getProduct(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/product-events", strings.NewReader(`{"type":"product.updated","product_id":2}`))
+	rec := httptest.NewRecorder()
+	productEventsHandler(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	if _, err := getProduct(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if full.Load() != 2 {
+		t.Errorf("expected the invalidated product to be refetched, got %d fetches", full.Load())
+	}
+	if s := catalogCache.snapshot(); s.Invalidations != 1 {
+		t.Errorf("expected 1 invalidation, got %+v", s)
+	}
+}
+
+func TestProductEventValidation(t *testing.T) {
+	rec := httptest.NewRecorder()
+	productEventsHandler(rec, httptest.NewRequest(http.MethodPost, "/product-events", strings.NewReader(`{"type":"product.updated"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a product_id, got %d", rec.Code)
+	}
+}
+
+func TestProductCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newProductCache(time.Minute, 2)
+	c.put(Product{ID: 1}, "")
+	c.put(Product{ID: 2}, "")
+	c.get(1) // 2 is now the least recently used
+	c.put(Product{ID: 3}, "")
+
+	if _, ok, _ := c.get(2); ok {
+		t.Error("expected product 2 to be evicted")
+	}
+	for _, id := range []int{1, 3} {
+		if _, ok, _ := c.get(id); !ok {
+			t.Errorf("expected product %d to be cached", id)
+		}
+	}
+	if s := c.snapshot(); s.Evictions != 1 || s.Size != 2 {
+		t.Errorf("unexpected cache stats: %+v", s)
+	}
+}
+
+func TestDependenciesHandlerReportsCache(t *testing.T) {
+	etagProductService(t)
+	getProduct(context.Background(), 2)
+	getProduct(context.Background(), 2)
+
+	rec := httptest.NewRecorder()
+	dependenciesHandler(rec, httptest.NewRequest(http.MethodGet, "/debug/dependencies", nil))
+
+	var got map[string]dependencyStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	cache := got["productservice"].Cache
+	if cache == nil || cache.Hits != 1 || cache.Misses != 1 {
+		t.Errorf("expected cache stats under productservice, got %+v", cache)
+	}
+}
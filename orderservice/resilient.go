@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"shared/authz"
+)
+
+// Circuit breaker states. A closed breaker lets every call through; after
+// breakerThreshold consecutive failures it opens and fails calls fast for
+// breakerCooldown, then goes half-open and lets a single trial call decide
+// whether to close again or reopen.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+
+	breakerThreshold = 5
+	breakerCooldown  = 10 * time.Second
+)
+
+// errCircuitOpen is returned without making a request while a
+// dependency's breaker is open.
+var errCircuitOpen = errors.New("circuit open")
+
+// resilientClient makes the calls to one dependency. Idempotent GETs are
+// retried with jittered exponential backoff; everything goes through the
+// dependency's circuit breaker. Transport errors and 5xx responses count
+// as failures, other responses as successes.
+type resilientClient struct {
+	name       string
+	client     *http.Client
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	now        func() time.Time
+
+	mu           sync.Mutex
+	state        string
+	failures     int // consecutive, while closed
+	openedAt     time.Time
+	trialRunning bool
+	stats        dependencyStats
+}
+
+// dependencyStats are cumulative counters for a dependency since startup.
+type dependencyStats struct {
+	Requests       int64 `json:"requests"`
+	Retries        int64 `json:"retries"`
+	Failures       int64 `json:"failures"`
+	ShortCircuited int64 `json:"short_circuited"`
+}
+
+// dependencyStatus is one entry of GET /debug/dependencies.
+type dependencyStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	dependencyStats
+	Cache *cacheStats `json:"cache,omitempty"`
+}
+
+// The per-attempt timeout is short enough that a GET and its retries fit
+// inside the server's 10s WriteTimeout.
+func newResilientClient(name string) *resilientClient {
+	return &resilientClient{
+		name:       name,
+		client:     &http.Client{Timeout: 2 * time.Second},
+		maxRetries: 2,
+		baseDelay:  100 * time.Millisecond,
+		maxDelay:   time.Second,
+		now:        time.Now,
+		state:      breakerClosed,
+	}
+}
+
+// serviceName is how orderservice identifies itself on outgoing calls.
+const serviceName = "orderservice"
+
+var (
+	productClient = newResilientClient("productservice")
+	userClient    = newResilientClient("userservice")
+	paymentClient = newResilientClient("paymentservice")
+)
+
+// Get fetches url with the given extra headers, retrying transport errors and 5xx responses up to
+// maxRetries times. If every attempt fails, the last response (or error)
+// is returned. Cancelling ctx aborts the request in flight and any
+// remaining retries.
+func (c *resilientClient) Get(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := c.Do(req)
+		if errors.Is(err, errCircuitOpen) || !failed(resp, err) || attempt == c.maxRetries || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		c.mu.Lock()
+		c.stats.Retries++
+		c.mu.Unlock()
+
+		timer := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Do sends a single request through the breaker. It's used as-is for
+// calls that aren't safe to repeat, like the reservation POSTs. A request
+// abandoned because its context was cancelled says nothing about the
+// dependency's health, so it isn't counted either way.
+func (c *resilientClient) Do(req *http.Request) (*http.Response, error) {
+	if !c.allow() {
+		return nil, errCircuitOpen
+	}
+	// Identifies us to the other service's authz.Authorize.
+	req.Header.Set(authz.HeaderServiceName, serviceName)
+	resp, err := c.client.Do(req)
+	if err != nil && req.Context().Err() != nil {
+		c.abandon()
+		return nil, err
+	}
+	c.record(!failed(resp, err))
+	return resp, err
+}
+
+func failed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// backoff is "full jitter": a random delay up to baseDelay*2^attempt,
+// capped at maxDelay, so callers retrying together spread out.
+func (c *resilientClient) backoff(attempt int) time.Duration {
+	d := c.baseDelay << attempt
+	if d <= 0 || d > c.maxDelay {
+		d = c.maxDelay
+	}
+	return rand.N(d + 1)
+}
+
+// allow reports whether a call may go out, moving an open breaker to
+// half-open once the cooldown has passed.
+func (c *resilientClient) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Requests++
+	if c.state == breakerOpen && c.now().Sub(c.openedAt) >= breakerCooldown {
+		c.state = breakerHalfOpen
+	}
+	switch {
+	case c.state == breakerOpen, c.state == breakerHalfOpen && c.trialRunning:
+		c.stats.ShortCircuited++
+		return false
+	case c.state == breakerHalfOpen:
+		c.trialRunning = true
+	}
+	return true
+}
+
+func (c *resilientClient) record(success bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if success {
+		c.state = breakerClosed
+		c.failures = 0
+		c.trialRunning = false
+		return
+	}
+
+	c.stats.Failures++
+	c.failures++
+	if c.state == breakerHalfOpen || c.failures >= breakerThreshold {
+		c.state = breakerOpen
+		c.openedAt = c.now()
+		c.trialRunning = false
+	}
+}
+
+// abandon frees the half-open trial slot, if the call held it, without
+// recording an outcome.
+func (c *resilientClient) abandon() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.trialRunning = false
+}
+
+func (c *resilientClient) status() dependencyStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := dependencyStatus{
+		State:               c.state,
+		ConsecutiveFailures: c.failures,
+		dependencyStats:     c.stats,
+	}
+	if c.state != breakerClosed {
+		openedAt := c.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// dependenciesHandler handles GET /debug/dependencies, reporting each
+// dependency's breaker state and call counters, plus the product cache's.
+func dependenciesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := map[string]dependencyStatus{}
+	for _, c := range []*resilientClient{productClient, userClient, paymentClient} {
+		status[c.name] = c.status()
+	}
+	products := status[productClient.name]
+	cache := catalogCache.snapshot()
+	products.Cache = &cache
+	status[productClient.name] = products
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyService fails the first `failures` requests with a 503 and then
+// answers 200, counting every request it sees.
+func flakyService(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id":1,"name":"Mouse","price":20}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func testClient() *resilientClient {
+	c := newResilientClient("test")
+	c.baseDelay = time.Millisecond
+	return c
+}
+
+func TestResilientGetRetriesServerErrors(t *testing.T) {
+	srv, calls := flakyService(t, 2)
+	c := testClient()
+
+	resp, err := c.Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after retries, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls.Load())
+	}
+	if s := c.status(); s.Retries != 2 || s.Failures != 2 || s.State != breakerClosed {
+		t.Errorf("unexpected status after recovery: %+v", s)
+	}
+}
+
+func TestResilientGetGivesUpAfterMaxRetries(t *testing.T) {
+	srv, calls := flakyService(t, 100)
+	c := testClient()
+
+	resp, err := c.Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last 503 to be returned, got %d", resp.StatusCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("expected 1 attempt + 2 retries, got %d", calls.Load())
+	}
+}
+
+func TestResilientGetDoesNotRetryClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	c := testClient()
+
+	resp, err := c.Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 1 {
+		t.Errorf("expected a 404 not to be retried, got %d attempts", calls.Load())
+	}
+	if s := c.status(); s.Failures != 0 {
+		t.Errorf("a 404 shouldn't count as a failure: %+v", s)
+	}
+}
+
+func TestResilientDoDoesNotRetry(t *testing.T) {
+	srv, calls := flakyService(t, 100)
+	c := testClient()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 1 {
+		t.Errorf("expected a POST to be sent once, got %d", calls.Load())
+	}
+}
+
+func TestCircuitBreakerOpensAndFailsFast(t *testing.T) {
+	srv, calls := flakyService(t, 100)
+	c := testClient()
+	c.maxRetries = 0
+
+	for i := 0; i < breakerThreshold; i++ {
+		resp, err := c.Get(context.Background(), srv.URL, nil)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		resp.Body.Close()
+	}
+	if s := c.status(); s.State != breakerOpen || s.OpenedAt == nil {
+		t.Fatalf("expected breaker to open after %d failures: %+v", breakerThreshold, s)
+	}
+
+	if _, err := c.Get(context.Background(), srv.URL, nil); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected errCircuitOpen, got %v", err)
+	}
+	if calls.Load() != breakerThreshold {
+		t.Errorf("open breaker should not reach the service, got %d calls", calls.Load())
+	}
+	if s := c.status(); s.ShortCircuited != 1 {
+		t.Errorf("expected 1 short-circuited call: %+v", s)
+	}
+}
+
+func TestCircuitBreakerHalfOpenTrial(t *testing.T) {
+	srv, _ := flakyService(t, breakerThreshold+1)
+	c := testClient()
+	c.maxRetries = 0
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < breakerThreshold; i++ {
+		resp, _ := c.Get(context.Background(), srv.URL, nil)
+		resp.Body.Close()
+	}
+
+	// The first trial after the cooldown fails and reopens the breaker.
+	now = now.Add(breakerCooldown)
+	resp, err := c.Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("trial request: %v", err)
+	}
+	resp.Body.Close()
+	if s := c.status(); s.State != breakerOpen {
+		t.Fatalf("expected failed trial to reopen the breaker: %+v", s)
+	}
+	if _, err := c.Get(context.Background(), srv.URL, nil); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected reopened breaker to fail fast, got %v", err)
+	}
+
+	// The next trial succeeds and closes it.
+	now = now.Add(breakerCooldown)
+	resp, err = c.Get(context.Background(), srv.URL, nil)
+	if err != nil {
+		t.Fatalf("trial request: %v", err)
+	}
+	resp.Body.Close()
+	if s := c.status(); s.State != breakerClosed || s.ConsecutiveFailures != 0 {
+		t.Fatalf("expected successful trial to close the breaker: %+v", s)
+	}
+}
+
+func TestCreateOrderFailsFastWhenProductServiceCircuitOpen(t *testing.T) {
+	setupTestDB(t)
+	setFakeBackends(t,
+		http.StatusOK, `{"id":1,"name":"Demo User","email":"demo@example.com"}`,
+		http.StatusOK, `{"id":2,"name":"Mouse","price":20}`,
+	)
+	productClient.mu.Lock()
+	productClient.state, productClient.openedAt = breakerOpen, time.Now()
+	productClient.mu.Unlock()
+
+	req := asUser(httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(`{"user_id":1,"product_id":2,"quantity":1}`)), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDependenciesHandler(t *testing.T) {
+	useFreshClients(t)
+	userClient.mu.Lock()
+	userClient.stats.Requests = 3
+	userClient.mu.Unlock()
+
+	rec := httptest.NewRecorder()
+	dependenciesHandler(rec, httptest.NewRequest(http.MethodGet, "/debug/dependencies", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var got map[string]dependencyStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got["productservice"].State != breakerClosed || got["userservice"].Requests != 3 || got["paymentservice"].State != breakerClosed {
+		t.Errorf("unexpected dependencies response: %+v", got)
+	}
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"shared/authz"
+)
+
+// Placing an order is a saga: a series of steps against other services,
+// each with an undo. The saga and its steps are saved as they go, so a
+// failure part way through can always be undone, and a crash picked up
+// where it left off.
+//
+// The order is saved (pending) before the first step, so it has an ID to
+// hang the saga on, but it isn't announced with order.created until the
+// last step. If a step fails, the steps before it are undone and the
+// order is cancelled and deleted: to the customer, it was never placed.
+
+// Saga statuses.
+const (
+	sagaRunning      = "running"
+	sagaCompleted    = "completed"
+	sagaCompensating = "compensating" // a step failed; undoing the others
+	sagaFailed       = "failed"       // undone; the order is cancelled
+)
+
+// Step statuses.
+const (
+	stepPending     = "pending"
+	stepRunning     = "running"
+	stepDone        = "done"
+	stepFailed      = "failed"
+	stepCompensated = "compensated"
+)
+
+// Placement steps, in the order they run.
+const (
+	stepReserveStock     = "reserve_stock"
+	stepAuthorizePayment = "authorize_payment"
+	stepConfirmOrder     = "confirm_order"
+)
+
+const (
+	// sagaStaleAfter is how long a saga can go without progress before
+	// it's taken to have been abandoned by a crashed request. Like
+	// idempotencyLockTimeout, it comfortably exceeds the WriteTimeout.
+	sagaStaleAfter = time.Minute
+	// sagaResumeInterval is how often abandoned sagas are looked for.
+	sagaResumeInterval = 30 * time.Second
+)
+
+// OrderSaga maps to the "order_sagas" table: the placement of one order.
+// PaymentID is the payment authorization, once there is one.
+type OrderSaga struct {
+	ID        int        `json:"id" gorm:"primaryKey"`
+	OrderID   int        `json:"order_id" gorm:"uniqueIndex;not null"`
+	Status    string     `json:"status" gorm:"size:20;not null;index"`
+	PaymentID string     `json:"payment_id,omitempty" gorm:"size:64"`
+	Error     string     `json:"error,omitempty"`
+	Steps     []SagaStep `json:"steps" gorm:"foreignKey:SagaID"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// SagaStep maps to the "saga_steps" table: one step of a saga. Error is
+// why the step failed, or why undoing it did.
+type SagaStep struct {
+	ID        int       `json:"-" gorm:"primaryKey"`
+	SagaID    int       `json:"-" gorm:"index;not null"`
+	Name      string    `json:"name" gorm:"size:32;not null"`
+	Status    string    `json:"status" gorm:"size:20;not null;default:pending"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// placement is a saga in progress and the order it's placing.
+type placement struct {
+	saga  *OrderSaga
+	order *Order
+}
+
+// placementSteps are the steps of placing an order. Each undo reverses
+// its step, including a step that failed or was cut off half way, and is
+// safe to repeat. Confirming has no undo: once it's done, the order is
+// placed.
+var placementSteps = []struct {
+	name string
+	do   func(ctx context.Context, p *placement) error
+	undo func(ctx context.Context, p *placement) error
+}{
+	{stepReserveStock, reserveOrderStock, releaseOrderStock},
+	{stepAuthorizePayment, authorizeOrderPayment, voidOrderPayment},
+	{stepConfirmOrder, confirmOrder, nil},
+}
+
+// startPlacement saves order, pending, along with a new saga to place it.
+func startPlacement(order *Order) (*placement, error) {
+	saga := &OrderSaga{Status: sagaRunning}
+	for _, step := range placementSteps {
+		saga.Steps = append(saga.Steps, SagaStep{Name: step.name, Status: stepPending})
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(order).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&OrderTransition{OrderID: order.ID, To: statusPending}).Error; err != nil {
+			return err
+		}
+		saga.OrderID = order.ID
+		return tx.Create(saga).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &placement{saga: saga, order: order}, nil
+}
+
+// run carries out the saga's steps, skipping any already done, so a saga
+// resumed after a crash carries on from its last finished step. Steps are
+// safe to repeat, so one cut off part way through is simply run again. If
+// a step fails, run undoes the others and returns the name of the step
+// that failed with its error. An undo that fails leaves the saga
+// compensating, for resumeSagas to finish.
+func (p *placement) run(ctx context.Context) (string, error) {
+	for i, step := range placementSteps {
+		if p.saga.Steps[i].Status == stepDone {
+			continue
+		}
+		if err := p.setStep(i, stepRunning, ""); err != nil {
+			return step.name, err
+		}
+		if err := step.do(ctx, p); err != nil {
+			p.setStep(i, stepFailed, err.Error())
+			if err := p.compensate(ctx, step.name+": "+err.Error()); err != nil {
+				log.Printf("order %d: placement saga left compensating: %v", p.order.ID, err)
+			}
+			return step.name, err
+		}
+		if step.undo != nil {
+			if err := p.setStep(i, stepDone, ""); err != nil {
+				return step.name, err
+			}
+		}
+	}
+	return "", nil
+}
+
+// compensate undoes every step that started, newest first, then cancels
+// and deletes the order. It picks up where an earlier attempt left off.
+func (p *placement) compensate(ctx context.Context, reason string) error {
+	if p.saga.Status != sagaCompensating {
+		p.saga.Status, p.saga.Error = sagaCompensating, reason
+		if err := db.Model(p.saga).Updates(map[string]any{"status": p.saga.Status, "error": reason}).Error; err != nil {
+			return err
+		}
+	}
+
+	for i := len(placementSteps) - 1; i >= 0; i-- {
+		step := &p.saga.Steps[i]
+		if step.Status == stepPending || step.Status == stepCompensated || placementSteps[i].undo == nil {
+			continue
+		}
+		// A step's error is why it failed, if it did, then why undoing it
+		// failed, if that did too.
+		cause, _, _ := strings.Cut(step.Error, "undo: ")
+		cause = strings.TrimSuffix(cause, "; ")
+		if err := placementSteps[i].undo(ctx, p); err != nil {
+			msg := "undo: " + err.Error()
+			if cause != "" {
+				msg = cause + "; " + msg
+			}
+			p.setStep(i, step.Status, msg)
+			return fmt.Errorf("undoing %s: %w", step.Name, err)
+		}
+		if err := p.setStep(i, stepCompensated, cause); err != nil {
+			return err
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := rejectOrder(tx, p.order); err != nil {
+			return err
+		}
+		p.saga.Status = sagaFailed
+		return tx.Model(p.saga).Update("status", sagaFailed).Error
+	})
+}
+
+// setStep records the i'th step's progress. It also bumps the saga's
+// updated_at, which is what tells resumeSagas the saga is still alive.
+func (p *placement) setStep(i int, status, errMsg string) error {
+	step := &p.saga.Steps[i]
+	step.Status, step.Error = status, errMsg
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(step).Updates(map[string]any{"status": status, "error": errMsg}).Error; err != nil {
+			return err
+		}
+		return tx.Model(p.saga).Update("updated_at", time.Now()).Error
+	})
+}
+
+// rejectOrder cancels and deletes an order whose placement failed. No
+// events are recorded: as far as subscribers know, it never existed.
+func rejectOrder(tx *gorm.DB, order *Order) error {
+	if order.Status != statusCancelled {
+		if err := tx.Model(&Order{}).Where("id = ?", order.ID).Update("status", statusCancelled).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&OrderTransition{OrderID: order.ID, From: order.Status, To: statusCancelled}).Error; err != nil {
+			return err
+		}
+		order.Status = statusCancelled
+	}
+	return tx.Delete(&Order{}, order.ID).Error
+}
+
+// reserveOrderStock reserves stock for each line, saving each reservation
+// as it's made so it can be released after a crash.
+func reserveOrderStock(ctx context.Context, p *placement) error {
+	for i := range p.order.Items {
+		item := &p.order.Items[i]
+		if item.ReservationID != 0 {
+			continue
+		}
+		reservation, err := reserveStock(ctx, item.ProductID, item.Quantity)
+		if err != nil {
+			return err
+		}
+		if err := db.Model(item).Update("reservation_id", reservation.ID).Error; err != nil {
+			releaseStockOrLog(ctx, item.ProductID, reservation.ID)
+			return err
+		}
+		item.ReservationID = reservation.ID
+	}
+	return nil
+}
+
+// releaseOrderStock releases every reservation the order holds.
+func releaseOrderStock(ctx context.Context, p *placement) error {
+	var errs []error
+	for _, item := range p.order.Items {
+		if item.ReservationID != 0 {
+			errs = append(errs, releaseReservation(ctx, item.ProductID, item.ReservationID))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func authorizeOrderPayment(ctx context.Context, p *placement) error {
+	id, err := payments.Authorize(ctx, *p.order)
+	if err != nil {
+		return err
+	}
+	if err := db.Model(p.saga).Update("payment_id", id).Error; err != nil {
+		if err := payments.Void(ctx, id); err != nil {
+			log.Printf("order %d: failed to void payment %s: %v", p.order.ID, id, err)
+		}
+		return err
+	}
+	p.saga.PaymentID = id
+	return nil
+}
+
+func voidOrderPayment(ctx context.Context, p *placement) error {
+	if p.saga.PaymentID == "" {
+		return nil
+	}
+	return payments.Void(ctx, p.saga.PaymentID)
+}
+
+// confirmOrder completes the saga and announces the order, then turns
+// its stock reservations into sales (see commitItems).
+func confirmOrder(ctx context.Context, p *placement) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		step := &p.saga.Steps[len(p.saga.Steps)-1]
+		if err := tx.Model(step).Updates(map[string]any{"status": stepDone, "error": ""}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(p.saga).Update("status", sagaCompleted).Error; err != nil {
+			return err
+		}
+		return recordOrderEvent(tx, eventOrderCreated, *p.order)
+	})
+	if err != nil {
+		return err
+	}
+	p.saga.Status = sagaCompleted
+	p.saga.Steps[len(p.saga.Steps)-1].Status = stepDone
+	wakeOutboxRelay()
+
+	commitItems(ctx, p.order.ID, p.order.Items)
+	return nil
+}
+
+// writePlacementError reports a failed placement step to the client.
+func writePlacementError(w http.ResponseWriter, step string, err error) {
+	switch {
+	case step == stepReserveStock:
+		writeReservationError(w, err)
+	case errors.Is(err, errPaymentDeclined):
+		http.Error(w, "Payment declined", http.StatusPaymentRequired)
+	case errors.Is(err, errCircuitOpen):
+		http.Error(w, "Payment service unavailable", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Failed to place order: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// stillPlacing reports whether an order's placement saga hasn't finished,
+// in which case the order can't be changed yet. Orders placed before
+// sagas have none.
+func stillPlacing(orderID int) (bool, error) {
+	var n int64
+	err := db.Model(&OrderSaga{}).Where("order_id = ? AND status <> ?", orderID, sagaCompleted).Count(&n).Error
+	return n > 0, err
+}
+
+// checkPlaced writes a 409 and returns false if the order is still being
+// placed.
+func checkPlaced(w http.ResponseWriter, orderID int) bool {
+	placing, err := stillPlacing(orderID)
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return false
+	}
+	if placing {
+		http.Error(w, "Order is still being placed", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// resumeSagas finishes sagas abandoned by a crash, at startup and every
+// sagaResumeInterval after.
+func resumeSagas() {
+	for {
+		resumeAbandonedSagas(context.Background())
+		time.Sleep(sagaResumeInterval)
+	}
+}
+
+// resumeAbandonedSagas finishes every saga that's made no progress for
+// sagaStaleAfter. A running one's request died part way through, so it's
+// run on from its last finished step, and undone only if a step then
+// fails; a compensating one is undone the rest of the way. Each saga is
+// claimed with a conditional update first, so only one replica resumes it.
+func resumeAbandonedSagas(ctx context.Context) {
+	var stale []OrderSaga
+	err := db.Preload("Steps", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		Where("status IN ? AND updated_at < ?", []string{sagaRunning, sagaCompensating}, time.Now().Add(-sagaStaleAfter)).
+		Find(&stale).Error
+	if err != nil {
+		log.Printf("saga: failed to look for abandoned sagas: %v", err)
+		return
+	}
+
+	for i := range stale {
+		saga := &stale[i]
+		claim := db.Model(&OrderSaga{}).
+			Where("id = ? AND updated_at = ?", saga.ID, saga.UpdatedAt).
+			Update("updated_at", time.Now())
+		if claim.Error != nil || claim.RowsAffected == 0 {
+			continue
+		}
+
+		var order Order
+		if err := db.Unscoped().Preload("Items").First(&order, saga.OrderID).Error; err != nil {
+			log.Printf("saga %d: failed to load order %d: %v", saga.ID, saga.OrderID, err)
+			continue
+		}
+		p := &placement{saga: saga, order: &order}
+		if saga.Status == sagaCompensating {
+			if err := p.compensate(ctx, saga.Error); err != nil {
+				log.Printf("saga %d: still compensating: %v", saga.ID, err)
+				continue
+			}
+			log.Printf("saga %d: undid the abandoned placement of order %d", saga.ID, order.ID)
+			continue
+		}
+		if step, err := p.run(ctx); err != nil {
+			log.Printf("saga %d: resumed placement of order %d failed at %s: %v", saga.ID, order.ID, step, err)
+			continue
+		}
+		log.Printf("saga %d: finished the abandoned placement of order %d", saga.ID, order.ID)
+	}
+}
+
+// sagaHandler handles GET /orders/{id}/saga: how the order's placement
+// went, step by step.
+func sagaHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orders/"), "/saga")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	// A failed placement's order is deleted; support can still see it.
+	scope, err := readScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var order Order
+	result := scope.First(&order, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !canViewOrder(authz.RequestCaller(r), order) {
+		http.Error(w, "Order belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	var saga OrderSaga
+	result = db.Preload("Steps", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		Where("order_id = ?", id).First(&saga)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Order was placed before sagas", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch saga", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saga)
+}
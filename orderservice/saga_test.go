@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shared/authz"
+)
+
+// getSaga fetches an order's saga through the API, as support.
+func getSaga(t *testing.T, orderID int) OrderSaga {
+	t.Helper()
+	path := fmt.Sprintf("/orders/%d/saga?include_deleted=true", orderID)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, path, nil), 9, authz.RoleSupport))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var saga OrderSaga
+	if err := json.NewDecoder(rec.Body).Decode(&saga); err != nil {
+		t.Fatalf("failed to decode saga: %v", err)
+	}
+	return saga
+}
+
+// stepStatuses summarizes a saga's steps as "name=status,...".
+func stepStatuses(saga OrderSaga) string {
+	var out []string
+	for _, step := range saga.Steps {
+		out = append(out, step.Name+"="+step.Status)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestPlacementSagaCompletes(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	pay := useFakePayments(t)
+
+	rec := postOrder(t, `{"items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":2}]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	saga := getSaga(t, 1)
+	if saga.Status != sagaCompleted || saga.PaymentID != "auth_1" {
+		t.Errorf("expected a completed saga with the authorization, got %+v", saga)
+	}
+	if got := stepStatuses(saga); got != "reserve_stock=done,authorize_payment=done,confirm_order=done" {
+		t.Errorf("unexpected steps: %s", got)
+	}
+	if len(pay.authorized) != 1 || len(inv.committed) != 2 || len(inv.released) != 0 {
+		t.Errorf("expected payment authorized and stock committed, got authorized=%v committed=%v released=%v",
+			pay.authorized, inv.committed, inv.released)
+	}
+
+	var items []OrderItem
+	db.Where("order_id = ?", 1).Order("id").Find(&items)
+	if len(items) != 2 || items[0].ReservationID != 1 || items[1].ReservationID != 2 {
+		t.Errorf("expected each line's reservation saved, got %+v", items)
+	}
+}
+
+func TestDeclinedPaymentUndoesPlacement(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	pay := useFakePayments(t)
+	pay.decline = true
+
+	rec := postOrder(t, `{"items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":2}]}`)
+	if rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected 402, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(inv.released) != 2 || len(inv.committed) != 0 {
+		t.Errorf("expected both reservations released, got released=%v committed=%v", inv.released, inv.committed)
+	}
+
+	var count int64
+	db.Model(&Order{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected the order hidden, %d visible", count)
+	}
+	var order Order
+	db.Unscoped().First(&order, 1)
+	if order.Status != statusCancelled || !order.DeletedAt.Valid {
+		t.Errorf("expected a cancelled, deleted order, got %s (deleted %v)", order.Status, order.DeletedAt.Valid)
+	}
+	if got := outboxTypes(t); len(got) != 0 {
+		t.Errorf("expected no events for an order that was never placed, got %v", got)
+	}
+
+	saga := getSaga(t, 1)
+	if saga.Status != sagaFailed || !strings.Contains(saga.Error, "payment declined") {
+		t.Errorf("expected a failed saga saying why, got %+v", saga)
+	}
+	if got := stepStatuses(saga); got != "reserve_stock=compensated,authorize_payment=compensated,confirm_order=pending" {
+		t.Errorf("unexpected steps: %s", got)
+	}
+}
+
+func TestOutOfStockSagaFailsAtReservation(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	inv.soldOut[2] = true
+	pay := useFakePayments(t)
+
+	rec := postOrder(t, `{"items":[{"product_id":1,"quantity":1},{"product_id":2,"quantity":1}]}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(pay.authorized) != 0 {
+		t.Errorf("expected no payment authorized, got %v", pay.authorized)
+	}
+	if len(inv.released) != 1 || inv.released[0] != 1 {
+		t.Errorf("expected the first line's reservation released, got %v", inv.released)
+	}
+	if got := stepStatuses(getSaga(t, 1)); got != "reserve_stock=compensated,authorize_payment=pending,confirm_order=pending" {
+		t.Errorf("unexpected steps: %s", got)
+	}
+}
+
+// seedAbandonedSaga stores order 1 as a request that crashed while
+// authorizing payment would leave it: stock reserved (reservation 7), an
+// authorization made, and no progress since updatedAt.
+func seedAbandonedSaga(t *testing.T, updatedAt time.Time) {
+	t.Helper()
+	order := seedOrder(t, 2, 1, 2000, 7)
+	saga := OrderSaga{OrderID: order.ID, Status: sagaRunning, PaymentID: "auth_1", Steps: []SagaStep{
+		{Name: stepReserveStock, Status: stepDone},
+		{Name: stepAuthorizePayment, Status: stepRunning},
+		{Name: stepConfirmOrder, Status: stepPending},
+	}}
+	if err := db.Create(&saga).Error; err != nil {
+		t.Fatalf("failed to seed saga: %v", err)
+	}
+	db.Model(&OrderSaga{}).Where("id = ?", saga.ID).UpdateColumn("updated_at", updatedAt)
+}
+
+func TestUpdateRefusedOncePaymentAuthorized(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	useFakePayments(t)
+	if rec := postOrder(t, `{"items":[{"product_id":2,"quantity":1}]}`); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	body := strings.NewReader(`{"items":[{"product_id":2,"quantity":5}]}`)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodPut, "/orders/1", body), 1))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var stored Order
+	db.Preload("Items").First(&stored, 1)
+	if len(stored.Items) != 1 || stored.Items[0].Quantity != 1 || stored.Total != 2000 {
+		t.Errorf("expected the order to keep the total it was authorized for, got %+v", stored)
+	}
+	if len(inv.reserved) != 1 {
+		t.Errorf("expected no stock reserved for the refused update, got %v", inv.reserved)
+	}
+}
+
+func TestAbandonedSagaIsResumed(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+	pay := useFakePayments(t)
+	seedAbandonedSaga(t, time.Now().Add(-2*sagaStaleAfter))
+
+	resumeAbandonedSagas(context.Background())
+
+	// Stock was already reserved, so it's only committed; the payment step
+	// was cut off, so it's run again.
+	if len(inv.reserved) != 0 || len(inv.committed) != 1 || inv.committed[0] != 7 || len(inv.released) != 0 {
+		t.Errorf("expected reservation 7 committed and nothing else, got reserved=%v committed=%v released=%v",
+			inv.reserved, inv.committed, inv.released)
+	}
+	if len(pay.authorized) != 1 || len(pay.voided) != 0 {
+		t.Errorf("expected the payment authorized and not voided, got authorized=%v voided=%v", pay.authorized, pay.voided)
+	}
+	saga := getSaga(t, 1)
+	if saga.Status != sagaCompleted || saga.PaymentID != "auth_1" {
+		t.Errorf("expected the saga completed, got %+v", saga)
+	}
+	if got := stepStatuses(saga); got != "reserve_stock=done,authorize_payment=done,confirm_order=done" {
+		t.Errorf("unexpected steps: %s", got)
+	}
+	if got := strings.Join(outboxTypes(t), ","); got != eventOrderCreated {
+		t.Errorf("expected the order announced once placed, got %s", got)
+	}
+
+	// Already finished, so a second pass leaves it alone.
+	resumeAbandonedSagas(context.Background())
+	if len(pay.authorized) != 1 || len(inv.committed) != 1 {
+		t.Errorf("expected nothing more, got authorized=%v committed=%v", pay.authorized, inv.committed)
+	}
+}
+
+func TestResumedSagaIsUndoneWhenAStepFails(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+	pay := useFakePayments(t)
+	pay.decline = true
+	seedAbandonedSaga(t, time.Now().Add(-2*sagaStaleAfter))
+
+	resumeAbandonedSagas(context.Background())
+
+	if len(inv.released) != 1 || inv.released[0] != 7 || len(pay.voided) != 1 || pay.voided[0] != "auth_1" {
+		t.Errorf("expected the reservation released and payment voided, got released=%v voided=%v", inv.released, pay.voided)
+	}
+	saga := getSaga(t, 1)
+	if saga.Status != sagaFailed || !strings.Contains(saga.Error, "payment declined") {
+		t.Errorf("expected the saga failed on the declined payment, got %+v", saga)
+	}
+	if got := stepStatuses(saga); got != "reserve_stock=compensated,authorize_payment=compensated,confirm_order=pending" {
+		t.Errorf("unexpected steps: %s", got)
+	}
+}
+
+func TestLiveSagaIsLeftAlone(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+	useFakePayments(t)
+	seedAbandonedSaga(t, time.Now())
+
+	resumeAbandonedSagas(context.Background())
+
+	if len(inv.released) != 0 || getSaga(t, 1).Status != sagaRunning {
+		t.Errorf("expected a saga that's still making progress to be left running")
+	}
+}
+
+func TestFailedUndoIsRetried(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	pay := useFakePayments(t)
+	pay.decline = true
+	inv.releaseDown = true
+
+	if rec := postOrder(t, `{"product_id":2,"quantity":1}`); rec.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected 402, got %d: %s", rec.Code, rec.Body.String())
+	}
+	saga := getSaga(t, 1)
+	if saga.Status != sagaCompensating || !strings.Contains(saga.Steps[0].Error, "undo") {
+		t.Fatalf("expected the saga stuck compensating, got %+v", saga)
+	}
+
+	// While it's being undone, the order can't be changed.
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodDelete, "/orders/1", nil), 1))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 deleting an order still being placed, got %d", rec.Code)
+	}
+	if rec := postTransition(t, 1, statusCancelled); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 cancelling an order still being placed, got %d", rec.Code)
+	}
+
+	inv.releaseDown = false
+	db.Model(&OrderSaga{}).Where("id = ?", saga.ID).UpdateColumn("updated_at", time.Now().Add(-2*sagaStaleAfter))
+	resumeAbandonedSagas(context.Background())
+
+	saga = getSaga(t, 1)
+	if saga.Status != sagaFailed || len(inv.released) != 1 {
+		t.Errorf("expected the retry to finish undoing, got %+v released=%v", saga, inv.released)
+	}
+	if !strings.Contains(saga.Error, "payment declined") || saga.Steps[1].Error != "payment declined" || saga.Steps[0].Error != "" {
+		t.Errorf("expected only the original failure kept, got %+v", saga)
+	}
+}
+
+func TestSagaEndpoint(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+	useFakePayments(t)
+	postOrder(t, `{"product_id":2,"quantity":1}`)
+	seedOrderFor(t, 1) // placed before sagas
+
+	for _, tt := range []struct {
+		path   string
+		userID int
+		want   int
+	}{
+		{"/orders/1/saga", 1, http.StatusOK},
+		{"/orders/1/saga", 2, http.StatusForbidden},
+		{"/orders/2/saga", 1, http.StatusNotFound},
+		{"/orders/99/saga", 1, http.StatusNotFound},
+		{"/orders/abc/saga", 1, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		ordersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, tt.path, nil), tt.userID))
+		if rec.Code != tt.want {
+			t.Errorf("%s as user %d: expected %d, got %d", tt.path, tt.userID, tt.want, rec.Code)
+		}
+	}
+}
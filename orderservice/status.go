@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"shared/authz"
+)
+
+// Order statuses. Every order starts pending.
+const (
+	statusPending   = "pending"
+	statusPaid      = "paid"
+	statusShipped   = "shipped"
+	statusDelivered = "delivered"
+	statusCancelled = "cancelled"
+	statusRefunded  = "refunded"
+)
+
+// orderTransitions lists the statuses each status may move to. Cancelled
+// and refunded are terminal.
+var orderTransitions = map[string][]string{
+	statusPending:   {statusPaid, statusCancelled},
+	statusPaid:      {statusShipped, statusRefunded},
+	statusShipped:   {statusDelivered},
+	statusDelivered: {statusRefunded},
+	statusCancelled: nil,
+	statusRefunded:  nil,
+}
+
+// OrderTransition maps to the "order_transitions" table: one status change
+// of an order and when it happened. Creating an order records the move
+// from "" to pending.
+type OrderTransition struct {
+	ID        int       `json:"id" gorm:"primaryKey"`
+	OrderID   int       `json:"order_id" gorm:"index;not null"`
+	From      string    `json:"from" gorm:"column:from_status;size:20"`
+	To        string    `json:"to" gorm:"column:to_status;size:20;not null"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var errInvalidTransition = errors.New("invalid status transition")
+
+func canTransition(from, to string) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// canModify reports whether an order's items may still be changed or the
+// order deleted. Once it's paid, money has moved and the order is a record
+// that can only progress through transitions.
+func canModify(status string) bool {
+	return status == statusPending
+}
+
+func canDelete(status string) bool {
+	return status == statusPending || status == statusCancelled
+}
+
+// transitionOrder moves an order from one status to another and records
+// the change, in the history and as an event. The UPDATE is conditional
+// on the status the caller saw, so two racing transitions can't both
+// succeed.
+func transitionOrder(tx *gorm.DB, order *Order, to string) error {
+	if !canTransition(order.Status, to) {
+		return errInvalidTransition
+	}
+	result := tx.Model(&Order{}).
+		Where("id = ? AND status = ?", order.ID, order.Status).
+		Update("status", to)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInvalidTransition
+	}
+
+	if err := tx.Create(&OrderTransition{OrderID: order.ID, From: order.Status, To: to}).Error; err != nil {
+		return err
+	}
+	order.Status = to
+
+	event := eventOrderUpdated
+	if to == statusCancelled {
+		event = eventOrderCancelled
+	}
+	return recordOrderEvent(tx, event, *order)
+}
+
+// transitionsHandler handles /orders/{id}/transitions:
+//
+//	GET   the order's status history, oldest first
+//	POST  {"status": "shipped"} moves the order to a new status
+//
+// A move the transition table doesn't allow gets a 409. Cancelling an
+// order returns its reserved stock and voids its payment. Owners may only
+// cancel; every other move is for admins. Paid and refunded can't be set
+// here: they follow the payment (see paymentEventsHandler), so an order
+// is only paid once its payment has been captured in paymentservice.
+func transitionsHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orders/"), "/transitions")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	// Support can read the history of a deleted order with
+	// ?include_deleted=true; deleted orders can't change status.
+	scope := db
+	if r.Method == http.MethodGet {
+		if scope, err = readScope(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	var order Order
+	result := scope.Preload("Items").First(&order, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Order not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c := authz.RequestCaller(r)
+	if r.Method == http.MethodGet && !canViewOrder(c, order) || r.Method != http.MethodGet && !canChangeOrder(c, order) {
+		http.Error(w, "Order belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		history := []OrderTransition{}
+		if err := db.Where("order_id = ?", id).Order("id").Find(&history).Error; err != nil {
+			http.Error(w, "Failed to fetch transitions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
+		return
+	}
+
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if _, known := orderTransitions[req.Status]; !known {
+		http.Error(w, fmt.Sprintf("Unknown status %q", req.Status), http.StatusBadRequest)
+		return
+	}
+	if req.Status == statusPaid || req.Status == statusRefunded {
+		http.Error(w, fmt.Sprintf("Orders become %s through their payment; capture or refund it in paymentservice", req.Status), http.StatusConflict)
+		return
+	}
+	if req.Status != statusCancelled && !c.HasRole(authz.RoleAdmin) {
+		http.Error(w, fmt.Sprintf("Only an admin can mark an order %s", req.Status), http.StatusForbidden)
+		return
+	}
+	if !checkPlaced(w, order.ID) {
+		return
+	}
+
+	from := order.Status
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return transitionOrder(tx, &order, req.Status)
+	})
+	if err != nil {
+		if errors.Is(err, errInvalidTransition) {
+			http.Error(w, fmt.Sprintf("Cannot move order from %s to %s", from, req.Status), http.StatusConflict)
+		} else {
+			http.Error(w, "Failed to update order status", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	wakeOutboxRelay()
+	if order.Status == statusCancelled {
+		releaseItems(r.Context(), order.Items)
+		voidPaymentOrLog(r.Context(), order.ID)
+	}
+	order.setLegacyFields()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shared/authz"
+)
+
+func postTransition(t *testing.T, orderID int, status string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := strings.NewReader(fmt.Sprintf(`{"status":%q}`, status))
+	req := asUser(httptest.NewRequest(http.MethodPost, fmt.Sprintf("/orders/%d/transitions", orderID), body), 1, authz.RoleAdmin)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+	return rec
+}
+
+// setStatus forces an order into a status, bypassing the transition table.
+func setStatus(t *testing.T, orderID int, status string) {
+	t.Helper()
+	if err := db.Model(&Order{}).Where("id = ?", orderID).Update("status", status).Error; err != nil {
+		t.Fatalf("failed to set status: %v", err)
+	}
+}
+
+func TestNewOrderIsPending(t *testing.T) {
+	setupTestDB(t)
+	setFakeCatalog(t, testCatalog)
+
+	rec := postOrder(t, `{"user_id":1,"product_id":2,"quantity":1}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var order Order
+	json.NewDecoder(rec.Body).Decode(&order)
+	if order.Status != statusPending {
+		t.Errorf("expected pending, got %q", order.Status)
+	}
+
+	var history []OrderTransition
+	db.Where("order_id = ?", order.ID).Find(&history)
+	if len(history) != 1 || history[0].From != "" || history[0].To != statusPending || history[0].CreatedAt.IsZero() {
+		t.Errorf("expected creation to be recorded as a transition, got %+v", history)
+	}
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	setupTestDB(t)
+	order := seedOrder(t, 2, 1, 2000, 7)
+
+	// Paid and refunded come from the payment; the rest are admin moves.
+	payment := func(event string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"type":%q,"payment_id":5,"order_id":%d}`, event, order.ID)
+		if rec := postPaymentEvent(t, body); rec.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected 204, got %d: %s", event, rec.Code, rec.Body.String())
+		}
+	}
+	move := func(status string) {
+		t.Helper()
+		rec := postTransition(t, order.ID, status)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("-> %s: expected 200, got %d: %s", status, rec.Code, rec.Body.String())
+		}
+		var got Order
+		json.NewDecoder(rec.Body).Decode(&got)
+		if got.Status != status {
+			t.Errorf("expected status %s, got %s", status, got.Status)
+		}
+	}
+	payment(paymentCaptured)
+	move(statusShipped)
+	move(statusDelivered)
+	payment(paymentRefunded)
+
+	req := asUser(httptest.NewRequest(http.MethodGet, fmt.Sprintf("/orders/%d/transitions", order.ID), nil), 1)
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var history []OrderTransition
+	json.NewDecoder(rec.Body).Decode(&history)
+	want := []string{statusPaid, statusShipped, statusDelivered, statusRefunded}
+	if len(history) != len(want) {
+		t.Fatalf("expected %d transitions, got %+v", len(want), history)
+	}
+	for i, tr := range history {
+		if tr.To != want[i] || tr.CreatedAt.IsZero() {
+			t.Errorf("transition %d: expected timestamped move to %s, got %+v", i, want[i], tr)
+		}
+	}
+}
+
+func TestInvalidTransitionConflicts(t *testing.T) {
+	tests := []struct{ from, to string }{
+		{statusPending, statusShipped},
+		{statusPaid, statusPending},
+		{statusShipped, statusCancelled},
+		{statusCancelled, statusPaid},
+		{statusRefunded, statusPaid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			setupTestDB(t)
+			order := seedOrder(t, 2, 1, 2000, 7)
+			setStatus(t, order.ID, tt.from)
+
+			rec := postTransition(t, order.ID, tt.to)
+			if rec.Code != http.StatusConflict {
+				t.Errorf("expected 409, got %d", rec.Code)
+			}
+			var stored Order
+			db.First(&stored, order.ID)
+			if stored.Status != tt.from {
+				t.Errorf("status should stay %s, got %s", tt.from, stored.Status)
+			}
+		})
+	}
+}
+
+func TestPaymentStatusesFollowThePayment(t *testing.T) {
+	for _, tt := range []struct{ from, to string }{
+		{statusPending, statusPaid},
+		{statusPaid, statusRefunded},
+		{statusDelivered, statusRefunded},
+	} {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			setupTestDB(t)
+			order := seedOrder(t, 2, 1, 2000, 7)
+			setStatus(t, order.ID, tt.from)
+
+			rec := postTransition(t, order.ID, tt.to)
+			if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "payment") {
+				t.Errorf("expected a 409 pointing at the payment, got %d: %s", rec.Code, rec.Body.String())
+			}
+			var stored Order
+			db.First(&stored, order.ID)
+			if stored.Status != tt.from {
+				t.Errorf("status should stay %s, got %s", tt.from, stored.Status)
+			}
+		})
+	}
+}
+
+func TestTransitionValidation(t *testing.T) {
+	setupTestDB(t)
+	order := seedOrder(t, 2, 1, 2000, 7)
+
+	if rec := postTransition(t, order.ID, "teleported"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown status: expected 400, got %d", rec.Code)
+	}
+	if rec := postTransition(t, 999, statusPaid); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown order: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestCancelOrderReleasesStock(t *testing.T) {
+	setupTestDB(t)
+	inv := setFakeCatalog(t, testCatalog)
+	order := seedOrder(t, 2, 1, 2000, 7)
+
+	rec := postTransition(t, order.ID, statusCancelled)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(inv.released) != 1 || inv.released[0] != 7 {
+		t.Errorf("expected reservation 7 released, got %v", inv.released)
+	}
+
+	// Deleting the cancelled order must not release the stock twice.
+	req := asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/orders/%d", order.ID), nil), 1)
+	rec = httptest.NewRecorder()
+	ordersRouter(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if len(inv.released) != 1 {
+		t.Errorf("expected no second release, got %v", inv.released)
+	}
+}
+
+func TestUpdateAndDeleteForbiddenOncePaid(t *testing.T) {
+	for _, status := range []string{statusPaid, statusShipped, statusDelivered, statusRefunded} {
+		t.Run(status, func(t *testing.T) {
+			setupTestDB(t)
+			setFakeCatalog(t, testCatalog)
+			order := seedOrder(t, 2, 1, 2000, 7)
+			setStatus(t, order.ID, status)
+
+			body := strings.NewReader(`{"product_id":2,"quantity":5}`)
+			req := asUser(httptest.NewRequest(http.MethodPut, fmt.Sprintf("/orders/%d", order.ID), body), 1)
+			rec := httptest.NewRecorder()
+			ordersRouter(rec, req)
+			if rec.Code != http.StatusConflict {
+				t.Errorf("PUT: expected 409, got %d", rec.Code)
+			}
+
+			req = asUser(httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/orders/%d", order.ID), nil), 1)
+			rec = httptest.NewRecorder()
+			ordersRouter(rec, req)
+			if rec.Code != http.StatusConflict {
+				t.Errorf("DELETE: expected 409, got %d", rec.Code)
+			}
+		})
+	}
+}
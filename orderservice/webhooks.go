@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"shared/authz"
+)
+
+// Webhook delivery statuses. A delivery is pending until the subscriber
+// answers 2xx (delivered) or it runs out of attempts (dead). Dead
+// deliveries are the dead-letter list; an admin can send one again.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+const (
+	webhookBatchSize    = 50
+	webhookPollInterval = time.Second
+	// A delivery is claimed for this long while it's being sent, longer
+	// than webhookClient's timeout, so another replica won't send it too.
+	webhookLease = 30 * time.Second
+	// Delivered deliveries are kept this long, like published outbox
+	// events, then purged. Dead ones are kept until they're redelivered.
+	webhookRetention = 7 * 24 * time.Hour
+	// webhookSignatureHeader carries "t=<unix time>,v1=<hex HMAC-SHA256>"
+	// over "<unix time>.<body>", keyed with the subscription's secret.
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// Retry schedule: the wait after the nth failed attempt is
+// webhookBaseDelay*2^(n-1), capped at webhookMaxDelay, and a delivery is
+// dead after webhookMaxAttempts. With the defaults that's about 21
+// minutes of trying. Variables so tests can shrink them.
+var (
+	webhookBaseDelay   = 10 * time.Second
+	webhookMaxDelay    = time.Hour
+	webhookMaxAttempts = 8
+	webhookClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+// WebhookSubscription maps to the "webhook_subscriptions" table: a partner
+// URL to POST order events of the given types to. Secret signs each
+// delivery and is only shown when the subscription is created.
+type WebhookSubscription struct {
+	ID         int            `json:"id" gorm:"primaryKey"`
+	URL        string         `json:"url" gorm:"not null"`
+	Secret     string         `json:"secret,omitempty" gorm:"not null"`
+	EventTypes eventTypeList  `json:"event_types" gorm:"type:text;not null"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	DeletedAt  gorm.DeletedAt `json:"deleted_at" gorm:"index"`
+}
+
+// eventTypeList is stored as a comma-separated string.
+type eventTypeList []string
+
+func (l eventTypeList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *eventTypeList) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into an event type list", src)
+	}
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// WebhookDelivery maps to the "webhook_deliveries" table: one event on its
+// way to one subscription. Payload is the event as it's POSTed, the same
+// JSON the outbox publishes.
+type WebhookDelivery struct {
+	ID             int        `json:"id" gorm:"primaryKey"`
+	SubscriptionID int        `json:"subscription_id" gorm:"index;not null"`
+	EventID        int        `json:"event_id" gorm:"not null"`
+	EventType      string     `json:"event_type" gorm:"size:64;not null"`
+	Payload        string     `json:"-" gorm:"not null"`
+	Status         string     `json:"status" gorm:"size:20;not null;index:idx_webhook_deliveries_due,priority:1"`
+	Attempts       int        `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at" gorm:"not null;index:idx_webhook_deliveries_due,priority:2"`
+	LastStatusCode int        `json:"last_status_code,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// queueWebhooks adds a delivery of ev for every subscription that wants
+// its type. It runs in recordOrderEvent's transaction, so a delivery
+// exists exactly when its event does.
+func queueWebhooks(tx *gorm.DB, ev OutboxEvent) error {
+	var subs []WebhookSubscription
+	if err := tx.Find(&subs).Error; err != nil {
+		return err
+	}
+	payload, err := json.Marshal(ev.message())
+	if err != nil {
+		return err
+	}
+	var deliveries []WebhookDelivery
+	for _, sub := range subs {
+		if slices.Contains(sub.EventTypes, ev.Type) {
+			deliveries = append(deliveries, WebhookDelivery{
+				SubscriptionID: sub.ID,
+				EventID:        ev.ID,
+				EventType:      ev.Type,
+				Payload:        string(payload),
+				Status:         deliveryPending,
+				NextAttemptAt:  time.Now(),
+			})
+		}
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return tx.Create(&deliveries).Error
+}
+
+// webhookWake nudges the sender to look for deliveries now rather than at
+// its next poll.
+var webhookWake = make(chan struct{}, 1)
+
+func wakeWebhookSender() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// sendWebhooks sends due deliveries until ctx is done, polling every
+// webhookPollInterval and whenever woken, and purges old delivered ones
+// once an hour.
+func sendWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+	for {
+		if _, err := sendDueWebhooks(ctx); err != nil {
+			log.Printf("webhooks: %v", err)
+		}
+		if time.Since(lastPurge) > time.Hour {
+			db.Where("status = ? AND delivered_at < ?", deliveryDelivered, time.Now().Add(-webhookRetention)).
+				Delete(&WebhookDelivery{})
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+// sendDueWebhooks attempts up to a batch of due deliveries, oldest first,
+// and returns how many it attempted. Unlike the outbox relay it doesn't
+// stop at a failure: one partner being down mustn't hold up the rest, so
+// a subscriber can see an order's events out of order and should go by
+// each event's occurred_at.
+func sendDueWebhooks(ctx context.Context) (int, error) {
+	var due []WebhookDelivery
+	err := db.Where("status = ? AND next_attempt_at <= ?", deliveryPending, time.Now()).
+		Order("next_attempt_at, id").Limit(webhookBatchSize).Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+
+	attempted := 0
+	for _, d := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		// Claim it, unless another replica just did.
+		claim := db.Model(&WebhookDelivery{}).
+			Where("id = ? AND status = ? AND next_attempt_at = ?", d.ID, deliveryPending, d.NextAttemptAt).
+			Update("next_attempt_at", time.Now().Add(webhookLease))
+		if claim.Error != nil {
+			return attempted, claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			continue
+		}
+		if err := attemptWebhook(ctx, d); err != nil {
+			return attempted, err
+		}
+		attempted++
+	}
+	return attempted, nil
+}
+
+// attemptWebhook POSTs d once and records how it went.
+func attemptWebhook(ctx context.Context, d WebhookDelivery) error {
+	var sub WebhookSubscription
+	err := db.First(&sub, d.SubscriptionID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return db.Model(&d).Updates(map[string]any{"status": deliveryDead, "last_error": "subscription deleted"}).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	status, sendErr := postWebhook(ctx, sub, d)
+	d.Attempts++
+	updates := map[string]any{"attempts": d.Attempts, "last_status_code": status}
+	switch {
+	case sendErr == nil:
+		updates["status"] = deliveryDelivered
+		updates["delivered_at"] = time.Now()
+		updates["last_error"] = ""
+	case d.Attempts >= webhookMaxAttempts:
+		updates["status"] = deliveryDead
+		updates["last_error"] = sendErr.Error()
+		log.Printf("webhook delivery %d to %s is dead after %d attempts: %v", d.ID, sub.URL, d.Attempts, sendErr)
+	default:
+		updates["next_attempt_at"] = time.Now().Add(webhookBackoff(d.Attempts))
+		updates["last_error"] = sendErr.Error()
+	}
+	return db.Model(&d).Updates(updates).Error
+}
+
+// webhookBackoff is how long to wait after the nth failed attempt.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookBaseDelay << (attempts - 1)
+	if d <= 0 || d > webhookMaxDelay {
+		d = webhookMaxDelay
+	}
+	return d
+}
+
+// postWebhook sends d to sub, returning the response status, if any, and
+// an error unless it was a 2xx.
+func postWebhook(ctx context.Context, sub WebhookSubscription, d WebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", strconv.Itoa(d.ID))
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set(webhookSignatureHeader, signWebhook(sub.Secret, time.Now(), body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("subscriber returned status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the signature header for body sent at t. The time is
+// signed too, so a subscriber can refuse an old request replayed at it.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookEventTypes are the events a subscription can ask for.
+var webhookEventTypes = []string{eventOrderCreated, eventOrderUpdated, eventOrderCancelled, eventOrderDeleted}
+
+// createWebhookHandler handles POST /webhooks:
+//
+//	{"url": "https://partner.example/hooks", "event_types": ["order.created"], "secret": "..."}
+//
+// The secret is optional; one is generated if it's left out. Either way
+// the response is the only time it's shown.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var sub WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(sub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	if len(sub.EventTypes) == 0 {
+		http.Error(w, "event_types must name at least one event", http.StatusBadRequest)
+		return
+	}
+	for _, t := range sub.EventTypes {
+		if !slices.Contains(webhookEventTypes, t) {
+			http.Error(w, fmt.Sprintf("Unknown event type %q (want one of %s)", t, strings.Join(webhookEventTypes, ", ")),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	slices.Sort(sub.EventTypes)
+	sub.EventTypes = slices.Compact(sub.EventTypes)
+
+	switch {
+	case sub.Secret == "":
+		secret := make([]byte, 24)
+		rand.Read(secret)
+		sub.Secret = "whsec_" + hex.EncodeToString(secret)
+	case len(sub.Secret) < 16:
+		http.Error(w, "secret must be at least 16 characters", http.StatusBadRequest)
+		return
+	}
+
+	sub.ID = 0
+	if err := db.Create(&sub).Error; err != nil {
+		http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+// listWebhooksHandler handles GET /webhooks.
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	subs := []WebhookSubscription{}
+	if err := db.Order("id").Find(&subs).Error; err != nil {
+		http.Error(w, "Failed to fetch webhooks", http.StatusInternalServerError)
+		return
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+// webhookHandler handles GET and DELETE /webhooks/{id}. Deleting a
+// subscription stops its pending deliveries too.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	sub, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := db.Delete(&sub).Error; err != nil {
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	sub.Secret = ""
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sub)
+}
+
+// webhookDeliveriesHandler handles GET /webhooks/{id}/deliveries, newest
+// first. ?status=dead lists the dead letters.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	sub, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	query := db.Where("subscription_id = ?", sub.ID)
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+	case deliveryPending, deliveryDelivered, deliveryDead:
+		query = query.Where("status = ?", status)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown delivery status %q", status), http.StatusBadRequest)
+		return
+	}
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	deliveries := []WebhookDelivery{}
+	if err := query.Order("id DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		http.Error(w, "Failed to fetch deliveries", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redeliverWebhookHandler handles
+// POST /webhooks/{id}/deliveries/{did}/redeliver: send a dead (or already
+// delivered) delivery again, with a fresh set of attempts.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	sub, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	did, err := strconv.Atoi(parts[3])
+	if err != nil {
+		http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+		return
+	}
+
+	var d WebhookDelivery
+	if err := db.Where("subscription_id = ?", sub.ID).First(&d, did).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch delivery", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	result := db.Model(&d).Where("status <> ?", deliveryPending).Updates(map[string]any{
+		"status":          deliveryPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	if result.Error != nil {
+		http.Error(w, "Failed to update delivery", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Delivery is already waiting to be sent", http.StatusConflict)
+		return
+	}
+	wakeWebhookSender()
+
+	db.First(&d, d.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
+
+// loadWebhook fetches the subscription whose ID is the second path
+// segment, writing the error response itself if it can't.
+func loadWebhook(w http.ResponseWriter, r *http.Request) (WebhookSubscription, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return WebhookSubscription{}, false
+	}
+	var sub WebhookSubscription
+	if err := db.First(&sub, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch webhook", http.StatusInternalServerError)
+		}
+		return WebhookSubscription{}, false
+	}
+	return sub, true
+}
+
+// webhooksRouter is the /webhooks entry point, checked against the same
+// permissions as ordersRouter.
+var webhooksRouter = authz.Authorize(permissions, routeWebhooks)
+
+// routeWebhooks dispatches /webhooks requests by method and path.
+func routeWebhooks(w http.ResponseWriter, r *http.Request) {
+	segments := len(strings.Split(strings.Trim(r.URL.Path, "/"), "/"))
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/webhooks":
+		createWebhookHandler(w, r)
+
+	case r.Method == http.MethodGet && segments == 1:
+		listWebhooksHandler(w, r)
+
+	case (r.Method == http.MethodGet || r.Method == http.MethodDelete) && segments == 2:
+		webhookHandler(w, r)
+
+	case r.Method == http.MethodGet && segments == 3:
+		webhookDeliveriesHandler(w, r)
+
+	case r.Method == http.MethodPost && segments == 5:
+		redeliverWebhookHandler(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shared/authz"
+)
+
+// receivedWebhook is one request a webhookReceiver got.
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver is a partner endpoint that answers with the given
+// statuses in turn, then 200, keeping every request it gets.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	got      []receivedWebhook
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	rcv := &webhookReceiver{statuses: statuses}
+	rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+		rcv.got = append(rcv.got, receivedWebhook{header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(rcv.statuses) > 0 {
+			status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rcv.Close)
+	return rcv
+}
+
+func (rcv *webhookReceiver) requests() []receivedWebhook {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]receivedWebhook(nil), rcv.got...)
+}
+
+// webhookRequest sends a request to the /webhooks API as an admin.
+func webhookRequest(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	webhooksRouter(rec, asUser(httptest.NewRequest(method, path, strings.NewReader(body)), 9, authz.RoleAdmin))
+	return rec
+}
+
+// subscribe creates a subscription to url for eventTypes with a known
+// secret.
+func subscribe(t *testing.T, url string, eventTypes ...string) WebhookSubscription {
+	t.Helper()
+	types, _ := json.Marshal(eventTypes)
+	body := fmt.Sprintf(`{"url":%q,"event_types":%s,"secret":"test-secret-0123456789"}`, url, types)
+	rec := webhookRequest(t, http.MethodPost, "/webhooks", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var sub WebhookSubscription
+	json.NewDecoder(rec.Body).Decode(&sub)
+	return sub
+}
+
+// deliveries returns every delivery, oldest first.
+func deliveries(t *testing.T) []WebhookDelivery {
+	t.Helper()
+	var out []WebhookDelivery
+	if err := db.Order("id").Find(&out).Error; err != nil {
+		t.Fatalf("failed to read deliveries: %v", err)
+	}
+	return out
+}
+
+// makeDue moves every pending delivery's next attempt into the past.
+func makeDue(t *testing.T) {
+	t.Helper()
+	db.Model(&WebhookDelivery{}).Where("status = ?", deliveryPending).
+		UpdateColumn("next_attempt_at", time.Now().Add(-time.Second))
+}
+
+func TestCreateWebhook(t *testing.T) {
+	setupTestDB(t)
+
+	rec := webhookRequest(t, http.MethodPost, "/webhooks",
+		`{"url":"https://partner.example/hooks","event_types":["order.updated","order.created","order.created"]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created WebhookSubscription
+	json.NewDecoder(rec.Body).Decode(&created)
+	if !strings.HasPrefix(created.Secret, "whsec_") || strings.Join(created.EventTypes, ",") != "order.created,order.updated" {
+		t.Errorf("expected a generated secret and the event types deduplicated, got %+v", created)
+	}
+
+	// The secret is only shown once.
+	for _, path := range []string{"/webhooks", "/webhooks/1"} {
+		rec = webhookRequest(t, http.MethodGet, path, "")
+		if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), created.Secret) {
+			t.Errorf("%s: expected 200 without the secret, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	var stored WebhookSubscription
+	db.First(&stored, created.ID)
+	if stored.Secret != created.Secret || len(stored.EventTypes) != 2 {
+		t.Errorf("expected the subscription stored as created, got %+v", stored)
+	}
+}
+
+func TestCreateWebhookValidation(t *testing.T) {
+	setupTestDB(t)
+
+	for _, body := range []string{
+		`not json`,
+		`{"url":"partner.example/hooks","event_types":["order.created"]}`,
+		`{"url":"ftp://partner.example/hooks","event_types":["order.created"]}`,
+		`{"url":"https://partner.example/hooks","event_types":[]}`,
+		`{"url":"https://partner.example/hooks","event_types":["order.shipped"]}`,
+		`{"url":"https://partner.example/hooks","event_types":["order.created"],"secret":"short"}`,
+	} {
+		if rec := webhookRequest(t, http.MethodPost, "/webhooks", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestWebhooksAreForAdmins(t *testing.T) {
+	setupTestDB(t)
+
+	rec := httptest.NewRecorder()
+	webhooksRouter(rec, asUser(httptest.NewRequest(http.MethodGet, "/webhooks", nil), 1, authz.RoleSupport))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for support, got %d", rec.Code)
+	}
+}
+
+func TestOrderEventsQueueWebhooks(t *testing.T) {
+	setupTestDB(t)
+	setFakeBackends(t, http.StatusOK, `{}`, http.StatusOK, `{}`)
+	subscribe(t, "https://a.example/hooks", eventOrderCancelled)
+	subscribe(t, "https://b.example/hooks", eventOrderCancelled, eventOrderDeleted)
+	seedOrder(t, 1, 1, 2000, 0)
+
+	rec := httptest.NewRecorder()
+	ordersRouter(rec, asUser(httptest.NewRequest(http.MethodDelete, "/orders/1", nil), 1))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	var got []string
+	for _, d := range deliveries(t) {
+		got = append(got, fmt.Sprintf("%d:%s", d.SubscriptionID, d.EventType))
+		if d.Status != deliveryPending {
+			t.Errorf("expected delivery %d pending, got %s", d.ID, d.Status)
+		}
+	}
+	if want := "1:order.cancelled,2:order.cancelled,2:order.deleted"; strings.Join(got, ",") != want {
+		t.Errorf("expected deliveries %s, got %v", want, got)
+	}
+}
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	setupTestDB(t)
+	rcv := newWebhookReceiver(t)
+	sub := subscribe(t, rcv.URL, eventOrderCreated)
+	order := seedOrder(t, 1, 1, 2000, 0)
+	recordOrderEvent(db, eventOrderCreated, order)
+
+	if n, err := sendDueWebhooks(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected one delivery attempted, got %d: %v", n, err)
+	}
+
+	reqs := rcv.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("expected one request, got %d", len(reqs))
+	}
+	req := reqs[0]
+	var ev orderEvent
+	if err := json.Unmarshal(req.body, &ev); err != nil || ev.ID != 1 || ev.Type != eventOrderCreated || ev.OrderID != order.ID {
+		t.Errorf("expected the order.created event, got %s: %v", req.body, err)
+	}
+	if req.header.Get("X-Webhook-Event") != eventOrderCreated || req.header.Get("X-Webhook-ID") != "1" {
+		t.Errorf("expected event and delivery headers, got %v", req.header)
+	}
+
+	// Check the signature the way a partner would.
+	var ts, sig string
+	fmt.Sscanf(strings.Replace(req.header.Get(webhookSignatureHeader), ",", " ", 1), "t=%s v1=%s", &ts, &sig)
+	mac := hmac.New(sha256.New, []byte(sub.Secret))
+	mac.Write([]byte(ts + "." + string(req.body)))
+	if want := hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Errorf("signature doesn't verify: got %q, want %q", sig, want)
+	}
+
+	d := deliveries(t)[0]
+	if d.Status != deliveryDelivered || d.Attempts != 1 || d.DeliveredAt == nil || d.LastStatusCode != http.StatusOK {
+		t.Errorf("expected the delivery marked delivered, got %+v", d)
+	}
+	if n, _ := sendDueWebhooks(context.Background()); n != 0 {
+		t.Errorf("expected nothing left to send, got %d", n)
+	}
+}
+
+func TestWebhookRetriesThenDies(t *testing.T) {
+	setupTestDB(t)
+	origMax := webhookMaxAttempts
+	webhookMaxAttempts = 3
+	t.Cleanup(func() { webhookMaxAttempts = origMax })
+
+	rcv := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusBadRequest)
+	subscribe(t, rcv.URL, eventOrderCreated)
+	recordOrderEvent(db, eventOrderCreated, seedOrder(t, 1, 1, 2000, 0))
+
+	before := time.Now()
+	sendDueWebhooks(context.Background())
+	d := deliveries(t)[0]
+	if d.Status != deliveryPending || d.Attempts != 1 || d.LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected a failed attempt recorded, got %+v", d)
+	}
+	if wait := d.NextAttemptAt.Sub(before); wait < webhookBaseDelay || wait > webhookBaseDelay+time.Second {
+		t.Errorf("expected the retry in %s, got %s", webhookBaseDelay, wait)
+	}
+	if n, _ := sendDueWebhooks(context.Background()); n != 0 {
+		t.Errorf("expected no retry before the backoff is up, got %d", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		makeDue(t)
+		sendDueWebhooks(context.Background())
+	}
+	d = deliveries(t)[0]
+	if d.Status != deliveryDead || d.Attempts != 3 || !strings.Contains(d.LastError, "400") {
+		t.Errorf("expected the delivery dead after 3 attempts, got %+v", d)
+	}
+	if len(rcv.requests()) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(rcv.requests()))
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  webhookBaseDelay,
+		2:  2 * webhookBaseDelay,
+		4:  8 * webhookBaseDelay,
+		20: webhookMaxDelay,
+		90: webhookMaxDelay,
+	} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("after %d attempts: expected %s, got %s", attempts, want, got)
+		}
+	}
+}
+
+func TestRedeliverDeadWebhook(t *testing.T) {
+	setupTestDB(t)
+	rcv := newWebhookReceiver(t)
+	subscribe(t, rcv.URL, eventOrderCreated)
+	recordOrderEvent(db, eventOrderCreated, seedOrder(t, 1, 1, 2000, 0))
+	recordOrderEvent(db, eventOrderCreated, seedOrder(t, 1, 1, 2000, 0))
+	db.Model(&WebhookDelivery{}).Where("id = ?", 1).Updates(map[string]any{"status": deliveryDead, "attempts": 8, "last_error": "gone"})
+
+	rec := webhookRequest(t, http.MethodGet, "/webhooks/1/deliveries?status=dead", "")
+	var dead []WebhookDelivery
+	json.NewDecoder(rec.Body).Decode(&dead)
+	if rec.Code != http.StatusOK || len(dead) != 1 || dead[0].ID != 1 {
+		t.Fatalf("expected delivery 1 in the dead-letter list, got %d: %+v", rec.Code, dead)
+	}
+
+	rec = webhookRequest(t, http.MethodPost, "/webhooks/1/deliveries/1/redeliver", "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := webhookRequest(t, http.MethodPost, "/webhooks/1/deliveries/1/redeliver", ""); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 redelivering a queued delivery, got %d", rec.Code)
+	}
+
+	sendDueWebhooks(context.Background())
+	for _, d := range deliveries(t) {
+		if d.Status != deliveryDelivered {
+			t.Errorf("expected delivery %d delivered, got %+v", d.ID, d)
+		}
+	}
+	if d := deliveries(t)[0]; d.Attempts != 1 {
+		t.Errorf("expected the redelivery to start its attempts over, got %d", d.Attempts)
+	}
+
+	for path, want := range map[string]int{
+		"/webhooks/1/deliveries/99/redeliver": http.StatusNotFound,
+		"/webhooks/2/deliveries/1/redeliver":  http.StatusNotFound,
+		"/webhooks/1/deliveries/x/redeliver":  http.StatusBadRequest,
+	} {
+		if rec := webhookRequest(t, http.MethodPost, path, ""); rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", path, want, rec.Code)
+		}
+	}
+}
+
+func TestDeletedWebhookStopsDeliveries(t *testing.T) {
+	setupTestDB(t)
+	rcv := newWebhookReceiver(t)
+	subscribe(t, rcv.URL, eventOrderCreated)
+	recordOrderEvent(db, eventOrderCreated, seedOrder(t, 1, 1, 2000, 0))
+
+	if rec := webhookRequest(t, http.MethodDelete, "/webhooks/1", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	sendDueWebhooks(context.Background())
+	recordOrderEvent(db, eventOrderCreated, seedOrder(t, 1, 1, 2000, 0))
+
+	if len(rcv.requests()) != 0 {
+		t.Errorf("expected nothing sent to a deleted subscription, got %d", len(rcv.requests()))
+	}
+	if got := deliveries(t); len(got) != 1 || got[0].Status != deliveryDead || got[0].LastError != "subscription deleted" {
+		t.Errorf("expected the pending delivery dropped and no new one, got %+v", got)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"shared/authz"
+	"shared/money"
+)
+
+// Payment event types, one per status a payment can move to.
+const (
+	paymentAuthorized = "payment.authorized"
+	paymentCaptured   = "payment.captured"
+	paymentVoided     = "payment.voided"
+	paymentRefunded   = "payment.refunded"
+)
+
+// paymentEvent is POSTed to every URL in paymentEventURLs when a payment
+// changes status, so orderservice can move the order along with it. It
+// goes through the outbox (OutboxEvent), so it's sent at least once.
+type paymentEvent struct {
+	Type      string      `json:"type"`
+	PaymentID int         `json:"payment_id"`
+	OrderID   int         `json:"order_id"`
+	Amount    money.Money `json:"amount"`
+	Currency  string      `json:"currency"`
+}
+
+// paymentEventURLs comes from PAYMENT_EVENT_URLS, a comma-separated list.
+// With none set, nothing is sent.
+var paymentEventURLs = splitList(os.Getenv("PAYMENT_EVENT_URLS"))
+
+// serviceName is how paymentservice identifies itself to listeners (see
+// shared/authz).
+const serviceName = "paymentservice"
+
+// Outbox event statuses. An event is pending until its listener answers
+// 2xx (sent), or refuses it with a 4xx or runs out of attempts (dead).
+// Dead events stay in the table, so a lost status change can be found.
+const (
+	eventPending = "pending"
+	eventSent    = "sent"
+	eventDead    = "dead"
+)
+
+const (
+	eventBatchSize    = 100
+	eventPollInterval = time.Second
+	// An event is claimed for this long while it's being sent, longer than
+	// eventClient's timeout, so another replica won't send it too.
+	eventLease = 10 * time.Second
+	// Sent events are kept this long for debugging, then purged.
+	eventRetention = 7 * 24 * time.Hour
+)
+
+// Retry schedule: the wait after the nth failed attempt is
+// eventBaseDelay*2^(n-1), capped at eventMaxDelay, and an event is dead
+// after eventMaxAttempts, about four hours with the defaults. A lost event
+// leaves an order in the wrong status, so it's worth trying for a while.
+// Variables so tests can shrink them.
+var (
+	eventBaseDelay   = time.Second
+	eventMaxDelay    = 5 * time.Minute
+	eventMaxAttempts = 50
+	eventClient      = &http.Client{Timeout: 2 * time.Second}
+)
+
+// OutboxEvent maps to the "outbox_events" table: a payment event on its
+// way to one listener. It's written in the same transaction as the
+// payment change it describes, so a restart can't lose it.
+type OutboxEvent struct {
+	ID            int       `gorm:"primaryKey"`
+	Type          string    `gorm:"size:64;not null"`
+	PaymentID     int       `gorm:"not null"`
+	URL           string    `gorm:"not null"`
+	Payload       string    `gorm:"not null"`
+	Status        string    `gorm:"size:20;not null;index"`
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt time.Time `gorm:"not null"`
+	LastError     string
+	CreatedAt     time.Time
+	SentAt        *time.Time
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// recordPaymentEvent queues an event about p for each listener. tx must
+// be the transaction making the change; call wakeEventRelay once it has
+// committed.
+func recordPaymentEvent(tx *gorm.DB, eventType string, p Payment) error {
+	payload, err := json.Marshal(paymentEvent{
+		Type: eventType, PaymentID: p.ID, OrderID: p.OrderID, Amount: p.Amount, Currency: p.Currency,
+	})
+	if err != nil {
+		return err
+	}
+	var events []OutboxEvent
+	for _, url := range paymentEventURLs {
+		events = append(events, OutboxEvent{
+			Type: eventType, PaymentID: p.ID, URL: url, Payload: string(payload),
+			Status: eventPending, NextAttemptAt: time.Now(),
+		})
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return tx.Create(&events).Error
+}
+
+// eventWake nudges the relay to send now rather than at its next poll.
+var eventWake = make(chan struct{}, 1)
+
+func wakeEventRelay() {
+	select {
+	case eventWake <- struct{}{}:
+	default:
+	}
+}
+
+// relayEvents sends outbox events until ctx is done, polling every
+// eventPollInterval and whenever woken, and purges old sent events once
+// an hour.
+func relayEvents(ctx context.Context) {
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+	for {
+		if _, err := sendDueEvents(ctx); err != nil {
+			log.Printf("payment events: %v", err)
+		}
+		if time.Since(lastPurge) > time.Hour {
+			db.Where("status = ? AND sent_at < ?", eventSent, time.Now().Add(-eventRetention)).Delete(&OutboxEvent{})
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-eventWake:
+		}
+	}
+}
+
+// sendDueEvents attempts up to a batch of pending events, oldest first,
+// and returns how many it attempted. Each listener gets its events in
+// order: once one of them isn't due yet, or fails, the listener's later
+// events wait for it, so orderservice never hears of a refund before the
+// capture. Listeners may still see an event more than once, and must
+// treat a repeat as a no-op.
+func sendDueEvents(ctx context.Context) (int, error) {
+	var pending []OutboxEvent
+	err := db.Where("status = ?", eventPending).Order("id").Limit(eventBatchSize).Find(&pending).Error
+	if err != nil {
+		return 0, err
+	}
+
+	attempted := 0
+	held := make(map[string]bool)
+	for _, ev := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if held[ev.URL] || ev.NextAttemptAt.After(time.Now()) {
+			held[ev.URL] = true
+			continue
+		}
+		// Claim it, unless another replica just did.
+		claim := db.Model(&OutboxEvent{}).
+			Where("id = ? AND status = ? AND next_attempt_at = ?", ev.ID, eventPending, ev.NextAttemptAt).
+			Update("next_attempt_at", time.Now().Add(eventLease))
+		if claim.Error != nil {
+			return attempted, claim.Error
+		}
+		if claim.RowsAffected == 0 {
+			held[ev.URL] = true
+			continue
+		}
+		done, err := attemptEvent(ctx, ev)
+		if err != nil {
+			return attempted, err
+		}
+		if !done {
+			held[ev.URL] = true
+		}
+		attempted++
+	}
+	return attempted, nil
+}
+
+// attemptEvent POSTs ev once and records how it went, reporting whether
+// the listener is done with it: sent, or dead.
+func attemptEvent(ctx context.Context, ev OutboxEvent) (done bool, err error) {
+	retry, sendErr := deliverEvent(ctx, ev.URL, []byte(ev.Payload))
+	ev.Attempts++
+	updates := map[string]any{"attempts": ev.Attempts}
+	switch {
+	case sendErr == nil:
+		done = true
+		updates["status"] = eventSent
+		updates["sent_at"] = time.Now()
+		updates["last_error"] = ""
+	case !retry || ev.Attempts >= eventMaxAttempts:
+		done = true
+		updates["status"] = eventDead
+		updates["last_error"] = sendErr.Error()
+		log.Printf("gave up sending %s for payment %d to %s after %d attempts: %v", ev.Type, ev.PaymentID, ev.URL, ev.Attempts, sendErr)
+	default:
+		updates["next_attempt_at"] = time.Now().Add(eventBackoff(ev.Attempts))
+		updates["last_error"] = sendErr.Error()
+	}
+	return done, db.Model(&ev).Updates(updates).Error
+}
+
+// eventBackoff is how long to wait after the nth failed attempt.
+func eventBackoff(attempts int) time.Duration {
+	d := eventBaseDelay << (attempts - 1)
+	if d <= 0 || d > eventMaxDelay {
+		d = eventMaxDelay
+	}
+	return d
+}
+
+// deliverEvent POSTs payload to url once. On a failure it reports whether
+// it's worth trying again: after no answer or a 5xx, but not a 4xx.
+func deliverEvent(ctx context.Context, url string, payload []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return false, fmt.Errorf("bad event URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(authz.HeaderServiceName, serviceName)
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("error making request: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode >= 500, fmt.Errorf("listener returned status: %s", resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"shared/authz"
+)
+
+// listenForEvents points paymentEventURLs at a test server that answers
+// with the given statuses in turn (then 204), and returns a function that
+// runs the relay until the outbox is drained and reports what was
+// accepted.
+func listenForEvents(t *testing.T, statuses ...int) func() []paymentEvent {
+	t.Helper()
+	var mu sync.Mutex
+	var events []paymentEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authz.HeaderServiceName) != serviceName {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(statuses) > 0 {
+			status := statuses[0]
+			statuses = statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+		var e paymentEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		events = append(events, e)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	origURLs, origDelay := paymentEventURLs, eventBaseDelay
+	paymentEventURLs = []string{srv.URL}
+	eventBaseDelay = time.Nanosecond
+	t.Cleanup(func() {
+		paymentEventURLs, eventBaseDelay = origURLs, origDelay
+		srv.Close()
+	})
+	return func() []paymentEvent {
+		t.Helper()
+		for range 100 {
+			if pendingCount(t) == 0 {
+				break
+			}
+			if _, err := sendDueEvents(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+}
+
+func pendingCount(t *testing.T) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(&OutboxEvent{}).Where("status = ?", eventPending).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func eventTypes(events []paymentEvent) []string {
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestPaymentChangesSendEvents(t *testing.T) {
+	setupTestDB(t)
+	received := listenForEvents(t)
+
+	postPayment(t, `{"order_id":7,"user_id":1,"amount":20}`)
+	postAction(t, 1, "capture")
+	postAction(t, 1, "capture") // no change, no event
+	postAction(t, 1, "refund")
+
+	events := received()
+	for _, e := range events {
+		if e.PaymentID != 1 || e.OrderID != 7 || e.Amount != 2000 || e.Currency != "USD" {
+			t.Errorf("expected events about order 7's payment, got %+v", e)
+		}
+	}
+	want := []string{paymentAuthorized, paymentCaptured, paymentRefunded}
+	if got := eventTypes(events); !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestDeclinedPaymentSendsNoEvent(t *testing.T) {
+	setupTestDB(t)
+	received := listenForEvents(t)
+
+	postPayment(t, `{"order_id":7,"user_id":1,"amount":20.02}`)
+	if events := received(); len(events) != 0 {
+		t.Errorf("expected no events, got %+v", events)
+	}
+}
+
+// Events are queued with the change, so one the relay hasn't sent yet,
+// say because the service restarted, goes out when it next runs.
+func TestEventsAreQueuedWithTheChange(t *testing.T) {
+	setupTestDB(t)
+	received := listenForEvents(t)
+
+	postPayment(t, `{"order_id":7,"user_id":1,"amount":20}`)
+	postAction(t, 1, "capture")
+	var queued []OutboxEvent
+	db.Order("id").Find(&queued)
+	if len(queued) != 2 || queued[0].Type != paymentAuthorized || queued[1].Type != paymentCaptured || queued[1].Status != eventPending {
+		t.Fatalf("expected both events queued, got %+v", queued)
+	}
+
+	if got := eventTypes(received()); !slices.Equal(got, []string{paymentAuthorized, paymentCaptured}) {
+		t.Errorf("expected the queued events sent, got %v", got)
+	}
+}
+
+func TestEventDeliveryRetriesInOrder(t *testing.T) {
+	setupTestDB(t)
+	received := listenForEvents(t, http.StatusServiceUnavailable, http.StatusBadGateway)
+
+	postPayment(t, `{"order_id":7,"user_id":1,"amount":20}`)
+	postAction(t, 1, "capture")
+
+	// The capture waits behind the authorization until it's through.
+	if _, err := sendDueEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var capture OutboxEvent
+	db.Where("type = ?", paymentCaptured).First(&capture)
+	if capture.Attempts != 0 {
+		t.Errorf("expected the capture held back, got %d attempts", capture.Attempts)
+	}
+
+	if got := eventTypes(received()); !slices.Equal(got, []string{paymentAuthorized, paymentCaptured}) {
+		t.Errorf("expected both delivered in order, got %v", got)
+	}
+	var authorized OutboxEvent
+	db.Where("type = ?", paymentAuthorized).First(&authorized)
+	if authorized.Status != eventSent || authorized.Attempts != 3 || authorized.SentAt == nil {
+		t.Errorf("expected the authorization sent on the third try, got %+v", authorized)
+	}
+}
+
+func TestEventDeliveryGivesUp(t *testing.T) {
+	setupTestDB(t)
+	orig := eventMaxAttempts
+	eventMaxAttempts = 3
+	t.Cleanup(func() { eventMaxAttempts = orig })
+	// As many failures as there are attempts, then a 4xx for the next
+	// event, which isn't retried at all.
+	received := listenForEvents(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable, http.StatusBadRequest)
+
+	postPayment(t, `{"order_id":7,"user_id":1,"amount":20}`)
+	postAction(t, 1, "void")
+	if events := received(); len(events) != 0 {
+		t.Errorf("expected nothing delivered, got %+v", events)
+	}
+	var dead []OutboxEvent
+	db.Where("status = ?", eventDead).Order("id").Find(&dead)
+	if len(dead) != 2 || dead[0].Attempts != 3 || dead[1].Attempts != 1 || dead[1].LastError == "" {
+		t.Errorf("expected both events kept as dead, got %+v", dead)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"shared/authz"
+	"shared/migrate"
+	"shared/money"
+)
+
+// Payment statuses. A payment starts authorized (or declined, which is
+// final), then is either captured or voided; a captured payment can be
+// refunded.
+const (
+	statusAuthorized = "authorized"
+	statusDeclined   = "declined"
+	statusCaptured   = "captured"
+	statusVoided     = "voided"
+	statusRefunded   = "refunded"
+)
+
+// Payment maps to the "payments" table: the one payment for an order.
+// Amount is held in minor units of Currency (see money.Money). ProviderRef is
+// the processor's reference for the authorization.
+type Payment struct {
+	ID            int         `json:"id" gorm:"primaryKey"`
+	OrderID       int         `json:"order_id" gorm:"uniqueIndex;not null"`
+	UserID        int         `json:"user_id" gorm:"index;not null"`
+	Amount        money.Money `json:"amount" gorm:"column:amount_minor;not null"`
+	Currency      string      `json:"currency" gorm:"size:3;not null;default:USD"`
+	Status        string      `json:"status" gorm:"size:20;not null"`
+	ProviderRef   string      `json:"provider_ref,omitempty" gorm:"size:128"`
+	DeclineReason string      `json:"decline_reason,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+var db *gorm.DB
+
+// migrationFiles holds the versioned schema migrations (see shared/migrate).
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// openDB connects to the database named by the DB_* environment variables.
+func openDB() *gorm.DB {
+	dsn := fmt.Sprintf(
+		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_NAME"),
+		os.Getenv("DB_PORT"),
+	)
+
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		log.Fatal("Failed to connect to database:", err)
+	}
+	return conn
+}
+
+func initDB() {
+	db = openDB()
+	if err := migrate.OnStartup(db, migrationFiles); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
+	}
+}
+
+// createPaymentRequest is the body of POST /payments.
+type createPaymentRequest struct {
+	OrderID  int         `json:"order_id"`
+	UserID   int         `json:"user_id"`
+	Amount   money.Money `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+// createPaymentHandler handles POST /payments: authorize the amount for an
+// order. An order has at most one payment, so the call is safe to retry:
+// asking again for the same order and amount answers with what happened
+// the first time, without going back to the processor.
+func createPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	var req createPaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.OrderID <= 0 || req.UserID <= 0 {
+		http.Error(w, "order_id and user_id are required", http.StatusBadRequest)
+		return
+	}
+	if req.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if req.Currency == "" {
+		req.Currency = money.DefaultCurrency
+	}
+	currency, ok := money.NormalizeCurrency(req.Currency)
+	if !ok {
+		http.Error(w, "Unsupported currency "+req.Currency, http.StatusBadRequest)
+		return
+	}
+
+	var existing Payment
+	err := db.Where("order_id = ?", req.OrderID).First(&existing).Error
+	if err == nil {
+		writeExistingPayment(w, existing, req, currency)
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Failed to fetch payment", http.StatusInternalServerError)
+		return
+	}
+
+	payment := Payment{OrderID: req.OrderID, UserID: req.UserID, Amount: req.Amount, Currency: currency}
+	ref, err := paymentProvider.Authorize(r.Context(), fmt.Sprintf("order_%d", req.OrderID), req.Amount, currency)
+	var declined declinedError
+	switch {
+	case errors.As(err, &declined):
+		payment.Status = statusDeclined
+		payment.DeclineReason = declined.Reason
+	case err != nil:
+		log.Printf("authorizing payment for order %d: %v", req.OrderID, err)
+		http.Error(w, "Payment provider unavailable", http.StatusBadGateway)
+		return
+	default:
+		payment.Status = statusAuthorized
+		payment.ProviderRef = ref
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+		if payment.Status == statusDeclined {
+			return nil
+		}
+		return recordPaymentEvent(tx, paymentAuthorized, payment)
+	})
+	if err != nil {
+		// Most likely a concurrent request for the same order got there
+		// first; whatever it stored is the answer.
+		if db.Where("order_id = ?", req.OrderID).First(&existing).Error == nil {
+			writeExistingPayment(w, existing, req, currency)
+			return
+		}
+		if payment.Status == statusAuthorized {
+			if err := paymentProvider.Void(context.WithoutCancel(r.Context()), ref); err != nil {
+				log.Printf("failed to void unsaved authorization %s: %v", ref, err)
+			}
+		}
+		http.Error(w, "Failed to save payment", http.StatusInternalServerError)
+		return
+	}
+
+	if payment.Status == statusDeclined {
+		http.Error(w, "Payment declined: "+payment.DeclineReason, http.StatusPaymentRequired)
+		return
+	}
+	wakeEventRelay()
+	writePayment(w, http.StatusCreated, payment)
+}
+
+// writeExistingPayment answers a repeated POST /payments for an order that
+// already has payment p.
+func writeExistingPayment(w http.ResponseWriter, p Payment, req createPaymentRequest, currency string) {
+	if p.UserID != req.UserID || p.Amount != req.Amount || p.Currency != currency {
+		http.Error(w, fmt.Sprintf("Order %d already has a different payment", p.OrderID), http.StatusConflict)
+		return
+	}
+	if p.Status == statusDeclined {
+		http.Error(w, "Payment declined: "+p.DeclineReason, http.StatusPaymentRequired)
+		return
+	}
+	writePayment(w, http.StatusOK, p)
+}
+
+// getPaymentHandler handles GET /payments/{id}. Customers can only see
+// their own payments.
+func getPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	payment, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	c := authz.RequestCaller(r)
+	if payment.UserID != c.UserID && !c.HasRole(authz.RoleSupport, authz.RoleAdmin, authz.RoleService) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	writePayment(w, http.StatusOK, payment)
+}
+
+// paymentAction is a status change made through
+// POST /payments/{id}/{action}: allowed only from status from.
+type paymentAction struct {
+	from, to, event string
+	do              func(ctx context.Context, p Payment) error
+}
+
+var paymentActions = map[string]paymentAction{
+	"capture": {statusAuthorized, statusCaptured, paymentCaptured, func(ctx context.Context, p Payment) error {
+		return paymentProvider.Capture(ctx, p.ProviderRef, p.Amount)
+	}},
+	"void": {statusAuthorized, statusVoided, paymentVoided, func(ctx context.Context, p Payment) error {
+		return paymentProvider.Void(ctx, p.ProviderRef)
+	}},
+	"refund": {statusCaptured, statusRefunded, paymentRefunded, func(ctx context.Context, p Payment) error {
+		return paymentProvider.Refund(ctx, p.ProviderRef, p.Amount)
+	}},
+}
+
+// paymentActionHandler handles POST /payments/{id}/capture, /void and
+// /refund. Asking for the status a payment already has is a no-op that
+// returns it, so callers can retry.
+func paymentActionHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	action, ok := paymentActions[name]
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	payment, ok := loadPayment(w, r)
+	if !ok {
+		return
+	}
+	if payment.Status == action.to {
+		writePayment(w, http.StatusOK, payment)
+		return
+	}
+	if payment.Status != action.from {
+		http.Error(w, fmt.Sprintf("Cannot %s a payment that is %s", name, payment.Status), http.StatusConflict)
+		return
+	}
+
+	if err := action.do(r.Context(), payment); err != nil {
+		log.Printf("%s payment %d: %v", name, payment.ID, err)
+		http.Error(w, "Payment provider failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// Only move the payment if nobody else has since; the processor treats
+	// a repeated call for the same reference as a no-op. The event is
+	// queued in the same transaction, so it goes out exactly when the
+	// change sticks.
+	var changed bool
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Payment{}).
+			Where("id = ? AND status = ?", payment.ID, action.from).
+			Updates(map[string]any{"status": action.to, "updated_at": time.Now()})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		changed = true
+		if err := tx.First(&payment, payment.ID).Error; err != nil {
+			return err
+		}
+		return recordPaymentEvent(tx, action.event, payment)
+	})
+	if err != nil {
+		http.Error(w, "Failed to update payment", http.StatusInternalServerError)
+		return
+	}
+	if !changed {
+		http.Error(w, "Payment changed while being updated; try again", http.StatusConflict)
+		return
+	}
+	wakeEventRelay()
+	writePayment(w, http.StatusOK, payment)
+}
+
+// loadPayment fetches the payment whose ID is the second path segment,
+// writing the error response itself if it can't.
+func loadPayment(w http.ResponseWriter, r *http.Request) (Payment, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		http.Error(w, "Invalid payment ID", http.StatusBadRequest)
+		return Payment{}, false
+	}
+	var payment Payment
+	if err := db.First(&payment, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "Payment not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch payment", http.StatusInternalServerError)
+		}
+		return Payment{}, false
+	}
+	return payment, true
+}
+
+func writePayment(w http.ResponseWriter, status int, p Payment) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// permissions lists who may call each route (see shared/authz). Payments are
+// taken by orderservice; admins can step in by hand, and customers can
+// look at their own.
+var permissions = []authz.Permission{
+	{Method: "POST", Path: "/payments", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+	{Method: "GET", Path: "/payments/{id}", Allow: []string{authz.RoleCustomer, authz.RoleSupport, authz.RoleAdmin, authz.RoleService}},
+	{Method: "POST", Path: "/payments/{id}/capture", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+	{Method: "POST", Path: "/payments/{id}/void", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+	{Method: "POST", Path: "/payments/{id}/refund", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+}
+
+// paymentsRouter is the /payments entry point: authz.Authorize checks the
+// request against permissions, then routePayments dispatches it.
+var paymentsRouter = authz.Authorize(permissions, routePayments)
+
+// routePayments dispatches /payments requests by method and path.
+func routePayments(w http.ResponseWriter, r *http.Request) {
+	segments := len(strings.Split(strings.Trim(r.URL.Path, "/"), "/"))
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/payments":
+		createPaymentHandler(w, r)
+
+	case r.Method == http.MethodGet && segments == 2:
+		getPaymentHandler(w, r)
+
+	case r.Method == http.MethodPost && segments == 3:
+		paymentActionHandler(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// healthzHandler reports whether the service can do its job: alive and
+// able to reach the database. The ping gets a short deadline so a hung
+// DB connection makes the check fail instead of hang.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	sqlDB, err := db.DB()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		http.Error(w, "database unreachable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(openDB(), migrationFiles, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	initDB()
+	paymentProvider = newProvider()
+	go relayEvents(context.Background())
+
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/payments", paymentsRouter)
+	http.HandleFunc("/payments/", paymentsRouter)
+
+	log.Println("Payment Service listening on port 8084")
+	server := &http.Server{
+		Addr:         ":8084",
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	runWithGracefulShutdown(server)
+}
+
+// runWithGracefulShutdown serves until SIGTERM/SIGINT, then gives in-flight
+// requests up to 10s to finish so deploys don't cut anyone off mid-request.
+func runWithGracefulShutdown(server *http.Server) {
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	<-stop
+
+	log.Println("shutting down: waiting for in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Fatal("forced shutdown:", err)
+	}
+	log.Println("shutdown complete")
+}
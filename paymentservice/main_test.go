@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"shared/authz"
+)
+
+// setupTestDB swaps the package-level db for an in-memory SQLite database.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	var err error
+	db, err = gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		// Silence GORM's error-level logging; not-found tests trigger it by design.
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	if err := db.AutoMigrate(&Payment{}, &OutboxEvent{}); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+}
+
+// asUser adds the identity headers the gateway forwards for a verified
+// token.
+func asUser(req *http.Request, userID int, roles ...string) *http.Request {
+	req.Header.Set(authz.HeaderUserID, strconv.Itoa(userID))
+	req.Header.Set(authz.HeaderUserRoles, strings.Join(roles, ","))
+	return req
+}
+
+// asService marks a request as coming from orderservice.
+func asService(req *http.Request) *http.Request {
+	req.Header.Set(authz.HeaderServiceName, "orderservice")
+	return req
+}
+
+func postPayment(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	paymentsRouter(rec, asService(httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(body))))
+	return rec
+}
+
+func postAction(t *testing.T, id int, action string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	path := fmt.Sprintf("/payments/%d/%s", id, action)
+	paymentsRouter(rec, asService(httptest.NewRequest(http.MethodPost, path, nil)))
+	return rec
+}
+
+func decodePayment(t *testing.T, rec *httptest.ResponseRecorder) Payment {
+	t.Helper()
+	var p Payment
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode payment: %v", err)
+	}
+	return p
+}
+
+func TestAuthorizePayment(t *testing.T) {
+	setupTestDB(t)
+
+	rec := postPayment(t, `{"order_id":7,"user_id":1,"amount":20.00,"currency":"usd"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	p := decodePayment(t, rec)
+	if p.Status != statusAuthorized || p.Amount != 2000 || p.Currency != "USD" || p.ProviderRef != "fake_order_7" {
+		t.Errorf("unexpected payment: %+v", p)
+	}
+
+	// Asking again for the same order answers with the same payment.
+	rec = postPayment(t, `{"order_id":7,"user_id":1,"amount":20.00}`)
+	if rec.Code != http.StatusOK || decodePayment(t, rec).ID != p.ID {
+		t.Errorf("expected the existing payment with 200, got %d", rec.Code)
+	}
+	rec = postPayment(t, `{"order_id":7,"user_id":1,"amount":25.00}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for a different amount, got %d", rec.Code)
+	}
+
+	var count int64
+	db.Model(&Payment{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected one payment, got %d", count)
+	}
+}
+
+func TestDeclinedPaymentIsKept(t *testing.T) {
+	setupTestDB(t)
+
+	for i := 0; i < 2; i++ {
+		rec := postPayment(t, `{"order_id":7,"user_id":1,"amount":20.02}`)
+		if rec.Code != http.StatusPaymentRequired || !strings.Contains(rec.Body.String(), "insufficient funds") {
+			t.Fatalf("attempt %d: expected 402 with the reason, got %d: %s", i+1, rec.Code, rec.Body.String())
+		}
+	}
+	var p Payment
+	db.First(&p)
+	if p.Status != statusDeclined || p.DeclineReason != "insufficient funds" {
+		t.Errorf("expected a declined payment, got %+v", p)
+	}
+}
+
+func TestProviderOutageStoresNothing(t *testing.T) {
+	setupTestDB(t)
+
+	if rec := postPayment(t, `{"order_id":7,"user_id":1,"amount":20.03}`); rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var count int64
+	db.Model(&Payment{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no payment saved, got %d", count)
+	}
+}
+
+func TestCreatePaymentValidation(t *testing.T) {
+	setupTestDB(t)
+
+	for _, body := range []string{
+		`not json`,
+		`{"user_id":1,"amount":20}`,
+		`{"order_id":7,"amount":20}`,
+		`{"order_id":7,"user_id":1,"amount":0}`,
+		`{"order_id":7,"user_id":1,"amount":20,"currency":"XXX"}`,
+	} {
+		if rec := postPayment(t, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestPaymentActions(t *testing.T) {
+	setupTestDB(t)
+	postPayment(t, `{"order_id":7,"user_id":1,"amount":20}`)
+
+	for _, tt := range []struct {
+		action string
+		want   int
+		status string
+	}{
+		{"refund", http.StatusConflict, statusAuthorized},
+		{"capture", http.StatusOK, statusCaptured},
+		{"capture", http.StatusOK, statusCaptured}, // a retry is a no-op
+		{"void", http.StatusConflict, statusCaptured},
+		{"refund", http.StatusOK, statusRefunded},
+		{"bogus", http.StatusNotFound, statusRefunded},
+	} {
+		if rec := postAction(t, 1, tt.action); rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d: %s", tt.action, tt.want, rec.Code, rec.Body.String())
+		}
+		var p Payment
+		db.First(&p, 1)
+		if p.Status != tt.status {
+			t.Errorf("after %s: expected %s, got %s", tt.action, tt.status, p.Status)
+		}
+	}
+
+	if rec := postAction(t, 99, "capture"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing payment, got %d", rec.Code)
+	}
+}
+
+func TestGetPaymentPermissions(t *testing.T) {
+	setupTestDB(t)
+	postPayment(t, `{"order_id":7,"user_id":1,"amount":20}`)
+
+	for _, tt := range []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"owner", asUser(httptest.NewRequest(http.MethodGet, "/payments/1", nil), 1, authz.RoleCustomer), http.StatusOK},
+		{"other customer", asUser(httptest.NewRequest(http.MethodGet, "/payments/1", nil), 2, authz.RoleCustomer), http.StatusForbidden},
+		{"support", asUser(httptest.NewRequest(http.MethodGet, "/payments/1", nil), 9, authz.RoleSupport), http.StatusOK},
+		{"service", asService(httptest.NewRequest(http.MethodGet, "/payments/1", nil)), http.StatusOK},
+		{"anonymous", httptest.NewRequest(http.MethodGet, "/payments/1", nil), http.StatusUnauthorized},
+		{"customer capturing", asUser(httptest.NewRequest(http.MethodPost, "/payments/1/capture", nil), 1, authz.RoleCustomer), http.StatusForbidden},
+		{"customer paying", asUser(httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(`{}`)), 1, authz.RoleCustomer), http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		paymentsRouter(rec, tt.req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+-- The schema paymentservice started with.
+
+CREATE TABLE payments (
+    id bigserial PRIMARY KEY,
+    order_id bigint NOT NULL,
+    user_id bigint NOT NULL,
+    amount_minor bigint NOT NULL,
+    currency varchar(3) NOT NULL DEFAULT 'USD',
+    status varchar(20) NOT NULL,
+    provider_ref varchar(128),
+    decline_reason text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE UNIQUE INDEX idx_payments_order_id ON payments (order_id);
+CREATE INDEX idx_payments_user_id ON payments (user_id);
@@ -0,0 +1,17 @@
+-- Payment events waiting for the relay, one row per listener, written in
+-- the same transaction as the payment change they describe.
+
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id bigserial PRIMARY KEY,
+    type varchar(64) NOT NULL,
+    payment_id bigint NOT NULL,
+    url text NOT NULL,
+    payload text NOT NULL,
+    status varchar(20) NOT NULL,
+    attempts bigint NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL,
+    last_error text,
+    created_at timestamptz,
+    sent_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_status ON outbox_events (status);
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"shared/migrate"
+	"shared/pgtest"
+)
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := migrate.Load(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "baseline" {
+		t.Errorf("expected the baseline first, got %+v", migrations)
+	}
+}
+
+// TestMigrationsBuildTheModels runs the real migrations, so it needs
+// Postgres (see pgtest.DSNVar) and is skipped without it.
+func TestMigrationsBuildTheModels(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+	pgtest.CheckColumns(t, conn, &Payment{}, &OutboxEvent{})
+
+	if err := migrate.Command(conn, migrationFiles, []string{"down", "100"}, io.Discard); err != nil {
+		t.Fatalf("migrating down: %v", err)
+	}
+	if conn.Migrator().HasTable(&Payment{}) {
+		t.Error("expected no payments table at version 0")
+	}
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatalf("migrating up again: %v", err)
+	}
+	pgtest.CheckColumns(t, conn, &Payment{}, &OutboxEvent{})
+}
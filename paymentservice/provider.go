@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"shared/money"
+)
+
+// provider is a payment processor. Authorize holds amount on the
+// customer's payment method and returns the processor's reference for
+// the hold; Capture takes the held funds, Void lets the hold go, and
+// Refund gives captured funds back. reference is ours, and the same for
+// every attempt at one payment, so a processor can tell a retry from a
+// second charge.
+type provider interface {
+	Authorize(ctx context.Context, reference string, amount money.Money, currency string) (string, error)
+	Capture(ctx context.Context, providerRef string, amount money.Money) error
+	Void(ctx context.Context, providerRef string) error
+	Refund(ctx context.Context, providerRef string, amount money.Money) error
+}
+
+// declinedError is the processor refusing a payment, as opposed to
+// failing to answer.
+type declinedError struct {
+	Reason string
+}
+
+func (e declinedError) Error() string { return "declined: " + e.Reason }
+
+var errProviderUnavailable = errors.New("payment provider unavailable")
+
+// paymentProvider is the processor in use; main sets it from newProvider.
+var paymentProvider provider = fakeProvider{}
+
+// newProvider returns the processor named by PAYMENT_PROVIDER. Only
+// "fake" (the default) exists so far; a real processor's client would be
+// added here.
+func newProvider() provider {
+	switch name := envOr("PAYMENT_PROVIDER", "fake"); name {
+	case "fake":
+		return fakeProvider{}
+	default:
+		log.Fatalf("Unknown PAYMENT_PROVIDER %q (want fake)", name)
+		return nil
+	}
+}
+
+// fakeProvider stands in for a processor in local runs, dev and tests. It
+// never talks to anyone, and like a processor's test cards, the cents of
+// an amount pick the outcome of authorizing it:
+//
+//	.02  declined, insufficient funds
+//	.03  processor unavailable
+//	else approved
+//
+// Everything after a successful authorization succeeds. References are
+// derived from ours, so every run is the same.
+type fakeProvider struct{}
+
+func (fakeProvider) Authorize(ctx context.Context, reference string, amount money.Money, currency string) (string, error) {
+	switch amount % money.MinorUnits {
+	case 2:
+		return "", declinedError{Reason: "insufficient funds"}
+	case 3:
+		return "", errProviderUnavailable
+	}
+	return "fake_" + reference, nil
+}
+
+func (fakeProvider) Capture(context.Context, string, money.Money) error { return nil }
+func (fakeProvider) Void(context.Context, string) error                 { return nil }
+func (fakeProvider) Refund(context.Context, string, money.Money) error  { return nil }
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFakeProviderOutcomes(t *testing.T) {
+	ctx := context.Background()
+	p := fakeProvider{}
+
+	ref, err := p.Authorize(ctx, "order_1", 2000, "USD")
+	if err != nil || ref != "fake_order_1" {
+		t.Errorf("expected approval with a derived reference, got %q: %v", ref, err)
+	}
+
+	var declined declinedError
+	if _, err := p.Authorize(ctx, "order_2", 2002, "USD"); !errors.As(err, &declined) || declined.Reason != "insufficient funds" {
+		t.Errorf("expected .02 declined, got %v", err)
+	}
+	if _, err := p.Authorize(ctx, "order_3", 103, "USD"); !errors.Is(err, errProviderUnavailable) {
+		t.Errorf("expected .03 unavailable, got %v", err)
+	}
+
+	for name, err := range map[string]error{
+		"capture": p.Capture(ctx, ref, 2000),
+		"void":    p.Void(ctx, ref),
+		"refund":  p.Refund(ctx, ref, 2000),
+	} {
+		if err != nil {
+			t.Errorf("%s: expected success, got %v", name, err)
+		}
+	}
+}
+
+func TestNewProviderDefaultsToFake(t *testing.T) {
+	t.Setenv("PAYMENT_PROVIDER", "")
+	if _, ok := newProvider().(fakeProvider); !ok {
+		t.Errorf("expected the fake provider by default")
+	}
+}
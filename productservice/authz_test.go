@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shared/authz"
+)
+
+func TestProductPermissions(t *testing.T) {
+	tests := []struct {
+		name   string
+		roles  []string // nil: anonymous
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"anyone browses", nil, http.MethodGet, "/products", "", http.StatusOK},
+		{"anyone reads a product", nil, http.MethodGet, "/products/1", "", http.StatusOK},
+		{"anonymous create", nil, http.MethodPost, "/products", `{"name":"Pen","price":2}`, http.StatusUnauthorized},
+		{"customer create", []string{authz.RoleCustomer}, http.MethodPost, "/products", `{"name":"Pen","price":2}`, http.StatusForbidden},
+		{"support edit", []string{authz.RoleSupport}, http.MethodPatch, "/products/1", `{"price":2}`, http.StatusForbidden},
+		{"catalog admin create", []string{authz.RoleCatalogAdmin}, http.MethodPost, "/products", `{"name":"Pen","price":2}`, http.StatusCreated},
+		{"catalog admin edit", []string{authz.RoleCustomer, authz.RoleCatalogAdmin}, http.MethodPatch, "/products/1", `{"price":2}`, http.StatusOK},
+		{"catalog admin delete", []string{authz.RoleCatalogAdmin}, http.MethodDelete, "/products/1", "", http.StatusNoContent},
+		{"support adjusts stock", []string{authz.RoleSupport}, http.MethodPost, "/products/1/stock", `{"delta":1}`, http.StatusForbidden},
+		{"catalog admin adjusts stock", []string{authz.RoleCatalogAdmin}, http.MethodPost, "/products/1/stock", `{"delta":1}`, http.StatusOK},
+		{"customer reserves", []string{authz.RoleCustomer}, http.MethodPost, "/products/1/reservations", `{"quantity":1}`, http.StatusForbidden},
+		{"catalog admin reserves", []string{authz.RoleCatalogAdmin}, http.MethodPost, "/products/1/reservations", `{"quantity":1}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5, Version: 1})
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.roles != nil {
+				asUser(req, 1, tt.roles...)
+			}
+			rec := httptest.NewRecorder()
+			productsRouter(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReservationsAreForServices(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5, Version: 1})
+
+	req := httptest.NewRequest(http.MethodPost, "/products/1/reservations", strings.NewReader(`{"quantity":1}`))
+	req.Header.Set(authz.HeaderServiceName, "orderservice")
+	rec := httptest.NewRecorder()
+	productsRouter(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected orderservice to reserve stock, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
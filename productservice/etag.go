@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"shared/httpcond"
+)
+
+// productETag is a strong validator for a product. Version is bumped by
+// every write to the row, stock changes included, so equal tags mean equal
+// representations.
+func productETag(p Product) string {
+	return fmt.Sprintf(`"%d-%d"`, p.ID, p.Version)
+}
+
+// setValidators adds the ETag and Last-Modified headers for product.
+func setValidators(w http.ResponseWriter, product Product) {
+	w.Header().Set("ETag", productETag(product))
+	if !product.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", product.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// writeProduct sends product with its validators, or a bodiless 304 if the
+// request's conditional headers show the client already has this version.
+func writeProduct(w http.ResponseWriter, r *http.Request, product Product) {
+	setValidators(w, product)
+	if httpcond.NotModified(r, productETag(product), product.UpdatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
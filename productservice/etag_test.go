@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shared/authz"
+)
+
+func getProductWith(t *testing.T, header, value string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	return rec
+}
+
+func TestGetProductIfNoneMatch(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+
+	rec := getProductWith(t, "", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("expected 200 with validators, got %d %v", rec.Code, rec.Header())
+	}
+
+	rec = getProductWith(t, "If-None-Match", `"other", `+etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected empty 304 for a matching tag, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// Any write to the product, a stock reservation included, changes the tag.
+	if _, err := reserveStock(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	rec = getProductWith(t, "If-None-Match", etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Fatalf("expected 200 with a new ETag after a change, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestGetProductIfModifiedSince(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if rec := getProductWith(t, "If-Modified-Since", future); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 when unmodified since, got %d", rec.Code)
+	}
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if rec := getProductWith(t, "If-Modified-Since", past); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 when modified since, got %d", rec.Code)
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	req := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	req.Header.Set("If-Modified-Since", future)
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a mismatched If-None-Match to win, got %d", rec.Code)
+	}
+}
+
+func TestUpdateProductIfMatch(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+	etag := getProductWith(t, "", "").Header().Get("ETag")
+
+	patch := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/products/1", strings.NewReader(`{"price":1250}`))
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+		return rec
+	}
+
+	rec := patch(etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a current If-Match, got %d: %s", rec.Code, rec.Body.String())
+	}
+	newTag := rec.Header().Get("ETag")
+	if newTag == "" || newTag == etag {
+		t.Fatalf("expected the update to return a new ETag, got %q", newTag)
+	}
+
+	// The first tag is now stale.
+	if rec := patch(etag); rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a stale If-Match, got %d", rec.Code)
+	}
+	if rec := patch("*"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for If-Match: *, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"shared/authz"
+)
+
+// Product event types.
+const (
+	productUpdated = "product.updated"
+	productDeleted = "product.deleted"
+)
+
+// productEvent is POSTed to every URL in productEventURLs when a product's
+// details change, so services holding copies (orderservice's cache) can
+// drop them. Stock changes aren't announced.
+type productEvent struct {
+	Type      string `json:"type"`
+	ProductID int    `json:"product_id"`
+}
+
+// productEventURLs comes from PRODUCT_EVENT_URLS, a comma-separated list.
+// With none set, nothing is sent.
+var productEventURLs = splitList(os.Getenv("PRODUCT_EVENT_URLS"))
+
+var eventClient = &http.Client{Timeout: 2 * time.Second}
+
+// serviceName is how productservice identifies itself to listeners (see
+// shared/authz).
+const serviceName = "productservice"
+
+// pendingEvents tracks deliveries still in flight, so tests can wait for
+// them.
+var pendingEvents sync.WaitGroup
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// notifyProductChanged delivers an event to each listener in the
+// background. Delivery is best effort: listeners must also expire what
+// they hold, since a failed notification is only logged.
+func notifyProductChanged(eventType string, productID int) {
+	payload, _ := json.Marshal(productEvent{Type: eventType, ProductID: productID})
+	for _, url := range productEventURLs {
+		pendingEvents.Add(1)
+		go func() {
+			defer pendingEvents.Done()
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+			if err != nil {
+				log.Printf("bad event URL %s: %v", url, err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(authz.HeaderServiceName, serviceName)
+			resp, err := eventClient.Do(req)
+			if err != nil {
+				log.Printf("failed to send %s for product %d to %s: %v", eventType, productID, url, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("%s for product %d rejected by %s: %s", eventType, productID, url, resp.Status)
+			}
+		}()
+	}
+}
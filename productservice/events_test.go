@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"shared/authz"
+)
+
+// listenForEvents points productEventURLs at a test server and returns a
+// function that waits for deliveries and reports what arrived. Like
+// orderservice, the listener only accepts events from a service.
+func listenForEvents(t *testing.T) func() []productEvent {
+	t.Helper()
+	var mu sync.Mutex
+	var events []productEvent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authz.HeaderServiceName) != serviceName {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var e productEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	orig := productEventURLs
+	productEventURLs = []string{srv.URL}
+	t.Cleanup(func() {
+		productEventURLs = orig
+		srv.Close()
+	})
+	return func() []productEvent {
+		pendingEvents.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		return events
+	}
+}
+
+func TestUpdateProductSendsEvent(t *testing.T) {
+	setupTestDB(t)
+	received := listenForEvents(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	req := httptest.NewRequest(http.MethodPatch, "/products/1", strings.NewReader(`{"price":1250}`))
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	events := received()
+	if len(events) != 1 || events[0] != (productEvent{Type: productUpdated, ProductID: 1}) {
+		t.Errorf("expected one product.updated event, got %+v", events)
+	}
+}
+
+func TestDeleteProductSendsEvent(t *testing.T) {
+	setupTestDB(t)
+	received := listenForEvents(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(httptest.NewRequest(http.MethodDelete, "/products/1", nil), 1, authz.RoleAdmin))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	events := received()
+	if len(events) != 1 || events[0] != (productEvent{Type: productDeleted, ProductID: 1}) {
+		t.Errorf("expected one product.deleted event, got %+v", events)
+	}
+}
+
+func TestFailedUpdateSendsNoEvent(t *testing.T) {
+	setupTestDB(t)
+	received := listenForEvents(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	req := httptest.NewRequest(http.MethodPatch, "/products/1", strings.NewReader(`{"price":-1}`))
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+
+	if events := received(); len(events) != 0 {
+		t.Errorf("expected no events, got %+v", events)
+	}
+}
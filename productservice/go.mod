@@ -2,6 +2,8 @@ module productservice
 
 go 1.24.2
 
+require shared v0.0.0
+
 require (
 	gorm.io/driver/postgres v1.5.11
 	gorm.io/gorm v1.26.0
@@ -29,3 +31,5 @@ require (
 	modernc.org/memory v1.5.0 // indirect
 	modernc.org/sqlite v1.23.1 // indirect
 )
+
+replace shared => ../shared
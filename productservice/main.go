@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -16,18 +18,39 @@ import (
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"shared/authz"
+	"shared/httpcond"
+	"shared/migrate"
+	"shared/money"
 )
 
-// Product maps to the "products" table.
+// Product maps to the "products" table. Price is held in minor units of
+// Currency (see money.Money). Stock is the number of units available to sell;
+// units held by open reservations are already deducted.
 type Product struct {
-	ID    int     `json:"id" gorm:"primaryKey"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	ID       int         `json:"id" gorm:"primaryKey"`
+	Name     string      `json:"name"`
+	Price    money.Money `json:"price" gorm:"column:price_minor;not null;default:0"`
+	Currency string      `json:"currency" gorm:"size:3;not null;default:USD"`
+	Stock    int         `json:"stock" gorm:"not null;default:0;check:chk_products_stock,stock >= 0"`
+
+	// Version counts writes to the row and backs the ETag (see etag.go).
+	Version   int            `json:"-" gorm:"not null;default:1"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"deleted_at,omitzero" gorm:"index"`
 }
 
 var db *gorm.DB
 
-func initDB() {
+// migrationFiles holds the versioned schema migrations (see shared/migrate).
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// openDB connects to the database named by the DB_* environment variables.
+func openDB() *gorm.DB {
 	dsn := fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
 		os.Getenv("DB_HOST"),
@@ -37,14 +60,17 @@ func initDB() {
 		os.Getenv("DB_PORT"),
 	)
 
-	var err error
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+	return conn
+}
 
-	if err := db.AutoMigrate(&Product{}); err != nil {
-		log.Fatal("Failed to migrate schema:", err)
+func initDB() {
+	db = openDB()
+	if err := migrate.OnStartup(db, migrationFiles); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
 	}
 
 	// Seed the catalog so the app is usable on first run.
@@ -52,28 +78,58 @@ func initDB() {
 	db.Model(&Product{}).Count(&count)
 	if count == 0 {
 		db.Create(&[]Product{
-			{Name: "Laptop", Price: 1300.00},
-			{Name: "Mouse", Price: 20.00},
-			{Name: "Keyboard", Price: 75.00},
-			{Name: "Monitor", Price: 500.00},
+			{Name: "Laptop", Price: 130000, Stock: 10},
+			{Name: "Mouse", Price: 2000, Stock: 100},
+			{Name: "Keyboard", Price: 7500, Stock: 50},
+			{Name: "Monitor", Price: 50000, Stock: 20},
 		})
 	}
 }
 
-// getProductsHandler handles GET /products.
+// getProductsHandler handles GET /products. Results are paginated with an
+// opaque cursor and can be sorted and filtered; see parseProductQuery.
 func getProductsHandler(w http.ResponseWriter, r *http.Request) {
-	var products []Product
-	result := db.Find(&products)
-	if result.Error != nil {
+	pq, err := parseProductQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scope, err := readScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	tx, err := pq.apply(scope.Model(&Product{}))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	products := []Product{}
+	if err := tx.Find(&products).Error; err != nil {
 		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
 		return
 	}
 
+	page := productPage{
+		Items: products,
+		Page:  pageInfo{Limit: pq.limit, Sort: pq.sort},
+	}
+	if len(products) > pq.limit {
+		page.Items = products[:pq.limit]
+		page.Page.HasMore = true
+		page.Page.NextCursor = pq.cursorAfter(page.Items[pq.limit-1])
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextPageURL(r.URL, page.Page.NextCursor)))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	json.NewEncoder(w).Encode(page)
 }
 
-// getProductHandler handles GET /products/{id}.
+// getProductHandler handles GET /products/{id}. The response carries an
+// ETag and Last-Modified; a request whose If-None-Match (or failing that,
+// If-Modified-Since) shows it is up to date gets a 304.
 func getProductHandler(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/products/")
 	id, err := strconv.Atoi(idStr)
@@ -81,9 +137,14 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid product ID", http.StatusBadRequest)
 		return
 	}
+	scope, err := readScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	var product Product
-	result := db.First(&product, id)
+	result := scope.First(&product, id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			http.Error(w, "Product not found", http.StatusNotFound)
@@ -93,8 +154,7 @@ func getProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(product)
+	writeProduct(w, r, product)
 }
 
 // createProductHandler handles POST /products.
@@ -107,6 +167,12 @@ func createProductHandler(w http.ResponseWriter, r *http.Request) {
 
 	// IDs are assigned by the database, never by the client.
 	product.ID = 0
+	product.Version = 1
+
+	if err := validateProduct(&product); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	result := db.Create(&product)
 	if result.Error != nil {
@@ -114,11 +180,302 @@ func createProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setValidators(w, product)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(product)
 }
 
+// updateProductHandler handles PUT /products/{id} (full replacement) and
+// PATCH /products/{id} (JSON merge patch, RFC 7396). Both validate the
+// resulting product before saving, so a patch can't leave a row invalid.
+// Neither changes stock, whatever the body says (see adjustStockHandler).
+// The read-modify-write runs under a row lock. A request whose If-Match
+// doesn't name the current ETag gets a 412, so clients can make sure they
+// aren't overwriting a change they haven't seen.
+func updateProductHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/products/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var updated Product
+	var invalid error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var existing Product
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&existing, id).Error; err != nil {
+			return err
+		}
+
+		if httpcond.PreconditionFailed(r, productETag(existing)) {
+			return httpcond.ErrPreconditionFailed
+		}
+
+		updated, invalid = applyProductUpdate(existing, r.Method, body)
+		if invalid != nil {
+			return invalid
+		}
+		return tx.Save(&updated).Error
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, httpcond.ErrPreconditionFailed):
+			http.Error(w, "Product has changed; fetch it again and retry", http.StatusPreconditionFailed)
+		case invalid != nil:
+			http.Error(w, invalid.Error(), http.StatusBadRequest)
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "Product not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Failed to update product", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	notifyProductChanged(productUpdated, updated.ID)
+	setValidators(w, updated)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// applyProductUpdate builds the product that a PUT or PATCH body turns
+// existing into, returning a client-facing error if the body is unusable.
+func applyProductUpdate(existing Product, method string, body []byte) (Product, error) {
+	var updated Product
+	if method == http.MethodPatch {
+		current, err := json.Marshal(existing)
+		if err != nil {
+			return Product{}, err
+		}
+		merged, err := mergePatch(current, body)
+		if err != nil {
+			return Product{}, errors.New("Invalid merge patch: " + err.Error())
+		}
+		if err := json.Unmarshal(merged, &updated); err != nil {
+			return Product{}, errors.New("Invalid merge patch: " + err.Error())
+		}
+	} else if err := json.Unmarshal(body, &updated); err != nil {
+		return Product{}, errors.New("Invalid JSON")
+	}
+
+	// The ID comes from the URL; a body can't move a product to another row.
+	// The timestamps are the server's: a body can't backdate the product or
+	// delete it, and a PUT that leaves them out doesn't zero them.
+	// Stock only moves through reservations and adjustments (stock.go),
+	// which change it relative to the current level: a PUT that left it out
+	// would zero it, and one that set it would undo reservations made since
+	// the client read the product.
+	updated.ID = existing.ID
+	updated.Stock = existing.Stock
+	updated.Version = existing.Version + 1
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = existing.UpdatedAt
+	updated.DeletedAt = existing.DeletedAt
+
+	if err := validateProduct(&updated); err != nil {
+		return Product{}, err
+	}
+	return updated, nil
+}
+
+// deleteProductHandler handles DELETE /products/{id}. Deletes are soft:
+// the product drops out of the catalog but its row stays, so it can be
+// restored and old orders can still be traced to it.
+func deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/products/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	// Set deleted_at by hand rather than with db.Delete so the version
+	// moves too, and an ETag from before the delete goes stale.
+	result := db.Model(&Product{}).Where("id = ?", id).
+		Updates(map[string]any{"deleted_at": time.Now(), "version": gorm.Expr("version + 1")})
+	if result.Error != nil {
+		http.Error(w, "Failed to delete product", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	notifyProductChanged(productDeleted, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreProductHandler handles POST /products/{id}/restore, putting a
+// deleted product back in the catalog.
+func restoreProductHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/products/"), "/restore")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var product Product
+	result := db.Unscoped().First(&product, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Product not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch product", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !product.DeletedAt.Valid {
+		http.Error(w, "Product isn't deleted", http.StatusConflict)
+		return
+	}
+
+	result = db.Unscoped().Model(&Product{}).Where("id = ? AND deleted_at IS NOT NULL", id).
+		Updates(map[string]any{"deleted_at": nil, "version": gorm.Expr("version + 1")})
+	if result.Error != nil {
+		http.Error(w, "Failed to restore product", http.StatusInternalServerError)
+		return
+	}
+	if err := db.First(&product, id).Error; err != nil {
+		http.Error(w, "Failed to fetch product", http.StatusInternalServerError)
+		return
+	}
+
+	notifyProductChanged(productUpdated, id)
+	writeProduct(w, r, product)
+}
+
+var errIncludeDeleted = errors.New("Only catalog admins and admins can include deleted products")
+
+// readScope returns what to read products through for r: db, which hides
+// deleted products, or, when a catalog admin asks for
+// ?include_deleted=true, a handle that shows them too.
+func readScope(r *http.Request) (*gorm.DB, error) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return db, nil
+	}
+	if !authz.RequestCaller(r).HasRole(authz.RoleCatalogAdmin, authz.RoleAdmin) {
+		return nil, errIncludeDeleted
+	}
+	return db.Unscoped(), nil
+}
+
+// validateProduct enforces the rules every stored product must satisfy,
+// whether it arrived via POST, PUT or PATCH, and normalizes its currency.
+func validateProduct(p *Product) error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("Name is required")
+	}
+	currency, ok := money.NormalizeCurrency(p.Currency)
+	if !ok {
+		return fmt.Errorf("Unsupported currency %q", p.Currency)
+	}
+	p.Currency = currency
+	if p.Price <= 0 {
+		return errors.New("Price must be positive")
+	}
+	if p.Stock < 0 {
+		return errors.New("Stock can't be negative")
+	}
+	return nil
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch to doc: object members in
+// the patch replace those in doc, null members delete them, and any
+// non-object patch replaces doc wholesale.
+func mergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p any
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(target, p))
+}
+
+func mergeValue(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergeValue(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+// permissions lists who may call each route (see shared/authz). The catalog
+// is public; changing it takes a catalog admin, and reservations are for
+// orderservice.
+var permissions = []authz.Permission{
+	{Method: "GET", Path: "/products", Allow: []string{authz.AllowAnyone}},
+	{Method: "POST", Path: "/products", Allow: []string{authz.RoleCatalogAdmin, authz.RoleAdmin}},
+	{Method: "GET", Path: "/products/{id}", Allow: []string{authz.AllowAnyone}},
+	{Method: "PUT", Path: "/products/{id}", Allow: []string{authz.RoleCatalogAdmin, authz.RoleAdmin}},
+	{Method: "PATCH", Path: "/products/{id}", Allow: []string{authz.RoleCatalogAdmin, authz.RoleAdmin}},
+	{Method: "DELETE", Path: "/products/{id}", Allow: []string{authz.RoleCatalogAdmin, authz.RoleAdmin}},
+	{Method: "POST", Path: "/products/{id}/restore", Allow: []string{authz.RoleCatalogAdmin, authz.RoleAdmin}},
+	{Method: "POST", Path: "/products/{id}/stock", Allow: []string{authz.RoleCatalogAdmin, authz.RoleAdmin}},
+	{Method: "POST", Path: "/products/{id}/reservations", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+	{Method: "GET", Path: "/products/{id}/reservations/{rid}", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+	{Method: "POST", Path: "/products/{id}/reservations/{rid}/commit", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+	{Method: "POST", Path: "/products/{id}/reservations/{rid}/release", Allow: []string{authz.RoleService, authz.RoleAdmin}},
+}
+
+// productsRouter is the /products entry point: authz.Authorize checks the
+// request against permissions, then routeProducts dispatches it.
+var productsRouter = authz.Authorize(permissions, routeProducts)
+
+// routeProducts dispatches /products requests by method and path.
+func routeProducts(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/products":
+		createProductHandler(w, r)
+
+	case strings.Contains(r.URL.Path, "/reservations"):
+		reservationsRouter(w, r)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/products/") && strings.HasSuffix(r.URL.Path, "/restore"):
+		restoreProductHandler(w, r)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/products/") && strings.HasSuffix(r.URL.Path, "/stock"):
+		adjustStockHandler(w, r)
+
+	case r.Method == http.MethodGet && (r.URL.Path == "/products" || r.URL.Path == "/products/"):
+		getProductsHandler(w, r)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/products/"):
+		getProductHandler(w, r)
+
+	case (r.Method == http.MethodPut || r.Method == http.MethodPatch) && strings.HasPrefix(r.URL.Path, "/products/"):
+		updateProductHandler(w, r)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/products/"):
+		deleteProductHandler(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // healthzHandler reports whether the service can do its job: alive and
 // able to reach the database. The ping gets a short deadline so a hung
 // DB connection makes the check fail instead of hang.
@@ -138,20 +495,18 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(openDB(), migrationFiles, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	initDB()
 
 	http.HandleFunc("/healthz", healthzHandler)
-	http.HandleFunc("/products", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			getProductsHandler(w, r)
-		} else if r.Method == http.MethodPost {
-			createProductHandler(w, r)
-		} else {
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-		}
-	})
-
-	http.HandleFunc("/products/", getProductHandler)
+	http.HandleFunc("/products", productsRouter)
+	http.HandleFunc("/products/", productsRouter)
 
 	log.Println("Product Service listening on port 8081")
 	server := &http.Server{
@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"shared/authz"
 )
 
 // setupTestDB swaps the package-level db for an in-memory SQLite database.
@@ -23,16 +26,24 @@ func setupTestDB(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to open test database: %v", err)
 	}
-	if err := db.AutoMigrate(&Product{}); err != nil {
+	if err := db.AutoMigrate(&Product{}, &StockReservation{}); err != nil {
 		t.Fatalf("failed to migrate: %v", err)
 	}
 }
 
+// asUser adds the identity headers the gateway forwards for a verified
+// token.
+func asUser(req *http.Request, userID int, roles ...string) *http.Request {
+	req.Header.Set(authz.HeaderUserID, strconv.Itoa(userID))
+	req.Header.Set(authz.HeaderUserRoles, strings.Join(roles, ","))
+	return req
+}
+
 func TestGetProducts(t *testing.T) {
 	setupTestDB(t)
 	db.Create(&[]Product{
-		{Name: "Laptop", Price: 1300},
-		{Name: "Mouse", Price: 20},
+		{Name: "Laptop", Price: 130000},
+		{Name: "Mouse", Price: 2000},
 	})
 
 	req := httptest.NewRequest(http.MethodGet, "/products", nil)
@@ -42,18 +53,21 @@ func TestGetProducts(t *testing.T) {
 	if rec.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", rec.Code)
 	}
-	var products []Product
-	if err := json.NewDecoder(rec.Body).Decode(&products); err != nil {
+	var page productPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if len(products) != 2 {
-		t.Errorf("expected 2 products, got %d", len(products))
+	if len(page.Items) != 2 {
+		t.Errorf("expected 2 products, got %d", len(page.Items))
+	}
+	if page.Page.HasMore || page.Page.NextCursor != "" {
+		t.Errorf("expected a single page, got %+v", page.Page)
 	}
 }
 
 func TestGetProductByID(t *testing.T) {
 	setupTestDB(t)
-	db.Create(&Product{Name: "Laptop", Price: 1300})
+	db.Create(&Product{Name: "Laptop", Price: 130000})
 
 	req := httptest.NewRequest(http.MethodGet, "/products/1", nil)
 	rec := httptest.NewRecorder()
@@ -66,8 +80,8 @@ func TestGetProductByID(t *testing.T) {
 	if err := json.NewDecoder(rec.Body).Decode(&product); err != nil {
 		t.Fatalf("failed to decode response: %v", err)
 	}
-	if product.Price != 1300 {
-		t.Errorf("expected price 1300, got %v", product.Price)
+	if product.Price != 130000 {
+		t.Errorf("expected price 130000 cents, got %d", product.Price)
 	}
 }
 
@@ -177,3 +191,305 @@ func TestHealthzDatabaseDown(t *testing.T) {
 		t.Errorf("expected 503, got %d", rec.Code)
 	}
 }
+
+func TestCreateProductValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing name", `{"price":10}`},
+		{"blank name", `{"name":"   ","price":10}`},
+		{"zero price", `{"name":"Webcam","price":0}`},
+		{"negative price", `{"name":"Webcam","price":-5}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+
+			req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestReplaceProduct(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	body := strings.NewReader(`{"id":42,"name":"Gaming Laptop","price":1800}`)
+	req := httptest.NewRequest(http.MethodPut, "/products/1", body)
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stored Product
+	db.First(&stored, 1)
+	if stored.Name != "Gaming Laptop" || stored.Price != 180000 {
+		t.Errorf("expected product to be replaced, got %+v", stored)
+	}
+	var count int64
+	db.Model(&Product{}).Count(&count)
+	if count != 1 {
+		t.Errorf("body ID should be ignored, expected 1 product, got %d", count)
+	}
+}
+
+func TestPatchProductMergesFields(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	req := httptest.NewRequest(http.MethodPatch, "/products/1", strings.NewReader(`{"price":1250}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var product Product
+	if err := json.NewDecoder(rec.Body).Decode(&product); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if product.Name != "Laptop" || product.Price != 125000 {
+		t.Errorf("expected name kept and price patched, got %+v", product)
+	}
+}
+
+func TestUpdateProductKeepsTimestamps(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, tc := range map[string]struct{ method, body string }{
+		"put without them":   {http.MethodPut, `{"name":"Laptop","price":1200}`},
+		"patch setting them": {http.MethodPatch, `{"created_at":"2030-01-01T00:00:00Z","deleted_at":"2030-01-01T00:00:00Z"}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setupTestDB(t)
+			db.Create(&Product{Name: "Laptop", Price: 130000, CreatedAt: created})
+
+			req := httptest.NewRequest(tc.method, "/products/1", strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if strings.Contains(rec.Body.String(), "deleted_at") {
+				t.Errorf("expected no deleted_at on a live product, got %s", rec.Body.String())
+			}
+			var stored Product
+			if err := db.First(&stored, 1).Error; err != nil {
+				t.Fatalf("expected the product to stay live: %v", err)
+			}
+			if !stored.CreatedAt.Equal(created) {
+				t.Errorf("expected created_at %s to be kept, got %s", created, stored.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestUpdateProductValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+	}{
+		{"put invalid JSON", http.MethodPut, `{not json`},
+		{"put missing name", http.MethodPut, `{"price":10}`},
+		{"put zero price", http.MethodPut, `{"name":"Laptop","price":0}`},
+		{"patch null name", http.MethodPatch, `{"name":null}`},
+		{"patch negative price", http.MethodPatch, `{"price":-1}`},
+		{"patch invalid JSON", http.MethodPatch, `{not json`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			db.Create(&Product{Name: "Laptop", Price: 130000})
+
+			req := httptest.NewRequest(tt.method, "/products/1", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", rec.Code)
+			}
+			var stored Product
+			db.First(&stored, 1)
+			if stored.Name != "Laptop" || stored.Price != 130000 {
+				t.Errorf("rejected update should not change the row, got %+v", stored)
+			}
+		})
+	}
+}
+
+func TestUpdateProductNotFound(t *testing.T) {
+	setupTestDB(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/products/999", strings.NewReader(`{"name":"Laptop","price":1}`))
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestDeleteProduct(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	req := httptest.NewRequest(http.MethodDelete, "/products/1", nil)
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	var count int64
+	db.Model(&Product{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected product to be deleted, %d remain", count)
+	}
+	var stored Product
+	if err := db.Unscoped().First(&stored, 1).Error; err != nil || !stored.DeletedAt.Valid {
+		t.Errorf("expected the row to be kept as soft-deleted, got %+v (%v)", stored, err)
+	}
+}
+
+func TestDeletedProductsHiddenUnlessAsked(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&[]Product{{Name: "Laptop", Price: 130000}, {Name: "Mouse", Price: 2000}})
+	productsRouter(httptest.NewRecorder(), asUser(httptest.NewRequest(http.MethodDelete, "/products/1", nil), 1, authz.RoleAdmin))
+
+	tests := []struct {
+		name   string
+		path   string
+		roles  []string
+		status int
+		want   string
+	}{
+		{"anonymous list", "/products", nil, http.StatusOK, "Mouse"},
+		{"anonymous get", "/products/1", nil, http.StatusNotFound, ""},
+		{"customer asks for deleted", "/products?include_deleted=true", []string{authz.RoleCustomer}, http.StatusForbidden, ""},
+		{"catalog admin list", "/products?include_deleted=true&sort=id", []string{authz.RoleCatalogAdmin}, http.StatusOK, "Laptop,Mouse"},
+		{"catalog admin get", "/products/1?include_deleted=true", []string{authz.RoleCatalogAdmin}, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.roles != nil {
+				req = asUser(req, 1, tt.roles...)
+			}
+			rec := httptest.NewRecorder()
+			productsRouter(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if tt.want == "" {
+				return
+			}
+			var page productPage
+			json.NewDecoder(rec.Body).Decode(&page)
+			if names(page.Items) != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, names(page.Items))
+			}
+		})
+	}
+}
+
+func TestRestoreProduct(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000})
+
+	restore := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		productsRouter(rec, asUser(httptest.NewRequest(http.MethodPost, "/products/1/restore", nil), 1, authz.RoleCatalogAdmin))
+		return rec
+	}
+
+	if rec := restore(); rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 restoring a live product, got %d", rec.Code)
+	}
+	productsRouter(httptest.NewRecorder(), asUser(httptest.NewRequest(http.MethodDelete, "/products/1", nil), 1, authz.RoleAdmin))
+
+	rec := restore()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if etag := rec.Header().Get("ETag"); etag != `"1-3"` {
+		t.Errorf("expected the delete and restore to move the ETag to \"1-3\", got %s", etag)
+	}
+	if err := db.First(&Product{}, 1).Error; err != nil {
+		t.Errorf("expected the restored product to be visible again: %v", err)
+	}
+}
+
+func TestDeleteProductNotFound(t *testing.T) {
+	setupTestDB(t)
+
+	req := httptest.NewRequest(http.MethodDelete, "/products/999", nil)
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestProductsRouterMethodNotAllowed(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct{ method, path string }{
+		{http.MethodDelete, "/products"},
+		{http.MethodPost, "/products/1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		rec := httptest.NewRecorder()
+		productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: expected 405, got %d", tt.method, tt.path, rec.Code)
+		}
+	}
+}
+
+func TestCreateProductCurrency(t *testing.T) {
+	tests := []struct {
+		body string
+		code int
+		want string
+	}{
+		{`{"name":"Webcam","price":89.99}`, http.StatusCreated, "USD"},
+		{`{"name":"Webcam","price":89.99,"currency":"eur"}`, http.StatusCreated, "EUR"},
+		{`{"name":"Webcam","price":89.99,"currency":"XYZ"}`, http.StatusBadRequest, ""},
+		{`{"name":"Webcam","price":89.999}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		setupTestDB(t)
+
+		req := httptest.NewRequest(http.MethodPost, "/products", strings.NewReader(tt.body))
+		rec := httptest.NewRecorder()
+		createProductHandler(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.body, tt.code, rec.Code)
+			continue
+		}
+		if tt.code != http.StatusCreated {
+			continue
+		}
+		var product Product
+		if err := json.NewDecoder(rec.Body).Decode(&product); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if product.Price != 8999 || product.Currency != tt.want {
+			t.Errorf("%s: expected 8999 %s, got %d %s", tt.body, tt.want, product.Price, product.Currency)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+-- Stock levels, and the reservations orders hold against them.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS stock bigint NOT NULL DEFAULT 0;
+ALTER TABLE products DROP CONSTRAINT IF EXISTS chk_products_stock;
+ALTER TABLE products ADD CONSTRAINT chk_products_stock CHECK (stock >= 0);
+
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id bigserial PRIMARY KEY,
+    product_id bigint NOT NULL,
+    quantity bigint NOT NULL,
+    status text NOT NULL,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_product_id ON stock_reservations (product_id);
@@ -0,0 +1,4 @@
+ALTER TABLE products ADD COLUMN price decimal;
+UPDATE products SET price = price_minor / 100.0;
+ALTER TABLE products DROP COLUMN price_minor;
+ALTER TABLE products DROP COLUMN currency;
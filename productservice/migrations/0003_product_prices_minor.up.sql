@@ -0,0 +1,11 @@
+-- Prices move from a float of major units in "price" to integer minor
+-- units (cents) in "price_minor", with a currency. The float column is
+-- added first if it's missing, so the conversion is a no-op on a database
+-- that was already converted.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price_minor bigint NOT NULL DEFAULT 0;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS currency varchar(3) NOT NULL DEFAULT 'USD';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS price decimal;
+
+UPDATE products SET price_minor = ROUND(price * 100) WHERE price IS NOT NULL;
+ALTER TABLE products DROP COLUMN price;
@@ -0,0 +1,4 @@
+-- A write counter behind the ETag, and when the row last changed.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS updated_at timestamptz;
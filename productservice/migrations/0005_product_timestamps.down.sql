@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_products_deleted_at;
+ALTER TABLE products DROP COLUMN deleted_at;
+ALTER TABLE products DROP COLUMN created_at;
@@ -0,0 +1,8 @@
+-- Creation times, and soft delete. Products stored before created_at
+-- existed get their last update, the best guess there is.
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS created_at timestamptz;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_products_deleted_at ON products (deleted_at);
+
+UPDATE products SET created_at = COALESCE(updated_at, CURRENT_TIMESTAMP) WHERE created_at IS NULL;
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"shared/migrate"
+	"shared/pgtest"
+)
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := migrate.Load(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "baseline" {
+		t.Errorf("expected the baseline first, got %+v", migrations)
+	}
+}
+
+// The tests below run the real migrations, so they need Postgres (see
+// pgtest.DSNVar) and are skipped without it.
+
+func TestMigrationsBuildTheModels(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+	pgtest.CheckColumns(t, conn, &Product{}, &StockReservation{})
+
+	// Every down has to undo its up, so the schema can go all the way
+	// down and back up.
+	if err := migrate.Command(conn, migrationFiles, []string{"down", "100"}, io.Discard); err != nil {
+		t.Fatalf("migrating down: %v", err)
+	}
+	if conn.Migrator().HasTable(&Product{}) {
+		t.Error("expected no products table at version 0")
+	}
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatalf("migrating up again: %v", err)
+	}
+	pgtest.CheckColumns(t, conn, &Product{}, &StockReservation{})
+	if err := conn.Create(&Product{Name: "Laptop", Price: 130000, Currency: "USD", Stock: 3, Version: 1}).Error; err != nil {
+		t.Errorf("expected to store a product: %v", err)
+	}
+}
+
+// legacyProduct is a product as first stored, with a float price.
+type legacyProduct struct {
+	ID    int `gorm:"primaryKey"`
+	Name  string
+	Price float64
+}
+
+func (legacyProduct) TableName() string { return "products" }
+
+func TestMigrationsConvertFloatPrices(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := conn.AutoMigrate(&legacyProduct{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Create(&[]legacyProduct{{Name: "Laptop", Price: 1300}, {Name: "Cable", Price: 9.99}})
+
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	var products []Product
+	conn.Order("id").Find(&products)
+	if len(products) != 2 || products[0].Price != 130000 || products[1].Price != 999 {
+		t.Fatalf("expected prices in cents, got %+v", products)
+	}
+	if p := products[0]; p.Currency != "USD" || p.Stock != 0 || p.Version != 1 || p.CreatedAt.IsZero() {
+		t.Errorf("expected defaults for the new columns, got %+v", p)
+	}
+	if conn.Migrator().HasColumn(&Product{}, "price") {
+		t.Error("expected the float price column to be dropped")
+	}
+}
+
+func TestMigrationsAdoptAutoMigratedDatabase(t *testing.T) {
+	// The schema AutoMigrate built for the models before migrations, with
+	// products from before created_at was filled in.
+	conn := pgtest.Open(t)
+	if err := conn.AutoMigrate(&Product{}, &StockReservation{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Create(&Product{Name: "Laptop", Price: 130000, Currency: "EUR", Stock: 3, Version: 4})
+	updated := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	conn.Exec("UPDATE products SET created_at = NULL, updated_at = ?", updated)
+
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+
+	var p Product
+	if err := conn.First(&p).Error; err != nil {
+		t.Fatal(err)
+	}
+	if p.Price != 130000 || p.Currency != "EUR" || p.Stock != 3 || p.Version != 4 {
+		t.Errorf("expected the product unchanged, got %+v", p)
+	}
+	if !p.CreatedAt.Equal(updated) {
+		t.Errorf("expected created_at from the last update (%s), got %s", updated, p.CreatedAt)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"shared/money"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// sortColumns maps the ?sort= values clients may use to their columns.
+// Every sort is tie-broken by id so the ordering is total, which keyset
+// pagination needs to never skip or repeat a row.
+var sortColumns = map[string]string{
+	"id":    "id",
+	"name":  "name",
+	"price": "price_minor",
+}
+
+// productPage is the envelope returned by GET /products.
+type productPage struct {
+	Items []Product `json:"items"`
+	Page  pageInfo  `json:"page"`
+}
+
+type pageInfo struct {
+	Limit      int    `json:"limit"`
+	Sort       string `json:"sort"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// productQuery is a parsed, validated GET /products query string.
+type productQuery struct {
+	limit      int
+	sort       string // as given by the client, e.g. "-price"
+	column     string
+	desc       bool
+	minPrice   *money.Money
+	maxPrice   *money.Money
+	namePrefix string
+	after      *cursor
+}
+
+// cursor marks the last row of the previous page. It's handed to clients
+// base64-encoded and should be treated by them as opaque.
+type cursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    int             `json:"id"`
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var c cursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return &c, nil
+}
+
+// parseProductQuery validates the list parameters. Errors are meant to be
+// shown to the client as-is.
+func parseProductQuery(q url.Values) (productQuery, error) {
+	pq := productQuery{limit: defaultPageLimit, sort: "id", column: "id"}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return pq, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		pq.limit = n
+	}
+
+	if v := q.Get("sort"); v != "" {
+		column, ok := sortColumns[strings.TrimPrefix(v, "-")]
+		if !ok {
+			return pq, errors.New("sort must be one of id, name, price (prefix with - for descending)")
+		}
+		pq.sort, pq.column, pq.desc = v, column, strings.HasPrefix(v, "-")
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  **money.Money
+	}{{"min_price", &pq.minPrice}, {"max_price", &pq.maxPrice}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		m, err := money.Parse(v)
+		if err != nil {
+			return pq, fmt.Errorf("%s must be an amount like 12.50", p.name)
+		}
+		*p.dst = &m
+	}
+
+	pq.namePrefix = q.Get("name_prefix")
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return pq, err
+		}
+		// A cursor is a position within one particular ordering.
+		if c.Sort != pq.sort {
+			return pq, errors.New("cursor was issued for a different sort")
+		}
+		pq.after = c
+	}
+
+	return pq, nil
+}
+
+// apply adds the filters, keyset condition, ordering and limit to tx. It
+// fetches one row more than the page size so the caller can tell whether
+// another page exists without a separate count query.
+func (pq productQuery) apply(tx *gorm.DB) (*gorm.DB, error) {
+	if pq.minPrice != nil {
+		tx = tx.Where("price_minor >= ?", int64(*pq.minPrice))
+	}
+	if pq.maxPrice != nil {
+		tx = tx.Where("price_minor <= ?", int64(*pq.maxPrice))
+	}
+	if pq.namePrefix != "" {
+		tx = tx.Where("LOWER(name) LIKE ? ESCAPE '\\'", strings.ToLower(escapeLike(pq.namePrefix))+"%")
+	}
+
+	op, dir := ">", "ASC"
+	if pq.desc {
+		op, dir = "<", "DESC"
+	}
+
+	if pq.after != nil {
+		if pq.column == "id" {
+			tx = tx.Where("id "+op+" ?", pq.after.ID)
+		} else {
+			var v any
+			if err := json.Unmarshal(pq.after.Value, &v); err != nil {
+				return nil, errors.New("malformed cursor")
+			}
+			tx = tx.Where(
+				fmt.Sprintf("(%[1]s %[2]s ?) OR (%[1]s = ? AND id %[2]s ?)", pq.column, op),
+				v, v, pq.after.ID,
+			)
+		}
+	}
+
+	if pq.column != "id" {
+		tx = tx.Order(pq.column + " " + dir)
+	}
+	return tx.Order("id " + dir).Limit(pq.limit + 1), nil
+}
+
+// cursorAfter returns the cursor pointing just past p in this ordering.
+func (pq productQuery) cursorAfter(p Product) string {
+	var v any
+	switch pq.column {
+	case "name":
+		v = p.Name
+	case "price_minor":
+		// Minor units, matching the column rather than the JSON form.
+		v = int64(p.Price)
+	}
+	raw, _ := json.Marshal(v)
+	return encodeCursor(cursor{Sort: pq.sort, Value: raw, ID: p.ID})
+}
+
+// escapeLike neutralises LIKE wildcards in user input so a prefix of "50%"
+// matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// nextPageURL is the request URL with its cursor swapped for next, used for
+// the Link header so clients can follow pages without building URLs.
+func nextPageURL(u *url.URL, next string) string {
+	q := u.Query()
+	q.Set("cursor", next)
+	return (&url.URL{Path: u.Path, RawQuery: q.Encode()}).String()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func seedCatalog(t *testing.T) {
+	t.Helper()
+	db.Create(&[]Product{
+		{Name: "Laptop", Price: 130000},
+		{Name: "Mouse", Price: 2000},
+		{Name: "Keyboard", Price: 7500},
+		{Name: "Monitor", Price: 50000},
+		{Name: "Mousepad", Price: 2000},
+	})
+}
+
+// listProducts calls GET /products with the given query and decodes the page.
+func listProducts(t *testing.T, query string) (productPage, *httptest.ResponseRecorder) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/products?"+query, nil)
+	rec := httptest.NewRecorder()
+	getProductsHandler(rec, req)
+
+	var page productPage
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	}
+	return page, rec
+}
+
+func names(products []Product) string {
+	var out []string
+	for _, p := range products {
+		out = append(out, p.Name)
+	}
+	return strings.Join(out, ",")
+}
+
+func TestListProductsWalksAllPages(t *testing.T) {
+	setupTestDB(t)
+	seedCatalog(t)
+
+	// Two products share a price, so this also checks the id tie-breaker
+	// keeps rows from being skipped or repeated at a page boundary.
+	var got []Product
+	query := "limit=2&sort=price"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		page, rec := listProducts(t, query)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		got = append(got, page.Items...)
+		if !page.Page.HasMore {
+			if rec.Header().Get("Link") != "" {
+				t.Error("last page should not have a next link")
+			}
+			break
+		}
+		if !strings.Contains(rec.Header().Get("Link"), `rel="next"`) {
+			t.Errorf("expected next Link header, got %q", rec.Header().Get("Link"))
+		}
+		query = "limit=2&sort=price&cursor=" + url.QueryEscape(page.Page.NextCursor)
+	}
+
+	if want := "Mouse,Mousepad,Keyboard,Monitor,Laptop"; names(got) != want {
+		t.Errorf("expected %s, got %s", want, names(got))
+	}
+}
+
+func TestListProductsSortDescending(t *testing.T) {
+	setupTestDB(t)
+	seedCatalog(t)
+
+	page, rec := listProducts(t, "sort=-name&limit=3")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if want := "Mousepad,Mouse,Monitor"; names(page.Items) != want {
+		t.Errorf("expected %s, got %s", want, names(page.Items))
+	}
+
+	next, _ := listProducts(t, "sort=-name&limit=3&cursor="+url.QueryEscape(page.Page.NextCursor))
+	if want := "Laptop,Keyboard"; names(next.Items) != want {
+		t.Errorf("expected %s, got %s", want, names(next.Items))
+	}
+}
+
+func TestListProductsFilters(t *testing.T) {
+	setupTestDB(t)
+	seedCatalog(t)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"min_price=75", "Laptop,Keyboard,Monitor"},
+		{"max_price=75", "Mouse,Keyboard,Mousepad"},
+		{"min_price=50&max_price=600", "Keyboard,Monitor"},
+		{"name_prefix=mo", "Mouse,Monitor,Mousepad"},
+		{"name_prefix=Mouse&max_price=20", "Mouse,Mousepad"},
+		{"name_prefix=%25", ""},
+	}
+	for _, tt := range tests {
+		page, rec := listProducts(t, tt.query)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", tt.query, rec.Code)
+		}
+		if names(page.Items) != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.query, tt.want, names(page.Items))
+		}
+	}
+}
+
+func TestListProductsInvalidParams(t *testing.T) {
+	setupTestDB(t)
+	seedCatalog(t)
+
+	idCursor := encodeCursor(cursor{Sort: "id", ID: 1})
+	tests := []string{
+		"limit=0",
+		"limit=101",
+		"limit=abc",
+		"sort=stock",
+		"min_price=cheap",
+		"cursor=not-a-cursor",
+		"sort=price&cursor=" + idCursor,
+	}
+	for _, query := range tests {
+		_, rec := listProducts(t, query)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reservation statuses. Stock leaves Product.Stock when it is reserved, so
+// committing only records that the hold became a sale; releasing (from
+// either state) puts the units back on the shelf.
+const (
+	reservationReserved  = "reserved"
+	reservationCommitted = "committed"
+	reservationReleased  = "released"
+)
+
+// StockReservation maps to the "stock_reservations" table. A reservation
+// holds Quantity units of a product for a caller (orderservice) until it is
+// committed or released.
+type StockReservation struct {
+	ID        int       `json:"id" gorm:"primaryKey"`
+	ProductID int       `json:"product_id" gorm:"index;not null"`
+	Quantity  int       `json:"quantity" gorm:"not null"`
+	Status    string    `json:"status" gorm:"not null"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	errInsufficientStock  = errors.New("insufficient stock")
+	errReservationClosed  = errors.New("reservation already released")
+	errReservationMissing = errors.New("reservation not found")
+)
+
+// reserveStock takes quantity units of a product out of available stock in
+// a single transaction. The product row is locked (SELECT ... FOR UPDATE) so
+// concurrent reservations queue up instead of both reading the same stock
+// level, and the UPDATE repeats the stock >= quantity guard so stock can't
+// go negative even if the lock is unavailable (SQLite in tests).
+func reserveStock(productID, quantity int) (StockReservation, error) {
+	var reservation StockReservation
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var product Product
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&product, productID).Error; err != nil {
+			return err
+		}
+		if product.Stock < quantity {
+			return errInsufficientStock
+		}
+
+		result := tx.Model(&Product{}).
+			Where("id = ? AND stock >= ?", productID, quantity).
+			Updates(map[string]any{"stock": gorm.Expr("stock - ?", quantity), "version": gorm.Expr("version + 1")})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInsufficientStock
+		}
+
+		reservation = StockReservation{ProductID: productID, Quantity: quantity, Status: reservationReserved}
+		return tx.Create(&reservation).Error
+	})
+	return reservation, err
+}
+
+// settleReservation moves a reservation to committed or released. Both
+// are idempotent so callers can safely retry; a released reservation can't
+// be committed because its units may already have been sold to someone else.
+func settleReservation(productID, reservationID int, action string) (StockReservation, error) {
+	var reservation StockReservation
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).
+			Where("id = ? AND product_id = ?", reservationID, productID).
+			First(&reservation).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errReservationMissing
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case reservation.Status == reservationReleased && action == reservationReleased:
+			return nil
+		case reservation.Status == reservationReleased:
+			return errReservationClosed
+		case action == reservationCommitted:
+			if reservation.Status == reservationCommitted {
+				return nil
+			}
+		case action == reservationReleased:
+			// Unscoped: stock held for an order still goes back to a
+			// product deleted since, so it's right if the product returns.
+			err := tx.Unscoped().Model(&Product{}).Where("id = ?", productID).
+				Updates(map[string]any{"stock": gorm.Expr("stock + ?", reservation.Quantity), "version": gorm.Expr("version + 1")}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		reservation.Status = action
+		return tx.Save(&reservation).Error
+	})
+	return reservation, err
+}
+
+// adjustStock adds delta units (negative to remove) to a product's stock,
+// for deliveries, stocktakes and write-offs. Like a reservation it changes
+// stock relative to what's there, so it can't undo a reservation made
+// since the caller last looked; it refuses to take stock below zero.
+func adjustStock(productID, delta int) (Product, error) {
+	var product Product
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&product, productID).Error; err != nil {
+			return err
+		}
+		if product.Stock+delta < 0 {
+			return errInsufficientStock
+		}
+
+		result := tx.Model(&Product{}).
+			Where("id = ? AND stock + ? >= 0", productID, delta).
+			Updates(map[string]any{"stock": gorm.Expr("stock + ?", delta), "version": gorm.Expr("version + 1")})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInsufficientStock
+		}
+		return tx.First(&product, productID).Error
+	})
+	return product, err
+}
+
+// adjustStockHandler handles POST /products/{id}/stock {"delta": n}. This,
+// not PUT or PATCH, is how stock changes outside of orders.
+func adjustStockHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/products/"), "/stock")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Delta int `json:"delta"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Delta == 0 {
+		http.Error(w, "Delta must not be zero", http.StatusBadRequest)
+		return
+	}
+
+	product, err := adjustStock(id, req.Delta)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "Product not found", http.StatusNotFound)
+		case errors.Is(err, errInsufficientStock):
+			http.Error(w, "Stock can't go below zero", http.StatusConflict)
+		default:
+			http.Error(w, "Failed to adjust stock", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	notifyProductChanged(productUpdated, product.ID)
+	setValidators(w, product)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
+
+// reservationsRouter handles the stock reservation API:
+//
+//	POST /products/{id}/reservations                  reserve {"quantity": n}
+//	GET  /products/{id}/reservations/{rid}            look up a reservation
+//	POST /products/{id}/reservations/{rid}/commit     confirm the sale
+//	POST /products/{id}/reservations/{rid}/release    return units to stock
+func reservationsRouter(w http.ResponseWriter, r *http.Request) {
+	// e.g. ["3", "reservations", "12", "commit"]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/products/"), "/")
+	productID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		createReservationHandler(w, r, productID)
+
+	case len(parts) == 3 || len(parts) == 4:
+		reservationID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "Invalid reservation ID", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case len(parts) == 3 && r.Method == http.MethodGet:
+			getReservationHandler(w, productID, reservationID)
+		case len(parts) == 4 && r.Method == http.MethodPost && parts[3] == "commit":
+			settleReservationHandler(w, productID, reservationID, reservationCommitted)
+		case len(parts) == 4 && r.Method == http.MethodPost && parts[3] == "release":
+			settleReservationHandler(w, productID, reservationID, reservationReleased)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createReservationHandler(w http.ResponseWriter, r *http.Request, productID int) {
+	var req struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 {
+		http.Error(w, "Quantity must be positive", http.StatusBadRequest)
+		return
+	}
+
+	reservation, err := reserveStock(productID, req.Quantity)
+	if err != nil {
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "Product not found", http.StatusNotFound)
+		case errors.Is(err, errInsufficientStock):
+			http.Error(w, "Insufficient stock", http.StatusConflict)
+		default:
+			http.Error(w, "Failed to reserve stock", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func getReservationHandler(w http.ResponseWriter, productID, reservationID int) {
+	var reservation StockReservation
+	result := db.Where("id = ? AND product_id = ?", reservationID, productID).First(&reservation)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "Reservation not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
+
+func settleReservationHandler(w http.ResponseWriter, productID, reservationID int, action string) {
+	reservation, err := settleReservation(productID, reservationID, action)
+	if err != nil {
+		switch {
+		case errors.Is(err, errReservationMissing):
+			http.Error(w, "Reservation not found", http.StatusNotFound)
+		case errors.Is(err, errReservationClosed):
+			http.Error(w, "Reservation already released", http.StatusConflict)
+		default:
+			http.Error(w, "Failed to update reservation", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shared/authz"
+)
+
+func postReservation(t *testing.T, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	return rec
+}
+
+func stockOf(t *testing.T, id int) int {
+	t.Helper()
+	var p Product
+	if err := db.First(&p, id).Error; err != nil {
+		t.Fatalf("failed to load product %d: %v", id, err)
+	}
+	return p.Stock
+}
+
+func TestReserveStock(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+
+	rec := postReservation(t, "/products/1/reservations", `{"quantity":3}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var res StockReservation
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if res.ID == 0 || res.Status != reservationReserved || res.Quantity != 3 {
+		t.Errorf("unexpected reservation %+v", res)
+	}
+	if got := stockOf(t, 1); got != 2 {
+		t.Errorf("expected stock 2 after reserving 3 of 5, got %d", got)
+	}
+}
+
+func TestReserveStockInsufficient(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 2})
+
+	rec := postReservation(t, "/products/1/reservations", `{"quantity":3}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d", rec.Code)
+	}
+	if got := stockOf(t, 1); got != 2 {
+		t.Errorf("failed reservation should not touch stock, got %d", got)
+	}
+	var count int64
+	db.Model(&StockReservation{}).Count(&count)
+	if count != 0 {
+		t.Errorf("expected no reservation rows, got %d", count)
+	}
+}
+
+func TestReserveStockValidation(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 2})
+
+	tests := []struct {
+		path string
+		body string
+		want int
+	}{
+		{"/products/1/reservations", `{not json`, http.StatusBadRequest},
+		{"/products/1/reservations", `{"quantity":0}`, http.StatusBadRequest},
+		{"/products/abc/reservations", `{"quantity":1}`, http.StatusBadRequest},
+		{"/products/999/reservations", `{"quantity":1}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := postReservation(t, tt.path, tt.body)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: expected %d, got %d", tt.path, tt.body, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestCommitReservation(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+	postReservation(t, "/products/1/reservations", `{"quantity":2}`)
+
+	// Committing twice is fine; retries must not fail.
+	for i := 0; i < 2; i++ {
+		rec := postReservation(t, "/products/1/reservations/1/commit", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("commit %d: expected 200, got %d", i+1, rec.Code)
+		}
+	}
+	if got := stockOf(t, 1); got != 3 {
+		t.Errorf("expected committed units to stay out of stock, got %d", got)
+	}
+}
+
+func TestReleaseReservationRestoresStock(t *testing.T) {
+	for _, committed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("committed=%v", committed), func(t *testing.T) {
+			setupTestDB(t)
+			db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+			postReservation(t, "/products/1/reservations", `{"quantity":2}`)
+			if committed {
+				postReservation(t, "/products/1/reservations/1/commit", "")
+			}
+
+			for i := 0; i < 2; i++ {
+				rec := postReservation(t, "/products/1/reservations/1/release", "")
+				if rec.Code != http.StatusOK {
+					t.Fatalf("release %d: expected 200, got %d", i+1, rec.Code)
+				}
+			}
+			// Released only once despite the retry.
+			if got := stockOf(t, 1); got != 5 {
+				t.Errorf("expected stock back to 5, got %d", got)
+			}
+		})
+	}
+}
+
+func TestReleaseOnDeletedProductRestoresStock(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+	postReservation(t, "/products/1/reservations", `{"quantity":2}`)
+	db.Delete(&Product{}, 1)
+
+	if rec := postReservation(t, "/products/1/reservations/1/release", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var p Product
+	db.Unscoped().First(&p, 1)
+	if p.Stock != 5 {
+		t.Errorf("expected stock back to 5 on the deleted product, got %d", p.Stock)
+	}
+}
+
+func TestCommitReleasedReservationConflicts(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+	postReservation(t, "/products/1/reservations", `{"quantity":2}`)
+	postReservation(t, "/products/1/reservations/1/release", "")
+
+	rec := postReservation(t, "/products/1/reservations/1/commit", "")
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", rec.Code)
+	}
+}
+
+func TestReservationNotFound(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&[]Product{
+		{Name: "Laptop", Price: 130000, Stock: 5},
+		{Name: "Mouse", Price: 2000, Stock: 5},
+	})
+	postReservation(t, "/products/1/reservations", `{"quantity":2}`)
+
+	// Reservation 1 belongs to product 1, not product 2.
+	rec := postReservation(t, "/products/2/reservations/1/commit", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/products/1/reservations/999", nil)
+	rec = httptest.NewRecorder()
+	productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestUpdateProductKeepsStock(t *testing.T) {
+	for name, tc := range map[string]struct {
+		method, body string
+	}{
+		"PUT without stock": {http.MethodPut, `{"name":"Laptop Pro","price":1400}`},
+		"PUT with stock":    {http.MethodPut, `{"name":"Laptop Pro","price":1400,"stock":50}`},
+		"PATCH with stock":  {http.MethodPatch, `{"name":"Laptop Pro","stock":-1}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setupTestDB(t)
+			db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+			// A reservation the client hasn't seen.
+			postReservation(t, "/products/1/reservations", `{"quantity":2}`)
+
+			req := httptest.NewRequest(tc.method, "/products/1", strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			productsRouter(rec, asUser(req, 1, authz.RoleAdmin))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := stockOf(t, 1); got != 3 {
+				t.Errorf("expected the update to leave stock at 3, got %d", got)
+			}
+		})
+	}
+}
+
+func TestAdjustStock(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&Product{Name: "Laptop", Price: 130000, Stock: 5})
+	postReservation(t, "/products/1/reservations", `{"quantity":2}`)
+
+	rec := postReservation(t, "/products/1/stock", `{"delta":10}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var p Product
+	if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if p.Stock != 13 || stockOf(t, 1) != 13 {
+		t.Errorf("expected 10 units added to the 3 left, got %d", p.Stock)
+	}
+
+	rec = postReservation(t, "/products/1/stock", `{"delta":-14}`)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 for taking stock below zero, got %d", rec.Code)
+	}
+	if got := stockOf(t, 1); got != 13 {
+		t.Errorf("expected a refused adjustment to leave stock alone, got %d", got)
+	}
+
+	for body, want := range map[string]int{`{"delta":0}`: http.StatusBadRequest, `{`: http.StatusBadRequest} {
+		if rec := postReservation(t, "/products/1/stock", body); rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", body, want, rec.Code)
+		}
+	}
+	if rec := postReservation(t, "/products/99/stock", `{"delta":1}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing product, got %d", rec.Code)
+	}
+}
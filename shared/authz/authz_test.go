@@ -0,0 +1,36 @@
+package authz
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCallerFromHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set(HeaderUserID, "7")
+	h.Set(HeaderUserRoles, "support, admin,")
+
+	c, err := callerFromHeaders(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UserID != 7 || len(c.Roles) != 2 || !c.HasRole(RoleAdmin) {
+		t.Errorf("unexpected caller %+v", c)
+	}
+}
+
+func TestPermissionMatch(t *testing.T) {
+	p := Permission{Method: http.MethodGet, Path: "/products/{id}/reservations/{rid}"}
+
+	if id, ok := p.match("/products/3/reservations/12"); !ok || id != "3" {
+		t.Errorf("expected a match with id 3, got %q, %v", id, ok)
+	}
+	for _, path := range []string{"/products/3/reservations", "/products/3/reservations/12/commit", "/products//reservations/12"} {
+		if _, ok := p.match(path); ok {
+			t.Errorf("%s should not match %s", path, p.Path)
+		}
+	}
+	if _, ok := (Permission{Path: "/products"}).match("/products/"); !ok {
+		t.Error("a trailing slash should not matter")
+	}
+}
@@ -0,0 +1,48 @@
+// Package httpcond evaluates the conditional request headers
+// (If-None-Match, If-Modified-Since and If-Match) for productservice and
+// userservice. Each service computes its own ETags and writes its own
+// responses; this package only decides what the headers ask for.
+package httpcond
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETagMatches reports whether an If-None-Match or If-Match header value
+// names etag, either directly, in a comma-separated list, or as "*".
+// Weak tags are compared by their opaque part.
+func ETagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// NotModified evaluates a GET's If-None-Match, or If-Modified-Since when
+// there's no If-None-Match (RFC 9110 §13.2.2).
+func NotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return ETagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+// ErrPreconditionFailed aborts a write whose If-Match didn't hold.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// PreconditionFailed reports whether a write's If-Match header rules out
+// changing the resource as it currently stands.
+func PreconditionFailed(r *http.Request, etag string) bool {
+	im := r.Header.Get("If-Match")
+	return im != "" && !ETagMatches(im, etag)
+}
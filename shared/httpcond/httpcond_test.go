@@ -0,0 +1,75 @@
+package httpcond
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"1-2"`, true},
+		{`W/"1-2"`, true},
+		{`"1-1", "1-2"`, true},
+		{`*`, true},
+		{`"1-1"`, false},
+		{`"1-2-3"`, false},
+	}
+	for _, tt := range tests {
+		if got := ETagMatches(tt.header, `"1-2"`); got != tt.want {
+			t.Errorf("ETagMatches(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 500_000_000, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no conditions", nil, false},
+		{"matching etag", map[string]string{"If-None-Match": `"1-2"`}, true},
+		{"stale etag", map[string]string{"If-None-Match": `"1-1"`}, false},
+		{"unchanged since", map[string]string{"If-Modified-Since": updated.Format(http.TimeFormat)}, true},
+		{"changed since", map[string]string{"If-Modified-Since": updated.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"bad date", map[string]string{"If-Modified-Since": "yesterday"}, false},
+		{"etag wins over date", map[string]string{
+			"If-None-Match":     `"1-1"`,
+			"If-Modified-Since": updated.Format(http.TimeFormat),
+		}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := NotModified(r, `"1-2"`, updated); got != tt.want {
+			t.Errorf("%s: NotModified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPreconditionFailed(t *testing.T) {
+	tests := map[string]bool{
+		"":        false,
+		`"1-2"`:   false,
+		`*`:       false,
+		`"1-1"`:   true,
+		`W/"1-1"`: true,
+	}
+	for ifMatch, want := range tests {
+		r := httptest.NewRequest(http.MethodPut, "/", nil)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		if got := PreconditionFailed(r, `"1-2"`); got != want {
+			t.Errorf("If-Match %q: PreconditionFailed = %v, want %v", ifMatch, got, want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Package migrate runs the versioned SQL schema migrations of
+// productservice, orderservice, userservice and paymentservice. Each
+// service embeds its own migrations directory and passes it to OnStartup
+// and Command.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Schema changes are pairs of SQL files in the service's migrations
+// directory, built into the binary: NNNN_name.up.sql takes the schema to
+// version NNNN and NNNN_name.down.sql takes it back. Versions start at 1
+// with no gaps. A released migration is never edited; a mistake is fixed
+// by the next one. Handler tests still build their SQLite schema from the
+// models' gorm tags, so a migration that changes a table changes the model
+// too; each service also runs its real migrations against Postgres and
+// checks that every model field has a column.
+
+// SchemaMigration maps to the "schema_migrations" table: one row per
+// migration applied to the database.
+type SchemaMigration struct {
+	Version   int
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migration is one version's SQL.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// ErrSchemaTooNew is returned for a database a newer release has migrated.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// Load reads migrations/*.sql from fsys, in version order.
+func Load(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		parts := fileName.FindStringSubmatch(path.Base(file))
+		if parts == nil {
+			return nil, fmt.Errorf("%s isn't named like 0001_name.up.sql", file)
+		}
+		version, _ := strconv.Atoi(parts[1])
+		sql, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		} else if m.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, parts[2])
+		}
+		if parts[3] == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for version := 1; version <= len(byVersion); version++ {
+		m, ok := byVersion[version]
+		if !ok {
+			return nil, fmt.Errorf("migration %d is missing", version)
+		}
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d (%s) needs both an up and a down file", version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	return migrations, nil
+}
+
+// appliedVersions returns what schema_migrations records, oldest first,
+// creating the table on a database that has never been migrated.
+func appliedVersions(db *gorm.DB) ([]SchemaMigration, error) {
+	err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL)`).Error
+	if err != nil {
+		return nil, err
+	}
+	var applied []SchemaMigration
+	return applied, db.Order("version").Find(&applied).Error
+}
+
+// checkVersion refuses a database that a newer release has migrated
+// past the last version in migrations. This binary would misread a schema
+// it doesn't know; to roll back, run the newer release's "migrate down"
+// first.
+func checkVersion(applied []SchemaMigration, migrations []Migration) error {
+	if n := len(applied); n > 0 && applied[n-1].Version > len(migrations) {
+		latest := applied[n-1]
+		return fmt.Errorf("%w: it's at version %d (%s), this binary only knows up to %d",
+			ErrSchemaTooNew, latest.Version, latest.Name, len(migrations))
+	}
+	return nil
+}
+
+// lockKey namespaces the advisory lock withLock takes; the other half of
+// the key is the schema, whose schema_migrations the lock guards.
+const lockKey = 0x6d696772 // "migr"
+
+// withLock runs fn holding a Postgres advisory lock, so that two
+// instances starting at once, or a "migrate" run during a deploy, apply
+// migrations one after the other instead of both applying the same ones.
+// The lock belongs to a session, so fn gets a db pinned to the connection
+// that holds it. Other databases, such as the SQLite of the tests, run fn
+// on db as is.
+func withLock(db *gorm.DB, fn func(db *gorm.DB) error) error {
+	if db.Dialector.Name() != "postgres" {
+		return fn(db)
+	}
+	return db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?, hashtext(current_schema()))", lockKey).Error; err != nil {
+			return fmt.Errorf("locking schema_migrations: %w", err)
+		}
+		defer func() {
+			if err := conn.Exec("SELECT pg_advisory_unlock(?, hashtext(current_schema()))", lockKey).Error; err != nil {
+				log.Printf("unlocking schema_migrations: %v", err)
+			}
+		}()
+		return fn(conn)
+	})
+}
+
+// up applies every migration db hasn't had yet, each in its own
+// transaction, and returns how many it applied.
+func up(db *gorm.DB, migrations []Migration) (done int, err error) {
+	err = withLock(db, func(db *gorm.DB) error {
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(applied, migrations); err != nil {
+			return err
+		}
+
+		for _, m := range migrations[len(applied):] {
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(m.Up).Error; err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			done++
+		}
+		return nil
+	})
+	return done, err
+}
+
+// down undoes the newest n applied migrations, newest first, and
+// returns how many it undid.
+func down(db *gorm.DB, migrations []Migration, n int) (done int, err error) {
+	err = withLock(db, func(db *gorm.DB) error {
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+		if err := checkVersion(applied, migrations); err != nil {
+			return err
+		}
+
+		for version := len(applied); version > 0 && done < n; version-- {
+			m := migrations[version-1]
+			err := db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Exec(m.Down).Error; err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{}, "version = ?", m.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("undoing migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			done++
+		}
+		return nil
+	})
+	return done, err
+}
+
+// OnStartup brings db up to date with the migrations in fsys before
+// the service starts serving.
+func OnStartup(db *gorm.DB, fsys fs.FS) error {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return err
+	}
+	n, err := up(db, migrations)
+	if n > 0 {
+		log.Printf("applied %d migration(s), schema is at version %d", n, len(migrations))
+	}
+	return err
+}
+
+// ErrUsage is returned by Command for arguments it doesn't understand.
+var ErrUsage = errors.New("usage: migrate up | down [n] | status")
+
+// Command carries out "migrate up", "migrate down [n]" (one
+// migration unless n is given) or "migrate status" with the migrations in
+// fsys, writing a report to out.
+func Command(db *gorm.DB, fsys fs.FS, args []string, out io.Writer) error {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch {
+	case args[0] == "up" && len(args) == 1:
+		n, err := up(db, migrations)
+		fmt.Fprintf(out, "applied %d migration(s)\n", n)
+		return err
+
+	case args[0] == "down" && len(args) <= 2:
+		steps := 1
+		if len(args) == 2 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return ErrUsage
+			}
+		}
+		n, err := down(db, migrations, steps)
+		fmt.Fprintf(out, "undid %d migration(s)\n", n)
+		return err
+
+	case args[0] == "status" && len(args) == 1:
+		applied, err := appliedVersions(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for i, m := range migrations {
+			when := "pending"
+			if i < len(applied) {
+				when = applied[i].AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, when)
+		}
+		for _, a := range applied[min(len(applied), len(migrations)):] {
+			fmt.Fprintf(w, "%d\t%s\tunknown to this binary\n", a.Version, a.Name)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return checkVersion(applied, migrations)
+
+	default:
+		return ErrUsage
+	}
+}
@@ -0,0 +1,207 @@
+package migrate
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"shared/pgtest"
+)
+
+// testMigrations is a two-step history in SQL that SQLite also accepts.
+var testMigrations = fstest.MapFS{
+	"migrations/0001_widgets.up.sql":        {Data: []byte("CREATE TABLE widgets (id INTEGER PRIMARY KEY);")},
+	"migrations/0001_widgets.down.sql":      {Data: []byte("DROP TABLE widgets;")},
+	"migrations/0002_widget_names.up.sql":   {Data: []byte("ALTER TABLE widgets ADD COLUMN name TEXT; CREATE INDEX idx_widgets_name ON widgets (name);")},
+	"migrations/0002_widget_names.down.sql": {Data: []byte("DROP INDEX idx_widgets_name; ALTER TABLE widgets DROP COLUMN name;")},
+}
+
+func openMigrationTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func schemaVersion(t *testing.T, conn *gorm.DB) int {
+	t.Helper()
+	applied, err := appliedVersions(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(applied)
+}
+
+func TestLoadMigrationsRejectsBrokenSets(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"no down": {
+			"migrations/0001_a.up.sql": {Data: []byte("SELECT 1;")},
+		},
+		"gap": {
+			"migrations/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"migrations/0001_a.down.sql": {Data: []byte("SELECT 1;")},
+			"migrations/0003_c.up.sql":   {Data: []byte("SELECT 1;")},
+			"migrations/0003_c.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"two names": {
+			"migrations/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"migrations/0001_b.down.sql": {Data: []byte("SELECT 1;")},
+		},
+		"bad name": {
+			"migrations/first.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+	for name, fsys := range tests {
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+	conn := openMigrationTestDB(t)
+	migrations, err := Load(testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := up(conn, migrations); err != nil || n != 2 {
+		t.Fatalf("expected 2 migrations applied, got %d: %v", n, err)
+	}
+	if !conn.Migrator().HasColumn("widgets", "name") {
+		t.Error("expected widgets.name after migrating up")
+	}
+	if n, err := up(conn, migrations); err != nil || n != 0 {
+		t.Errorf("expected a second up to do nothing, got %d: %v", n, err)
+	}
+
+	if n, err := down(conn, migrations, 1); err != nil || n != 1 {
+		t.Fatalf("expected 1 migration undone, got %d: %v", n, err)
+	}
+	if conn.Migrator().HasColumn("widgets", "name") || schemaVersion(t, conn) != 1 {
+		t.Error("expected to be back at version 1")
+	}
+	if n, err := down(conn, migrations, 5); err != nil || n != 1 {
+		t.Fatalf("expected only the one remaining migration undone, got %d: %v", n, err)
+	}
+	if conn.Migrator().HasTable("widgets") {
+		t.Error("expected widgets dropped")
+	}
+}
+
+func TestFailedMigrationIsRolledBack(t *testing.T) {
+	conn := openMigrationTestDB(t)
+	broken := fstest.MapFS{
+		"migrations/0001_widgets.up.sql":   testMigrations["migrations/0001_widgets.up.sql"],
+		"migrations/0001_widgets.down.sql": testMigrations["migrations/0001_widgets.down.sql"],
+		"migrations/0002_oops.up.sql":      {Data: []byte("CREATE TABLE gadgets (id INTEGER); SELECT * FROM missing;")},
+		"migrations/0002_oops.down.sql":    {Data: []byte("DROP TABLE gadgets;")},
+	}
+	migrations, _ := Load(broken)
+
+	n, err := up(conn, migrations)
+	if err == nil || n != 1 {
+		t.Fatalf("expected migration 2 to fail after 1 applied, got %d: %v", n, err)
+	}
+	if conn.Migrator().HasTable("gadgets") || schemaVersion(t, conn) != 1 {
+		t.Error("expected nothing from the failed migration to stick")
+	}
+}
+
+func TestRefusesNewerSchema(t *testing.T) {
+	conn := openMigrationTestDB(t)
+	if err := OnStartup(conn, testMigrations); err != nil {
+		t.Fatal(err)
+	}
+
+	// An older binary, that only knows the first migration.
+	older := fstest.MapFS{
+		"migrations/0001_widgets.up.sql":   testMigrations["migrations/0001_widgets.up.sql"],
+		"migrations/0001_widgets.down.sql": testMigrations["migrations/0001_widgets.down.sql"],
+	}
+	if err := OnStartup(conn, older); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew on startup, got %v", err)
+	}
+	if err := Command(conn, older, []string{"down"}, &strings.Builder{}); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew from migrate down, got %v", err)
+	}
+	if schemaVersion(t, conn) != 2 {
+		t.Error("expected the schema to be left alone")
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	conn := openMigrationTestDB(t)
+	run := func(args ...string) string {
+		t.Helper()
+		var out strings.Builder
+		if err := Command(conn, testMigrations, args, &out); err != nil {
+			t.Fatalf("migrate %v: %v", args, err)
+		}
+		return out.String()
+	}
+
+	if out := run("status"); strings.Count(out, "pending") != 2 {
+		t.Errorf("expected both migrations pending, got:\n%s", out)
+	}
+	if out := run("up"); !strings.Contains(out, "applied 2") {
+		t.Errorf("unexpected up output: %s", out)
+	}
+	run("down")
+	if out := run("status"); !strings.Contains(out, "widget_names  pending") || strings.Count(out, "pending") != 1 {
+		t.Errorf("expected only widget_names pending, got:\n%s", out)
+	}
+
+	for _, args := range [][]string{nil, {"sideways"}, {"down", "0"}, {"up", "2"}} {
+		if err := Command(conn, testMigrations, args, &strings.Builder{}); !errors.Is(err, ErrUsage) {
+			t.Errorf("migrate %v: expected a usage error, got %v", args, err)
+		}
+	}
+}
+
+func TestConcurrentMigratorsTakeTurns(t *testing.T) {
+	conn := pgtest.Open(t)
+	// The sleep holds the first migrator inside migration 1 long enough
+	// for the second to find it not yet applied, were it not for the lock.
+	slow := fstest.MapFS{
+		"migrations/0001_widgets.up.sql":        {Data: []byte("CREATE TABLE widgets (id INTEGER PRIMARY KEY); SELECT pg_sleep(0.2);")},
+		"migrations/0001_widgets.down.sql":      testMigrations["migrations/0001_widgets.down.sql"],
+		"migrations/0002_widget_names.up.sql":   testMigrations["migrations/0002_widget_names.up.sql"],
+		"migrations/0002_widget_names.down.sql": testMigrations["migrations/0002_widget_names.down.sql"],
+	}
+	migrations, err := Load(slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	applied := make([]int, 2)
+	errs := make([]error, 2)
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied[i], errs[i] = up(conn, migrations)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("expected both migrators to succeed, got %v", err)
+		}
+	}
+	if applied[0]+applied[1] != 2 {
+		t.Errorf("expected each migration applied once, got %v", applied)
+	}
+	if schemaVersion(t, conn) != 2 {
+		t.Error("expected the schema at version 2")
+	}
+}
@@ -0,0 +1,121 @@
+// Package money holds amounts of money as integer minor units, for
+// productservice, orderservice and paymentservice.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Money is an amount in integer minor units (cents) of the currency it is
+// stored next to. Prices used to be float64, which can't represent most
+// decimal amounts exactly, so totals drifted by fractions of a cent; all
+// arithmetic now happens on integers.
+//
+// On the wire Money is still a plain JSON number in major units (12.5 means
+// 12.50), so clients written against the float API keep working.
+type Money int64
+
+// MinorUnits is the number of minor units per major unit. Every currency
+// in supportedCurrencies has two decimal places.
+const MinorUnits = 100
+
+// DefaultCurrency is assumed when a request doesn't name one.
+const DefaultCurrency = "USD"
+
+// supportedCurrencies are the ISO 4217 codes we accept.
+var supportedCurrencies = map[string]bool{
+	"USD": true,
+	"EUR": true,
+	"GBP": true,
+	"CAD": true,
+	"AUD": true,
+}
+
+// NormalizeCurrency upper-cases code, defaulting it when empty, and reports
+// whether the result is supported.
+func NormalizeCurrency(code string) (string, bool) {
+	if code == "" {
+		return DefaultCurrency, true
+	}
+	code = strings.ToUpper(code)
+	return code, supportedCurrencies[code]
+}
+
+// decimal is the amount syntax Parse accepts: what a JSON number allows,
+// with at most a three-digit exponent. big.Rat on its own also takes
+// fractions ("1/4") and hex ("0x10"), and would spend its time building
+// the huge integer an exponent like 1e999999 describes.
+var decimal = regexp.MustCompile(`^-?\d+(\.\d+)?([eE][+-]?\d{1,3})?$`)
+
+// Parse converts a decimal amount in major units ("12.5", "1.3e3") to
+// Money without going through float64. Amounts with fractions of a minor
+// unit are rejected rather than rounded.
+func Parse(s string) (Money, error) {
+	if !decimal.MatchString(s) {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	r.Mul(r, big.NewRat(MinorUnits, 1))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("amount %q has more than two decimal places", s)
+	}
+	n := r.Num()
+	if !n.IsInt64() {
+		return 0, fmt.Errorf("amount %q is out of range", s)
+	}
+	return Money(n.Int64()), nil
+}
+
+// String formats m in major units with no trailing zeros: 1300, 12.5, 0.99.
+func (m Money) String() string {
+	// The absolute value is unsigned: -m doesn't fit in an int64 when m is
+	// math.MinInt64, but its uint64 negation is exact.
+	sign := ""
+	abs := uint64(m)
+	if m < 0 {
+		sign = "-"
+		abs = -abs
+	}
+	major, minor := abs/MinorUnits, abs%MinorUnits
+	if minor == 0 {
+		return fmt.Sprintf("%s%d", sign, major)
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%02d", sign, major, minor), "0")
+}
+
+// Mul returns m multiplied by a quantity, failing rather than wrapping
+// around if the result doesn't fit.
+func (m Money) Mul(quantity int) (Money, error) {
+	product := int64(m) * int64(quantity)
+	if quantity != 0 && product/int64(quantity) != int64(m) {
+		return 0, errors.New("amount out of range")
+	}
+	return Money(product), nil
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		return errors.New("amount must be a JSON number, not a string")
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
@@ -0,0 +1,112 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Money
+	}{
+		{"1300", 130000},
+		{"89.99", 8999},
+		{"0.1", 10},
+		{"12.50", 1250},
+		{"12.500", 1250},
+		{"1.3e3", 130000},
+		{"1.5E+2", 15000},
+		{"2500e-2", 2500},
+		{"-5.25", -525},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if err != nil {
+			t.Errorf("Parse(%q): unexpected error %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+
+	invalid := []struct {
+		in, why string
+	}{
+		{"", "empty"},
+		{"abc", "not a number"},
+		{"0.001", "fraction of a cent"},
+		{"1e30", "out of range"},
+		{"1/4", "a fraction"},
+		{"0x10", "hex"},
+		{"0b101", "binary"},
+		{"+5", "a plus sign"},
+		{".5", "no integer part"},
+		{"5.", "no fractional digits"},
+		{" 5", "surrounding space"},
+		{"1e999999", "an exponent too long to evaluate"},
+		{"1e-999999", "a negative exponent too long to evaluate"},
+		{"1e1000", "a four-digit exponent"},
+		{"1e999", "out of range"},
+	}
+	for _, tt := range invalid {
+		if _, err := Parse(tt.in); err == nil {
+			t.Errorf("Parse(%q): expected an error for %s", tt.in, tt.why)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		in   Money
+		want string
+	}{
+		{130000, "1300"},
+		{8999, "89.99"},
+		{1250, "12.5"},
+		{5, "0.05"},
+		{-525, "-5.25"},
+		{math.MaxInt64, "92233720368547758.07"},
+		{math.MinInt64, "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+	}
+}
+
+// 0.1 + 0.2 style float drift is exactly what Money exists to avoid.
+func TestMoneyJSONRoundTripIsExact(t *testing.T) {
+	var p struct {
+		Price Money `json:"price"`
+	}
+	if err := json.Unmarshal([]byte(`{"price":0.29}`), &p); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	total, err := p.Price.Mul(3)
+	if err != nil {
+		t.Fatalf("Mul: %v", err)
+	}
+	if total != 87 {
+		t.Errorf("expected 87 cents, got %d", total)
+	}
+	out, _ := json.Marshal(struct {
+		Total Money `json:"total"`
+	}{total})
+	if string(out) != `{"total":0.87}` {
+		t.Errorf("unexpected JSON %s", out)
+	}
+
+	if err := json.Unmarshal([]byte(`{"price":"0.29"}`), &p); err == nil {
+		t.Error("expected string amounts to be rejected")
+	}
+}
+
+func TestMoneyMulOverflow(t *testing.T) {
+	if _, err := Money(1 << 62).Mul(4); err == nil {
+		t.Error("expected overflow error")
+	}
+}
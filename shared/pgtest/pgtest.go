@@ -0,0 +1,81 @@
+// Package pgtest gives tests a Postgres database of their own, for the
+// things in-memory SQLite can't stand in for, such as running the
+// services' migrations.
+package pgtest
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DSNVar names the environment variable holding the connection string,
+// in key=value form ("host=localhost user=postgres password=postgres
+// dbname=postgres sslmode=disable"). Tests that need Postgres are skipped
+// without it.
+const DSNVar = "TEST_POSTGRES_DSN"
+
+var schemas atomic.Int64
+
+// Open returns a connection whose tables go in a schema of its own,
+// dropped when the test ends, so tests can run in parallel against one
+// database and leave nothing behind.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv(DSNVar)
+	if dsn == "" {
+		t.Skipf("set %s to run against Postgres", DSNVar)
+	}
+	quiet := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+
+	admin, err := gorm.Open(postgres.Open(dsn), quiet)
+	if err != nil {
+		t.Fatalf("connecting to Postgres: %v", err)
+	}
+	schema := fmt.Sprintf("test_%d_%d", time.Now().UnixNano(), schemas.Add(1))
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := admin.Exec("DROP SCHEMA " + schema + " CASCADE").Error; err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	conn, err := gorm.Open(postgres.Open(dsn+" search_path="+schema), quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return conn
+}
+
+// CheckColumns fails t for each field of models that db has no column
+// for, such as one a model gained without a migration adding it.
+func CheckColumns(t testing.TB, db *gorm.DB, models ...any) {
+	t.Helper()
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("%s has no column %s for %s.%s", stmt.Schema.Table, field.DBName, stmt.Schema.Name, field.Name)
+			}
+		}
+	}
+}
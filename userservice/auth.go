@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Lockout: after maxFailedLogins wrong passwords in a row, whether at login
+// or as the current password of a change, an account refuses both, even
+// with the right password, for lockoutPeriod.
+const (
+	maxFailedLogins = 5
+	lockoutPeriod   = 15 * time.Minute
+)
+
+// Password policy. bcrypt ignores everything past 72 bytes, so longer
+// passwords are refused rather than silently truncated.
+const (
+	minPasswordLength = 12
+	maxPasswordBytes  = 72
+)
+
+// bcryptCost is a variable so tests can use bcrypt.MinCost.
+var bcryptCost = bcrypt.DefaultCost
+
+// Credential maps to the "credentials" table: one row per user who has
+// set a password. It's kept out of User so the hash can't end up in a
+// User response or be overwritten by a profile update.
+type Credential struct {
+	UserID         int    `gorm:"primaryKey;autoIncrement:false"`
+	PasswordHash   string `gorm:"not null"`
+	FailedAttempts int    `gorm:"not null;default:0"`
+	LockedUntil    *time.Time
+	UpdatedAt      time.Time
+}
+
+// lockedFor returns how much longer cred is locked out at now, or zero.
+func (cred *Credential) lockedFor(now time.Time) time.Duration {
+	if cred.LockedUntil != nil && now.Before(*cred.LockedUntil) {
+		return cred.LockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// recordFailure counts a wrong password against cred, locking it out for
+// lockoutPeriod once there have been maxFailedLogins in a row.
+func (cred *Credential) recordFailure(now time.Time) {
+	cred.FailedAttempts++
+	if cred.FailedAttempts >= maxFailedLogins {
+		until := now.Add(lockoutPeriod)
+		cred.FailedAttempts = 0
+		cred.LockedUntil = &until
+	}
+}
+
+// writeLockedOut sends the 429 for an account locked out for d more.
+func writeLockedOut(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+	http.Error(w, "Too many wrong passwords; try again later", http.StatusTooManyRequests)
+}
+
+// commonPasswords are refused outright; they head every guessing list.
+var commonPasswords = map[string]bool{
+	"password1234": true, "123456789012": true, "qwertyuiopas": true,
+	"letmein12345": true, "iloveyou1234": true, "passwordpassword": true,
+	"administrator": true, "welcome12345": true,
+}
+
+// dummyHash is compared against when a login names an unknown email, so
+// that response takes as long as a wrong password and doesn't reveal
+// which emails have accounts.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// checkPasswordPolicy returns a client-facing error if password is too
+// weak for user.
+func checkPasswordPolicy(password string, user User) error {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return errors.New("Password must be at least " + strconv.Itoa(minPasswordLength) + " characters")
+	}
+	if len(password) > maxPasswordBytes {
+		return errors.New("Password must be at most " + strconv.Itoa(maxPasswordBytes) + " bytes")
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return errors.New("Password is too common")
+	}
+	local, _, _ := strings.Cut(user.Email, "@")
+	for _, part := range append(strings.Fields(strings.ToLower(user.Name)), local) {
+		// Very short names would rule out too much to be useful.
+		if utf8.RuneCountInString(part) >= 4 && strings.Contains(lower, part) {
+			return errors.New("Password must not contain your name or email")
+		}
+	}
+	first, _ := utf8.DecodeRuneInString(password)
+	if strings.Trim(password, string(first)) == "" {
+		return errors.New("Password must not be a single repeated character")
+	}
+	return nil
+}
+
+type passwordRequest struct {
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password"`
+}
+
+// setPasswordHandler handles POST /users/{id}/password. Setting the first
+// password needs only the new one; changing it also needs the current
+// password, and a wrong one counts toward the same lockout as a failed
+// login. A successful change clears any lockout.
+func setPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/users/"), "/password")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req passwordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	if err := db.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := checkPasswordPolicy(req.Password, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptCost)
+	if err != nil {
+		http.Error(w, "Failed to set password", http.StatusInternalServerError)
+		return
+	}
+
+	var lockedFor time.Duration
+	var wrongCurrent bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var cred Credential
+		err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&cred, "user_id = ?", id).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			cred = Credential{UserID: id}
+		case err != nil:
+			return err
+		default:
+			now := time.Now()
+			if lockedFor = cred.lockedFor(now); lockedFor > 0 {
+				return nil
+			}
+			if bcrypt.CompareHashAndPassword([]byte(cred.PasswordHash), []byte(req.CurrentPassword)) != nil {
+				wrongCurrent = true
+				cred.recordFailure(now)
+				return tx.Save(&cred).Error
+			}
+		}
+
+		cred.PasswordHash = string(hash)
+		cred.FailedAttempts = 0
+		cred.LockedUntil = nil
+		return tx.Save(&cred).Error
+	})
+	switch {
+	case err != nil:
+		http.Error(w, "Failed to set password", http.StatusInternalServerError)
+	case lockedFor > 0:
+		writeLockedOut(w, lockedFor)
+	case wrongCurrent:
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// loginHandler handles POST /auth/login, returning a signed token (see
+// token.go) and the user on success.
+// Unknown emails and wrong passwords get the same 401. A locked account
+// gets a 429 with Retry-After until the lockout ends.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	email, err := normalizeEmail(req.Email)
+	if err != nil || req.Password == "" {
+		http.Error(w, "Email and password are required", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	var lockedFor time.Duration
+	var authenticated bool
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("email = ?", email).First(&user).Error; err != nil {
+			return err
+		}
+		var cred Credential
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&cred, "user_id = ?", user.ID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if lockedFor = cred.lockedFor(now); lockedFor > 0 {
+			return nil
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(cred.PasswordHash), []byte(req.Password)) == nil {
+			authenticated = true
+			cred.FailedAttempts = 0
+			cred.LockedUntil = nil
+		} else {
+			cred.recordFailure(now)
+		}
+		return tx.Save(&cred).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+	case err != nil:
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+	case lockedFor > 0:
+		writeLockedOut(w, lockedFor)
+	case !authenticated:
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+	default:
+		token, err := issueToken(user)
+		if err != nil {
+			http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(tokenResponse{
+			Token:     token,
+			TokenType: "Bearer",
+			ExpiresIn: int(tokenTTL.Seconds()),
+			User:      user,
+		})
+	}
+}
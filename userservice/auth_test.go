@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"shared/authz"
+)
+
+const testPassword = "correct horse battery"
+
+// seedUserWithPassword creates alice@example.com with testPassword set
+// through the API.
+func seedUserWithPassword(t *testing.T) {
+	t.Helper()
+	orig := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	t.Cleanup(func() { bcryptCost = orig })
+
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+	if rec := postPassword(t, 1, `{"password":"`+testPassword+`"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("setting password: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func postPassword(t *testing.T, id int, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/users/"+strconv.Itoa(id)+"/password", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(req, id))
+	return rec
+}
+
+func login(t *testing.T, email, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(loginRequest{Email: email, Password: password})
+	rec := httptest.NewRecorder()
+	loginHandler(rec, httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(string(body))))
+	return rec
+}
+
+func TestLogin(t *testing.T) {
+	setupTestDB(t)
+	seedUserWithPassword(t)
+
+	rec := login(t, "Alice@Example.com", testPassword)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(strings.ToLower(rec.Body.String()), "hash") || strings.Contains(rec.Body.String(), "$2a$") {
+		t.Errorf("login response leaks credentials: %s", rec.Body.String())
+	}
+	var resp tokenResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.User.ID != 1 || resp.Token == "" || resp.TokenType != "Bearer" {
+		t.Errorf("expected a token for user 1, got %+v", resp)
+	}
+}
+
+func TestSeedUsersNeedsPassword(t *testing.T) {
+	setupTestDB(t)
+	orig := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	t.Cleanup(func() { bcryptCost = orig })
+
+	if err := seedUsers(""); err != nil {
+		t.Fatalf("expected no password to skip seeding, got %v", err)
+	}
+	if err := seedUsers("password"); err == nil {
+		t.Error("expected a weak password to be refused")
+	}
+	var count int64
+	db.Model(&User{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no users seeded, got %d", count)
+	}
+
+	if err := seedUsers(testPassword); err != nil {
+		t.Fatal(err)
+	}
+	rec := login(t, "admin@example.com", testPassword)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the seeded admin to log in, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp tokenResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	var roles []UserRole
+	db.Where("user_id = ?", resp.User.ID).Find(&roles)
+	if len(roles) != 1 || roles[0].Role != authz.RoleAdmin {
+		t.Errorf("expected the seeded admin to be an admin, got %+v", roles)
+	}
+	if rec := login(t, "demo@example.com", testPassword); rec.Code != http.StatusOK {
+		t.Errorf("expected the demo user to log in, got %d", rec.Code)
+	}
+
+	// Seeding only happens on an empty database.
+	if err := seedUsers(testPassword); err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&User{}).Count(&count)
+	if count != 2 {
+		t.Errorf("expected seeding to run once, got %d users", count)
+	}
+}
+
+func TestLoginFailures(t *testing.T) {
+	setupTestDB(t)
+	seedUserWithPassword(t)
+	db.Create(&User{Name: "Bob", Email: "bob@example.com"}) // no password set
+
+	for _, tc := range []struct{ email, password string }{
+		{"alice@example.com", "wrong password!!"},
+		{"nobody@example.com", testPassword},
+		{"bob@example.com", testPassword},
+	} {
+		if rec := login(t, tc.email, tc.password); rec.Code != http.StatusUnauthorized {
+			t.Errorf("login(%s): expected 401, got %d", tc.email, rec.Code)
+		}
+	}
+	if rec := login(t, "alice@example.com", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a password, got %d", rec.Code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	setupTestDB(t)
+	seedUserWithPassword(t)
+
+	for i := 0; i < maxFailedLogins; i++ {
+		if rec := login(t, "alice@example.com", "wrong password!!"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, rec.Code)
+		}
+	}
+
+	rec := login(t, "alice@example.com", testPassword)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After while locked, got %d", rec.Code)
+	}
+
+	// Once the lockout has passed, the right password works again.
+	past := time.Now().Add(-time.Second)
+	db.Model(&Credential{}).Where("user_id = ?", 1).Update("locked_until", past)
+	if rec := login(t, "alice@example.com", testPassword); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after lockout, got %d", rec.Code)
+	}
+}
+
+func TestChangePasswordNeedsCurrentPassword(t *testing.T) {
+	setupTestDB(t)
+	seedUserWithPassword(t)
+
+	if rec := postPassword(t, 1, `{"password":"a brand new secret"}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 without the current password, got %d", rec.Code)
+	}
+	rec := postPassword(t, 1, `{"password":"a brand new secret","current_password":"`+testPassword+`"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := login(t, "alice@example.com", "a brand new secret"); rec.Code != http.StatusOK {
+		t.Errorf("expected the new password to work, got %d", rec.Code)
+	}
+	if rec := login(t, "alice@example.com", testPassword); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old password to stop working, got %d", rec.Code)
+	}
+}
+
+func TestWrongCurrentPasswordsLockTheAccount(t *testing.T) {
+	setupTestDB(t)
+	seedUserWithPassword(t)
+
+	// Failures at login and at a password change share one count.
+	login(t, "alice@example.com", "wrong password!!")
+	for i := 1; i < maxFailedLogins; i++ {
+		rec := postPassword(t, 1, `{"password":"a brand new secret","current_password":"wrong password!!"}`)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("attempt %d: expected 403, got %d", i, rec.Code)
+		}
+	}
+
+	rec := postPassword(t, 1, `{"password":"a brand new secret","current_password":"`+testPassword+`"}`)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After while locked, got %d", rec.Code)
+	}
+	if rec := login(t, "alice@example.com", testPassword); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected logins locked out too, got %d", rec.Code)
+	}
+
+	past := time.Now().Add(-time.Second)
+	db.Model(&Credential{}).Where("user_id = ?", 1).Update("locked_until", past)
+	rec = postPassword(t, 1, `{"password":"a brand new secret","current_password":"`+testPassword+`"}`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 after the lockout, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice Smith", Email: "alice@example.com"})
+
+	for _, pw := range []string{
+		"short",
+		strings.Repeat("x", 73),
+		"Password1234",
+		"my name is smith ok",
+		"alice-likes-cats",
+		"zzzzzzzzzzzzzz",
+	} {
+		if rec := postPassword(t, 1, `{"password":"`+pw+`"}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("password %q: expected 400, got %d", pw, rec.Code)
+		}
+	}
+	var count int64
+	db.Model(&Credential{}).Count(&count)
+	if count != 0 {
+		t.Errorf("no password should have been stored, got %d", count)
+	}
+}
+
+func TestSetPasswordUnknownUser(t *testing.T) {
+	setupTestDB(t)
+	if rec := postPassword(t, 9, `{"password":"`+testPassword+`"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestUserJSONNeverIncludesPassword(t *testing.T) {
+	setupTestDB(t)
+	seedUserWithPassword(t)
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, "/users/1", nil), 1, authz.RoleAdmin))
+	if strings.Contains(rec.Body.String(), "$2a$") || strings.Contains(rec.Body.String(), "password") {
+		t.Errorf("user response leaks credentials: %s", rec.Body.String())
+	}
+
+	// A profile update doesn't touch the password.
+	rec = httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodPut, "/users/1", strings.NewReader(`{"name":"Alice","email":"alice@example.com"}`)), 1, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if rec := login(t, "alice@example.com", testPassword); rec.Code != http.StatusOK {
+		t.Errorf("expected password to survive a profile update, got %d", rec.Code)
+	}
+}
+
+func TestCreateUserWithPassword(t *testing.T) {
+	setupTestDB(t)
+	orig := bcryptCost
+	bcryptCost = bcrypt.MinCost
+	t.Cleanup(func() { bcryptCost = orig })
+
+	rec := httptest.NewRecorder()
+	body := `{"name":"Alice","email":"alice@example.com","password":"` + testPassword + `"}`
+	usersRouter(rec, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "password") {
+		t.Errorf("response echoes the password: %s", rec.Body.String())
+	}
+	if rec := login(t, "alice@example.com", testPassword); rec.Code != http.StatusOK {
+		t.Errorf("expected to log in with the signup password, got %d", rec.Code)
+	}
+
+	// A weak password refuses the whole signup.
+	rec = httptest.NewRecorder()
+	body = `{"name":"Bob","email":"bob@example.com","password":"short"}`
+	usersRouter(rec, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	var count int64
+	db.Model(&User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("expected only Alice to be created, got %d users", count)
+	}
+}
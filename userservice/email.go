@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+// normalizeEmail checks that s is a single bare address ("ada@example.com",
+// not "Ada <ada@example.com>") and returns it trimmed and lowercased. Mail
+// servers may treat the local part as case-sensitive, but in practice
+// nobody relies on that, and lowercasing makes the unique index catch
+// "Ada@example.com" signing up twice.
+func normalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return "", errors.New("Email must be a valid address like name@example.com")
+	}
+	if !strings.Contains(s[strings.LastIndex(s, "@")+1:], ".") {
+		return "", errors.New("Email must be a valid address like name@example.com")
+	}
+	return strings.ToLower(s), nil
+}
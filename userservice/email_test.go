@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	valid := map[string]string{
+		"ada@example.com":             "ada@example.com",
+		"  Ada.Lovelace@Example.ORG ": "ada.lovelace@example.org",
+		"ada+orders@mail.example.co":  "ada+orders@mail.example.co",
+	}
+	for in, want := range valid {
+		if got, err := normalizeEmail(in); err != nil || got != want {
+			t.Errorf("normalizeEmail(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "ada", "ada@", "@example.com", "ada@localhost", "Ada <ada@example.com>", "ada@example.com, bob@example.com"} {
+		if _, err := normalizeEmail(in); err == nil {
+			t.Errorf("normalizeEmail(%q) should fail", in)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"shared/httpcond"
+)
+
+// userETag is a strong validator for a user. Version is bumped by every
+// write to the row, so equal tags mean equal representations.
+func userETag(u User) string {
+	return fmt.Sprintf(`"%d-%d"`, u.ID, u.Version)
+}
+
+// setValidators adds the ETag and Last-Modified headers for user.
+func setValidators(w http.ResponseWriter, user User) {
+	w.Header().Set("ETag", userETag(user))
+	if !user.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", user.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// writeUser sends user with its validators, or a bodiless 304 if the
+// request's conditional headers show the client already has this version.
+func writeUser(w http.ResponseWriter, r *http.Request, user User) {
+	setValidators(w, user)
+	if httpcond.NotModified(r, userETag(user), user.UpdatedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getUserWith(t *testing.T, header, value string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	rec := httptest.NewRecorder()
+	getUserHandler(rec, req)
+	return rec
+}
+
+func TestGetUserIfNoneMatch(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+	rec := getUserWith(t, "", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("expected 200 with validators, got %d %v", rec.Code, rec.Header())
+	}
+
+	rec = getUserWith(t, "If-None-Match", etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected empty 304 for a matching tag, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	if rec := getUserWith(t, "If-None-Match", `"1-0"`); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for a stale tag, got %d", rec.Code)
+	}
+}
+
+func TestGetUserIfModifiedSince(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if rec := getUserWith(t, "If-Modified-Since", future); rec.Code != http.StatusNotModified {
+		t.Errorf("expected 304 when unmodified since, got %d", rec.Code)
+	}
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if rec := getUserWith(t, "If-Modified-Since", past); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 when modified since, got %d", rec.Code)
+	}
+}
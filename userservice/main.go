@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -14,20 +16,37 @@ import (
 	"syscall"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"shared/authz"
+	"shared/httpcond"
+	"shared/migrate"
 )
 
 // User maps to the "users" table.
 type User struct {
 	ID    int    `json:"id" gorm:"primaryKey"`
 	Name  string `json:"name"`
-	Email string `json:"email"`
+	Email string `json:"email" gorm:"uniqueIndex:idx_users_email_live,where:deleted_at IS NULL"`
+
+	// Version counts writes to the row and backs the ETag (see etag.go).
+	Version   int            `json:"-" gorm:"not null;default:1"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `json:"deleted_at,omitzero" gorm:"index"`
 }
 
 var db *gorm.DB
 
-func initDB() {
+// migrationFiles holds the versioned schema migrations (see shared/migrate).
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// openDB connects to the database named by the DB_* environment variables.
+func openDB() *gorm.DB {
 	dsn := fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable",
 		os.Getenv("DB_HOST"),
@@ -37,28 +56,82 @@ func initDB() {
 		os.Getenv("DB_PORT"),
 	)
 
-	var err error
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	// TranslateError turns unique violations into gorm.ErrDuplicatedKey.
+	conn, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
+	return conn
+}
 
-	if err := db.AutoMigrate(&User{}); err != nil {
-		log.Fatal("Failed to auto-migrate users table:", err)
+func initDB() {
+	db = openDB()
+	if err := migrate.OnStartup(db, migrationFiles); err != nil {
+		log.Fatal("Failed to migrate database schema:", err)
+	}
+	if err := rotateSigningKeys(db); err != nil {
+		log.Fatal("Failed to set up signing keys:", err)
 	}
 
-	// Seed a default user so the app is usable on first run.
+	if err := seedUsers(os.Getenv("SEED_ADMIN_PASSWORD")); err != nil {
+		log.Fatal("Failed to seed users:", err)
+	}
+}
+
+// seedUsers creates a demo customer and an admin on an empty database so
+// the app is usable on first run. Both get password, which comes from
+// SEED_ADMIN_PASSWORD; without one nothing is seeded, so a deployment
+// that doesn't ask for the demo accounts never has them.
+func seedUsers(password string) error {
 	var count int64
-	db.Model(&User{}).Count(&count)
-	if count == 0 {
-		db.Create(&User{Name: "Demo User", Email: "demo@example.com"})
+	if err := db.Model(&User{}).Count(&count).Error; err != nil || count > 0 {
+		return err
 	}
+	if password == "" {
+		log.Println("SEED_ADMIN_PASSWORD isn't set; not seeding the demo and admin users")
+		return nil
+	}
+
+	demo := User{Name: "Demo User", Email: "demo@example.com", Version: 1}
+	admin := User{Name: "Demo Admin", Email: "admin@example.com", Version: 1}
+	for _, u := range []User{demo, admin} {
+		if err := checkPasswordPolicy(password, u); err != nil {
+			return fmt.Errorf("SEED_ADMIN_PASSWORD: %w", err)
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, seed := range []struct {
+			user *User
+			role string
+		}{{&demo, authz.RoleCustomer}, {&admin, authz.RoleAdmin}} {
+			if err := tx.Create(seed.user).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&Credential{UserID: seed.user.ID, PasswordHash: string(hash)}).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&UserRole{UserID: seed.user.ID, Role: seed.role}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // getAllUsersHandler handles GET /users.
 func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
+	scope, err := readScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	var users []User
-	result := db.Find(&users)
+	result := scope.Find(&users)
 	if result.Error != nil {
 		http.Error(w, "Failed to fetch users", http.StatusInternalServerError)
 		return
@@ -68,7 +141,9 @@ func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
-// getUserHandler handles GET /users/{id}.
+// getUserHandler handles GET /users/{id}. The response carries an ETag
+// and Last-Modified; a request whose If-None-Match (or failing that,
+// If-Modified-Since) shows it is up to date gets a 304.
 func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	idStr := strings.TrimPrefix(r.URL.Path, "/users/")
 	id, err := strconv.Atoi(idStr)
@@ -76,9 +151,14 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
+	scope, err := readScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	var user User
-	result := db.First(&user, id)
+	result := scope.First(&user, id)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
 			http.Error(w, "User not found", http.StatusNotFound)
@@ -88,37 +168,355 @@ func getUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	writeUser(w, r, user)
 }
 
-// createUserHandler handles POST /users.
+// newUserRequest is the POST /users body: the user, plus optionally a
+// password so the new user can log in straight away.
+type newUserRequest struct {
+	User
+	Password string `json:"password"`
+}
+
+// createUserHandler handles POST /users. New users are customers.
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	var req newUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	user := req.User
 
 	// IDs are assigned by the database, never by the client.
 	user.ID = 0
+	user.Version = 1
 
-	if user.Name == "" || user.Email == "" {
-		http.Error(w, "Name and email are required", http.StatusBadRequest)
+	if err := validateUser(&user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	var hash []byte
+	if req.Password != "" {
+		if err := checkPasswordPolicy(req.Password, user); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		if hash, err = bcrypt.GenerateFromPassword([]byte(req.Password), bcryptCost); err != nil {
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	result := db.Create(&user)
-	if result.Error != nil {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&UserRole{UserID: user.ID, Role: authz.RoleCustomer}).Error; err != nil {
+			return err
+		}
+		if hash == nil {
+			return nil
+		}
+		return tx.Create(&Credential{UserID: user.ID, PasswordHash: string(hash)}).Error
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		http.Error(w, "Email already in use", http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
 
+	setValidators(w, user)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
 }
 
+// updateUserHandler handles PUT /users/{id} (full replacement) and PATCH
+// /users/{id} (JSON merge patch, RFC 7396). The result is validated like a
+// new user; taking another user's email gets a 409, and an If-Match that
+// doesn't name the current ETag gets a 412.
+func updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/users/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var updated User
+	var invalid error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var existing User
+		if err := tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate}).First(&existing, id).Error; err != nil {
+			return err
+		}
+		if httpcond.PreconditionFailed(r, userETag(existing)) {
+			return httpcond.ErrPreconditionFailed
+		}
+
+		updated, invalid = applyUserUpdate(existing, r.Method, body)
+		if invalid != nil {
+			return invalid
+		}
+		return tx.Save(&updated).Error
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, httpcond.ErrPreconditionFailed):
+			http.Error(w, "User has changed; fetch it again and retry", http.StatusPreconditionFailed)
+		case invalid != nil:
+			http.Error(w, invalid.Error(), http.StatusBadRequest)
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+		case errors.Is(err, gorm.ErrDuplicatedKey):
+			http.Error(w, "Email already in use", http.StatusConflict)
+		default:
+			http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	setValidators(w, updated)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// applyUserUpdate builds the user that a PUT or PATCH body turns existing
+// into, returning a client-facing error if the body is unusable.
+func applyUserUpdate(existing User, method string, body []byte) (User, error) {
+	var updated User
+	if method == http.MethodPatch {
+		current, err := json.Marshal(existing)
+		if err != nil {
+			return User{}, err
+		}
+		merged, err := mergePatch(current, body)
+		if err != nil {
+			return User{}, errors.New("Invalid merge patch: " + err.Error())
+		}
+		if err := json.Unmarshal(merged, &updated); err != nil {
+			return User{}, errors.New("Invalid merge patch: " + err.Error())
+		}
+	} else if err := json.Unmarshal(body, &updated); err != nil {
+		return User{}, errors.New("Invalid JSON")
+	}
+
+	// The ID comes from the URL; a body can't move a user to another row.
+	// The timestamps are the server's: a body can't backdate the user or
+	// delete it, and a PUT that leaves them out doesn't zero them.
+	updated.ID = existing.ID
+	updated.Version = existing.Version + 1
+	updated.CreatedAt = existing.CreatedAt
+	updated.UpdatedAt = existing.UpdatedAt
+	updated.DeletedAt = existing.DeletedAt
+
+	if err := validateUser(&updated); err != nil {
+		return User{}, err
+	}
+	return updated, nil
+}
+
+// deleteUserHandler handles DELETE /users/{id}. Deletes are soft: the
+// user can't log in or be looked up any more, but the row keeps its
+// password and roles so an admin can restore the account.
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimPrefix(r.URL.Path, "/users/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	// Set deleted_at by hand rather than with db.Delete so the version
+	// moves too, and an ETag from before the delete goes stale.
+	result := db.Model(&User{}).Where("id = ?", id).
+		Updates(map[string]any{"deleted_at": time.Now(), "version": gorm.Expr("version + 1")})
+	if result.Error != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if result.RowsAffected == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreUserHandler handles POST /users/{id}/restore, bringing back a
+// deleted account with its password and roles. If someone has signed up
+// with the same email since, it gets a 409.
+func restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/users/"), "/restore")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var user User
+	result := db.Unscoped().First(&user, id)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !user.DeletedAt.Valid {
+		http.Error(w, "User isn't deleted", http.StatusConflict)
+		return
+	}
+
+	result = db.Unscoped().Model(&User{}).Where("id = ? AND deleted_at IS NOT NULL", id).
+		Updates(map[string]any{"deleted_at": nil, "version": gorm.Expr("version + 1")})
+	if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+		http.Error(w, "Email already in use", http.StatusConflict)
+		return
+	}
+	if result.Error != nil {
+		http.Error(w, "Failed to restore user", http.StatusInternalServerError)
+		return
+	}
+	if err := db.First(&user, id).Error; err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	writeUser(w, r, user)
+}
+
+var errIncludeDeleted = errors.New("Only support and admins can include deleted users")
+
+// readScope returns what to read users through for r: db, which hides
+// deleted users, or, when support or an admin asks for
+// ?include_deleted=true, a handle that shows them too.
+func readScope(r *http.Request) (*gorm.DB, error) {
+	if r.URL.Query().Get("include_deleted") != "true" {
+		return db, nil
+	}
+	if !authz.RequestCaller(r).HasRole(authz.RoleSupport, authz.RoleAdmin) {
+		return nil, errIncludeDeleted
+	}
+	return db.Unscoped(), nil
+}
+
+// validateUser enforces the rules every stored user must satisfy,
+// normalizing the email in place.
+func validateUser(u *User) error {
+	u.Name = strings.TrimSpace(u.Name)
+	if u.Name == "" || u.Email == "" {
+		return errors.New("Name and email are required")
+	}
+	email, err := normalizeEmail(u.Email)
+	if err != nil {
+		return err
+	}
+	u.Email = email
+	return nil
+}
+
+// mergePatch applies an RFC 7396 JSON merge patch to doc: object members in
+// the patch replace those in doc, null members delete them, and any
+// non-object patch replaces doc wholesale.
+func mergePatch(doc, patch []byte) ([]byte, error) {
+	var target, p any
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(target, p))
+}
+
+func mergeValue(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergeValue(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+// permissions lists who may call each route (see shared/authz). Anyone can
+// sign up and log in; users manage their own account, support can look
+// after anyone's, and only admins hand out roles. orderservice looks up
+// the users it takes orders for.
+var permissions = []authz.Permission{
+	{Method: "GET", Path: "/users", Allow: []string{authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "POST", Path: "/users", Allow: []string{authz.AllowAnyone}},
+	{Method: "GET", Path: "/users/{id}", Allow: []string{authz.AllowSelf, authz.RoleSupport, authz.RoleAdmin, authz.RoleService}},
+	{Method: "PUT", Path: "/users/{id}", Allow: []string{authz.AllowSelf, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "PATCH", Path: "/users/{id}", Allow: []string{authz.AllowSelf, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "DELETE", Path: "/users/{id}", Allow: []string{authz.AllowSelf, authz.RoleAdmin}},
+	{Method: "POST", Path: "/users/{id}/password", Allow: []string{authz.AllowSelf}},
+	{Method: "GET", Path: "/users/{id}/roles", Allow: []string{authz.AllowSelf, authz.RoleSupport, authz.RoleAdmin}},
+	{Method: "PUT", Path: "/users/{id}/roles", Allow: []string{authz.RoleAdmin}},
+	{Method: "POST", Path: "/users/{id}/restore", Allow: []string{authz.RoleAdmin}},
+	{Method: "POST", Path: "/auth/login", Allow: []string{authz.AllowAnyone}},
+	{Method: "GET", Path: "/.well-known/jwks.json", Allow: []string{authz.AllowAnyone}},
+}
+
+// usersRouter is the /users entry point: authz.Authorize checks the request
+// against permissions, then routeUsers dispatches it.
+var usersRouter = authz.Authorize(permissions, routeUsers)
+
+// routeUsers dispatches /users requests by method and path.
+func routeUsers(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case (r.Method == http.MethodGet || r.Method == http.MethodPut) &&
+		strings.HasPrefix(r.URL.Path, "/users/") && strings.HasSuffix(r.URL.Path, "/roles"):
+		rolesHandler(w, r)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/users/") && strings.HasSuffix(r.URL.Path, "/password"):
+		setPasswordHandler(w, r)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/users/") && strings.HasSuffix(r.URL.Path, "/restore"):
+		restoreUserHandler(w, r)
+
+	case r.Method == http.MethodGet && (r.URL.Path == "/users" || r.URL.Path == "/users/"):
+		getAllUsersHandler(w, r)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/users":
+		createUserHandler(w, r)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/users/"):
+		getUserHandler(w, r)
+
+	case (r.Method == http.MethodPut || r.Method == http.MethodPatch) && strings.HasPrefix(r.URL.Path, "/users/"):
+		updateUserHandler(w, r)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/users/"):
+		deleteUserHandler(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // healthzHandler reports whether the service can do its job: alive and
 // able to reach the database. The ping gets a short deadline so a hung
 // DB connection makes the check fail instead of hang.
@@ -138,20 +536,21 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate.Command(openDB(), migrationFiles, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	initDB()
+	go runKeyRotation()
 
 	http.HandleFunc("/healthz", healthzHandler)
-	http.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			getAllUsersHandler(w, r)
-		} else if r.Method == http.MethodPost {
-			createUserHandler(w, r)
-		} else {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		}
-	})
-
-	http.HandleFunc("/users/", getUserHandler)
+	http.HandleFunc("/users", usersRouter)
+	http.HandleFunc("/users/", usersRouter)
+	http.HandleFunc("/auth/login", authz.Authorize(permissions, loginHandler))
+	http.HandleFunc("/.well-known/jwks.json", authz.Authorize(permissions, jwksHandler))
 
 	server := &http.Server{
 		Addr:         ":8083",
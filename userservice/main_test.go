@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/glebarez/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
+	"shared/authz"
 )
 
 // setupTestDB swaps the package-level db for an in-memory SQLite database.
@@ -18,14 +21,29 @@ func setupTestDB(t *testing.T) {
 	var err error
 	db, err = gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
 		// Silence GORM's error-level logging; not-found tests trigger it by design.
-		Logger: logger.Default.LogMode(logger.Silent),
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
 	})
 	if err != nil {
 		t.Fatalf("failed to open test database: %v", err)
 	}
-	if err := db.AutoMigrate(&User{}); err != nil {
+	if err := db.AutoMigrate(&User{}, &Credential{}, &UserRole{}, &SigningKey{}); err != nil {
 		t.Fatalf("failed to migrate: %v", err)
 	}
+	if err := rotateSigningKeys(db); err != nil {
+		t.Fatalf("failed to create signing key: %v", err)
+	}
+}
+
+// asUser adds the identity headers the gateway forwards for a verified
+// token, with the customer role unless other roles are given.
+func asUser(req *http.Request, userID int, roles ...string) *http.Request {
+	if len(roles) == 0 {
+		roles = []string{authz.RoleCustomer}
+	}
+	req.Header.Set(authz.HeaderUserID, strconv.Itoa(userID))
+	req.Header.Set(authz.HeaderUserRoles, strings.Join(roles, ","))
+	return req
 }
 
 func TestGetAllUsers(t *testing.T) {
@@ -189,3 +207,245 @@ func TestHealthzDatabaseDown(t *testing.T) {
 		t.Errorf("expected 503, got %d", rec.Code)
 	}
 }
+
+func TestCreateUserNormalizesEmail(t *testing.T) {
+	setupTestDB(t)
+
+	body := strings.NewReader(`{"name":" Alice ","email":" Alice@Example.COM "}`)
+	rec := httptest.NewRecorder()
+	usersRouter(rec, httptest.NewRequest(http.MethodPost, "/users", body))
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var user User
+	json.NewDecoder(rec.Body).Decode(&user)
+	if user.Email != "alice@example.com" || user.Name != "Alice" {
+		t.Errorf("expected trimmed name and normalized email, got %+v", user)
+	}
+}
+
+func TestCreateUserDuplicateEmail(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+	body := strings.NewReader(`{"name":"Imposter","email":"ALICE@example.com"}`)
+	rec := httptest.NewRecorder()
+	usersRouter(rec, httptest.NewRequest(http.MethodPost, "/users", body))
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReplaceUser(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+	body := strings.NewReader(`{"id":42,"name":"Alice Smith","email":"alice.smith@example.com"}`)
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodPut, "/users/1", body), 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var stored User
+	db.First(&stored, 1)
+	if stored.Name != "Alice Smith" || stored.Email != "alice.smith@example.com" {
+		t.Errorf("expected user to be replaced, got %+v", stored)
+	}
+	var count int64
+	db.Model(&User{}).Count(&count)
+	if count != 1 {
+		t.Errorf("body ID should be ignored, expected 1 user, got %d", count)
+	}
+}
+
+func TestPatchUserEmail(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodPatch, "/users/1", strings.NewReader(`{"email":"Alice@New.example"}`)), 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var user User
+	json.NewDecoder(rec.Body).Decode(&user)
+	if user.Name != "Alice" || user.Email != "alice@new.example" {
+		t.Errorf("expected name kept and email patched, got %+v", user)
+	}
+}
+
+func TestUpdateUserKeepsTimestamps(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, tc := range map[string]struct{ method, body string }{
+		"put without them":   {http.MethodPut, `{"name":"Alice","email":"alice@example.com"}`},
+		"patch setting them": {http.MethodPatch, `{"created_at":"2030-01-01T00:00:00Z","deleted_at":"2030-01-01T00:00:00Z"}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setupTestDB(t)
+			db.Create(&User{Name: "Alice", Email: "alice@example.com", CreatedAt: created})
+
+			rec := httptest.NewRecorder()
+			usersRouter(rec, asUser(httptest.NewRequest(tc.method, "/users/1", strings.NewReader(tc.body)), 1, authz.RoleAdmin))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if strings.Contains(rec.Body.String(), "deleted_at") {
+				t.Errorf("expected no deleted_at on a live user, got %s", rec.Body.String())
+			}
+			var stored User
+			if err := db.First(&stored, 1).Error; err != nil {
+				t.Fatalf("expected the user to stay live: %v", err)
+			}
+			if !stored.CreatedAt.Equal(created) {
+				t.Errorf("expected created_at %s to be kept, got %s", created, stored.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestUpdateUserEmailConflict(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&[]User{
+		{Name: "Alice", Email: "alice@example.com"},
+		{Name: "Bob", Email: "bob@example.com"},
+	})
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodPatch, "/users/2", strings.NewReader(`{"email":"alice@example.com"}`)), 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUpdateUserValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+	}{
+		{"invalid JSON", http.MethodPut, `{not json`},
+		{"bad email", http.MethodPatch, `{"email":"not-an-email"}`},
+		{"display name", http.MethodPatch, `{"email":"Alice <alice@example.com>"}`},
+		{"clear name", http.MethodPatch, `{"name":null}`},
+		{"replace without email", http.MethodPut, `{"name":"Alice"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+			rec := httptest.NewRecorder()
+			usersRouter(rec, asUser(httptest.NewRequest(tt.method, "/users/1", strings.NewReader(tt.body)), 1, authz.RoleAdmin))
+
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestUpdateUserIfMatch(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+	req := httptest.NewRequest(http.MethodPatch, "/users/1", strings.NewReader(`{"name":"Al"}`))
+	req.Header.Set("If-Match", `"1-0"`)
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a stale If-Match, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/users/1", strings.NewReader(`{"name":"Al"}`))
+	req.Header.Set("If-Match", `"1-1"`)
+	rec = httptest.NewRecorder()
+	usersRouter(rec, asUser(req, 1, authz.RoleAdmin))
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"1-2"` {
+		t.Fatalf("expected 200 with the next ETag, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestUpdateUserNotFound(t *testing.T) {
+	setupTestDB(t)
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodPatch, "/users/99", strings.NewReader(`{"name":"Al"}`)), 1, authz.RoleAdmin))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodDelete, "/users/1", nil), 1, authz.RoleAdmin))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodDelete, "/users/1", nil), 1, authz.RoleAdmin))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 on second delete, got %d", rec.Code)
+	}
+}
+
+func TestDeletedUserHiddenUntilRestored(t *testing.T) {
+	setupTestDB(t)
+	seedUserWithPassword(t)
+	get := func(path string, roles ...string) int {
+		rec := httptest.NewRecorder()
+		usersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, path, nil), 1, roles...))
+		return rec.Code
+	}
+
+	usersRouter(httptest.NewRecorder(), asUser(httptest.NewRequest(http.MethodDelete, "/users/1", nil), 1))
+	if rec := login(t, "alice@example.com", testPassword); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a deleted user's login to fail, got %d", rec.Code)
+	}
+	if code := get("/users/1", authz.RoleAdmin); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+	if code := get("/users/1?include_deleted=true"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for a customer asking for deleted users, got %d", code)
+	}
+	if code := get("/users/1?include_deleted=true", authz.RoleSupport); code != http.StatusOK {
+		t.Errorf("expected support to see the deleted user, got %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodPost, "/users/1/restore", nil), 2, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := login(t, "alice@example.com", testPassword); rec.Code != http.StatusOK {
+		t.Errorf("expected the restored user to log in with their old password, got %d", rec.Code)
+	}
+}
+
+func TestDeletedUsersEmailCanBeReused(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+	usersRouter(httptest.NewRecorder(), asUser(httptest.NewRequest(http.MethodDelete, "/users/1", nil), 1))
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"New Alice","email":"alice@example.com"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected the address to be free again, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodPost, "/users/1/restore", nil), 9, authz.RoleAdmin))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected 409 restoring a user whose email was taken since, got %d", rec.Code)
+	}
+}
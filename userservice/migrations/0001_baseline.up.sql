@@ -0,0 +1,11 @@
+-- The schema userservice started with. Every migration is written to
+-- also run against a database AutoMigrate built at some later release, so
+-- an existing database is brought forward, data and all, from wherever
+-- it is: tables and columns are added only if missing, and data in an
+-- old shape is converted when it's found.
+
+CREATE TABLE IF NOT EXISTS users (
+    id bigserial PRIMARY KEY,
+    name text,
+    email text
+);
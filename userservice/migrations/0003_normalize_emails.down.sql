@@ -0,0 +1,2 @@
+-- The emails as they were typed are gone; normalized ones are still valid.
+SELECT 1;
@@ -0,0 +1,5 @@
+-- Emails are stored trimmed and lower-cased, so they can be compared and
+-- made unique. The unique index itself comes later, in 0008, once users
+-- can be deleted softly.
+
+UPDATE users SET email = LOWER(TRIM(email));
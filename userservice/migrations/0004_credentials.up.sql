@@ -0,0 +1,9 @@
+-- Password hashes, and the failed-login count behind lockouts.
+
+CREATE TABLE IF NOT EXISTS credentials (
+    user_id bigint PRIMARY KEY,
+    password_hash text NOT NULL,
+    failed_attempts bigint NOT NULL DEFAULT 0,
+    locked_until timestamptz,
+    updated_at timestamptz
+);
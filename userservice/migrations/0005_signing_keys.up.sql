@@ -0,0 +1,8 @@
+-- The keys tokens are signed with, rotated daily.
+
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id varchar(32) PRIMARY KEY,
+    private_key bytea NOT NULL,
+    public_key bytea NOT NULL,
+    created_at timestamptz
+);
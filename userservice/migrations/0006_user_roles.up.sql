@@ -0,0 +1,11 @@
+-- The roles each user holds. Users with none become customers, as they
+-- would have been had they signed up after roles existed.
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id bigint,
+    role varchar(32),
+    PRIMARY KEY (user_id, role)
+);
+
+INSERT INTO user_roles (user_id, role)
+SELECT id, 'customer' FROM users WHERE id NOT IN (SELECT user_id FROM user_roles);
@@ -0,0 +1,8 @@
+-- Creation times, and soft delete. Users stored before created_at existed
+-- get their last update, the best guess there is.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at timestamptz;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users (deleted_at);
+
+UPDATE users SET created_at = COALESCE(updated_at, CURRENT_TIMESTAMP) WHERE created_at IS NULL;
@@ -0,0 +1,23 @@
+-- Emails are unique among live users, so a deleted user's address is free
+-- to sign up again. Databases indexed before users could be deleted softly
+-- have idx_users_email over every row, which this replaces. If live users
+-- already share an address the migration fails, naming them, and the
+-- service won't start until they're merged or deleted.
+
+DO $$
+DECLARE
+    shared text;
+BEGIN
+    SELECT string_agg(email || ' (users ' || ids || ')', ', ' ORDER BY email) INTO shared
+    FROM (
+        SELECT email, string_agg(id::text, ', ' ORDER BY id) AS ids
+        FROM users WHERE deleted_at IS NULL
+        GROUP BY email HAVING COUNT(*) > 1
+    ) dupes;
+    IF shared IS NOT NULL THEN
+        RAISE EXCEPTION 'live users share an email, resolve them before indexing: %', shared;
+    END IF;
+END $$;
+
+DROP INDEX IF EXISTS idx_users_email;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_live ON users (email) WHERE deleted_at IS NULL;
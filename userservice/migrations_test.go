@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"shared/authz"
+	"shared/migrate"
+	"shared/pgtest"
+)
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	migrations, err := migrate.Load(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 || migrations[0].Name != "baseline" {
+		t.Errorf("expected the baseline first, got %+v", migrations)
+	}
+}
+
+// The tests below run the real migrations, so they need Postgres (see
+// pgtest.DSNVar) and are skipped without it.
+
+func TestMigrationsBuildTheModels(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+	pgtest.CheckColumns(t, conn, &User{}, &Credential{}, &UserRole{}, &SigningKey{})
+	if !conn.Migrator().HasIndex(&User{}, "idx_users_email_live") {
+		t.Error("expected the unique email index")
+	}
+
+	// Every down has to undo its up, so the schema can go all the way
+	// down and back up.
+	if err := migrate.Command(conn, migrationFiles, []string{"down", "100"}, io.Discard); err != nil {
+		t.Fatalf("migrating down: %v", err)
+	}
+	if conn.Migrator().HasTable(&User{}) {
+		t.Error("expected no users table at version 0")
+	}
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatalf("migrating up again: %v", err)
+	}
+	pgtest.CheckColumns(t, conn, &User{}, &Credential{}, &UserRole{}, &SigningKey{})
+	if err := conn.Create(&User{Name: "Alice", Email: "alice@example.com", Version: 1}).Error; err != nil {
+		t.Errorf("expected to store a user: %v", err)
+	}
+}
+
+// legacyUser is a user as first stored, before emails were normalized.
+type legacyUser struct {
+	ID    int `gorm:"primaryKey"`
+	Name  string
+	Email string
+}
+
+func (legacyUser) TableName() string { return "users" }
+
+func TestMigrationsConvertLegacyUsers(t *testing.T) {
+	conn := pgtest.Open(t)
+	if err := conn.AutoMigrate(&legacyUser{}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Create(&[]legacyUser{
+		{Name: "Alice", Email: " Alice@Example.com"},
+		{Name: "Carol", Email: "carol@example.com"},
+		{Name: "Carol again", Email: "CAROL@example.com "},
+	})
+
+	// Two live users share an address once it's normalized, so the
+	// email index can't be built and startup fails, naming them.
+	err := migrate.OnStartup(conn, migrationFiles)
+	if err == nil || !strings.Contains(err.Error(), "carol@example.com (users 2, 3)") {
+		t.Fatalf("expected the shared email to fail the migration, got %v", err)
+	}
+
+	var users []User
+	conn.Order("id").Find(&users)
+	if len(users) != 3 || users[0].Email != "alice@example.com" || users[2].Email != "carol@example.com" {
+		t.Fatalf("expected emails normalized, got %+v", users)
+	}
+	if u := users[0]; u.Version != 1 || u.CreatedAt.IsZero() {
+		t.Errorf("expected defaults for the new columns, got %+v", u)
+	}
+	var roles []UserRole
+	conn.Order("user_id").Find(&roles)
+	if len(roles) != 3 || roles[0].Role != authz.RoleCustomer {
+		t.Errorf("expected every user to become a customer, got %+v", roles)
+	}
+	if conn.Migrator().HasIndex(&User{}, "idx_users_email_live") {
+		t.Error("expected no email index while two users share an address")
+	}
+
+	conn.Delete(&User{}, users[2].ID)
+	if err := migrate.OnStartup(conn, migrationFiles); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.Migrator().HasIndex(&User{}, "idx_users_email_live") {
+		t.Error("expected the email index once the duplicate is resolved")
+	}
+}
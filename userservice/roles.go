@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+	"shared/authz"
+)
+
+// grantableRoles are the roles a user can hold (see shared/authz for what each
+// is allowed). Every new user is a customer.
+var grantableRoles = []string{authz.RoleCustomer, authz.RoleCatalogAdmin, authz.RoleSupport, authz.RoleAdmin}
+
+// UserRole maps to the "user_roles" table: one row per role a user holds.
+// Roles are copied into the user's tokens at login, so a change takes
+// effect on their next login.
+type UserRole struct {
+	UserID int    `gorm:"primaryKey"`
+	Role   string `gorm:"primaryKey;size:32"`
+}
+
+// userRoles returns the roles user holds, sorted.
+func userRoles(tx *gorm.DB, userID int) ([]string, error) {
+	roles := []string{}
+	err := tx.Model(&UserRole{}).Where("user_id = ?", userID).Order("role").Pluck("role", &roles).Error
+	return roles, err
+}
+
+type rolesBody struct {
+	Roles []string `json:"roles"`
+}
+
+// rolesHandler handles /users/{id}/roles:
+//
+//	GET  the user's roles
+//	PUT  {"roles": ["customer", "support"]} replaces them
+//
+// Admins can't take the admin role away from themselves, so there's
+// always someone left who can hand it out.
+func rolesHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/users/"), "/roles")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	if err := db.First(&User{}, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req rolesBody
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		for _, role := range req.Roles {
+			if !slices.Contains(grantableRoles, role) {
+				http.Error(w, fmt.Sprintf("Unknown role %q", role), http.StatusBadRequest)
+				return
+			}
+		}
+		if id == authz.RequestCaller(r).UserID && !slices.Contains(req.Roles, authz.RoleAdmin) {
+			http.Error(w, "You can't remove your own admin role", http.StatusConflict)
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Delete(&UserRole{}, "user_id = ?", id).Error; err != nil {
+				return err
+			}
+			for _, role := range req.Roles {
+				if err := tx.FirstOrCreate(&UserRole{UserID: id, Role: role}).Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "Failed to update roles", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	roles, err := userRoles(db, id)
+	if err != nil {
+		http.Error(w, "Failed to fetch roles", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rolesBody{Roles: roles})
+}
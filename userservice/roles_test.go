@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shared/authz"
+)
+
+func putRoles(t *testing.T, id string, body string, as *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPut, "/users/"+id+"/roles", strings.NewReader(body))
+	req.Header = as.Header
+	rec := httptest.NewRecorder()
+	usersRouter(rec, req)
+	return rec
+}
+
+func getRoles(t *testing.T, id string) []string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	usersRouter(rec, asUser(httptest.NewRequest(http.MethodGet, "/users/"+id+"/roles", nil), 1, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body rolesBody
+	json.NewDecoder(rec.Body).Decode(&body)
+	return body.Roles
+}
+
+// identity returns a request carrying only the given identity headers.
+func identity(userID int, roles ...string) *http.Request {
+	return asUser(httptest.NewRequest(http.MethodGet, "/", nil), userID, roles...)
+}
+
+func TestNewUsersAreCustomers(t *testing.T) {
+	setupTestDB(t)
+
+	rec := httptest.NewRecorder()
+	usersRouter(rec, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"name":"Alice","email":"alice@example.com"}`)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	if roles := getRoles(t, "1"); len(roles) != 1 || roles[0] != authz.RoleCustomer {
+		t.Errorf("expected [customer], got %v", roles)
+	}
+}
+
+func TestAdminSetsRoles(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&[]User{{Name: "Admin", Email: "admin@example.com"}, {Name: "Bob", Email: "bob@example.com"}})
+
+	rec := putRoles(t, "2", `{"roles":["customer","support"]}`, identity(1, authz.RoleAdmin))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if roles := getRoles(t, "2"); len(roles) != 2 || roles[0] != authz.RoleCustomer || roles[1] != authz.RoleSupport {
+		t.Errorf("expected [customer support], got %v", roles)
+	}
+
+	token, err := issueToken(User{ID: 2, Email: "bob@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims := decodeClaims(t, token); len(claims.Roles) != 2 {
+		t.Errorf("expected the new roles in Bob's next token, got %v", claims.Roles)
+	}
+}
+
+func TestSetRolesValidation(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&[]User{{Name: "Admin", Email: "admin@example.com"}, {Name: "Bob", Email: "bob@example.com"}})
+
+	tests := []struct {
+		name string
+		id   string
+		body string
+		as   *http.Request
+		want int
+	}{
+		{"unknown role", "2", `{"roles":["superuser"]}`, identity(1, authz.RoleAdmin), http.StatusBadRequest},
+		{"service is not grantable", "2", `{"roles":["service"]}`, identity(1, authz.RoleAdmin), http.StatusBadRequest},
+		{"unknown user", "99", `{"roles":["customer"]}`, identity(1, authz.RoleAdmin), http.StatusNotFound},
+		{"dropping own admin", "1", `{"roles":["customer"]}`, identity(1, authz.RoleAdmin), http.StatusConflict},
+		{"not an admin", "2", `{"roles":["admin"]}`, identity(2, authz.RoleSupport), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := putRoles(t, tt.id, tt.body, tt.as); rec.Code != tt.want {
+				t.Errorf("expected %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestUserPermissions(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&[]User{{Name: "Alice", Email: "alice@example.com"}, {Name: "Bob", Email: "bob@example.com"}})
+
+	service := httptest.NewRequest(http.MethodGet, "/", nil)
+	service.Header.Set(authz.HeaderServiceName, "orderservice")
+
+	tests := []struct {
+		name   string
+		as     *http.Request
+		method string
+		path   string
+		want   int
+	}{
+		{"anonymous", httptest.NewRequest(http.MethodGet, "/", nil), http.MethodGet, "/users/1", http.StatusUnauthorized},
+		{"self", identity(1), http.MethodGet, "/users/1", http.StatusOK},
+		{"someone else", identity(2), http.MethodGet, "/users/1", http.StatusForbidden},
+		{"customer lists users", identity(1), http.MethodGet, "/users", http.StatusForbidden},
+		{"support lists users", identity(2, authz.RoleSupport), http.MethodGet, "/users", http.StatusOK},
+		{"catalog admin reads a user", identity(2, authz.RoleCatalogAdmin), http.MethodGet, "/users/1", http.StatusForbidden},
+		{"service reads a user", service, http.MethodGet, "/users/1", http.StatusOK},
+		{"service can't delete", service, http.MethodDelete, "/users/1", http.StatusForbidden},
+		{"support can't delete", identity(2, authz.RoleSupport), http.MethodDelete, "/users/1", http.StatusForbidden},
+		{"self reads own roles", identity(1), http.MethodGet, "/users/1/roles", http.StatusOK},
+		{"unknown route", identity(1, authz.RoleAdmin), http.MethodGet, "/users/1/friends", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Header = tt.as.Header
+			rec := httptest.NewRecorder()
+			usersRouter(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}
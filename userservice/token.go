@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Tokens are EdDSA (Ed25519) JWTs signed with the newest SigningKey. A
+// new key is made every keyRotationInterval; older keys stay published in
+// the JWKS until every token they signed has expired, then are deleted.
+const (
+	tokenIssuer         = "userservice"
+	tokenTTL            = time.Hour
+	keyRotationInterval = 24 * time.Hour
+	keyRetention        = keyRotationInterval + tokenTTL
+)
+
+// SigningKey maps to the "signing_keys" table. PrivateKey is the Ed25519
+// seed; it never leaves this service.
+type SigningKey struct {
+	ID         string `gorm:"primaryKey;size:32"`
+	PrivateKey []byte `gorm:"not null"`
+	PublicKey  []byte `gorm:"not null"`
+	CreatedAt  time.Time
+}
+
+// tokenClaims is the JWT payload. Sub is the user ID as a string, as the
+// JWT spec requires.
+type tokenClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// tokenResponse is the body of a successful POST /auth/login.
+type tokenResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int    `json:"expires_in"`
+	User      User   `json:"user"`
+}
+
+// jwk is one entry of the JWKS (RFC 8037 OKP key).
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// rotateSigningKeys makes a new signing key if the newest is due for
+// rotation (or there is none) and deletes keys past retention.
+func rotateSigningKeys(db *gorm.DB) error {
+	now := time.Now()
+	var newest SigningKey
+	err := db.Order("created_at DESC").First(&newest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || err == nil && now.Sub(newest.CreatedAt) >= keyRotationInterval {
+		if _, err := newSigningKey(db); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return db.Where("created_at < ?", now.Add(-keyRetention)).Delete(&SigningKey{}).Error
+}
+
+func newSigningKey(db *gorm.DB) (SigningKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	key := SigningKey{ID: hex.EncodeToString(id), PrivateKey: priv.Seed(), PublicKey: pub}
+	return key, db.Create(&key).Error
+}
+
+// runKeyRotation checks for rotation hourly. Replicas share the table, so
+// one of them rotating is enough; if two rotate at once the newer key
+// wins and the other is simply retired with the rest.
+func runKeyRotation() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := rotateSigningKeys(db); err != nil {
+			log.Printf("failed to rotate signing keys: %v", err)
+		}
+	}
+}
+
+// issueToken signs a token for user, carrying their roles, with the
+// newest key.
+func issueToken(user User) (string, error) {
+	var key SigningKey
+	if err := db.Order("created_at DESC").First(&key).Error; err != nil {
+		return "", err
+	}
+	roles, err := userRoles(db, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "typ": "JWT", "kid": key.ID})
+	claims, _ := json.Marshal(tokenClaims{
+		Issuer:    tokenIssuer,
+		Subject:   strconv.Itoa(user.ID),
+		Email:     user.Email,
+		Roles:     roles,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tokenTTL).Unix(),
+	})
+
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(key.PrivateKey), []byte(signingInput))
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+// jwksHandler handles GET /.well-known/jwks.json, publishing every key
+// whose tokens may still be valid.
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var keys []SigningKey
+	if err := db.Order("created_at DESC").Find(&keys).Error; err != nil {
+		http.Error(w, "Failed to load keys", http.StatusInternalServerError)
+		return
+	}
+
+	set := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, jwk{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(k.PublicKey),
+			KeyID:     k.ID,
+			Use:       "sig",
+			Algorithm: "EdDSA",
+		})
+	}
+
+	// Short enough that a verifier picks up a new key well before it's
+	// used for anything but brand-new tokens.
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
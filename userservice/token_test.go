@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"shared/authz"
+)
+
+func fetchJWKS(t *testing.T) []jwk {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	jwksHandler(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var set struct{ Keys []jwk }
+	if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	return set.Keys
+}
+
+// decodeClaims returns a token's payload without checking the signature.
+func decodeClaims(t *testing.T, token string) tokenClaims {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	var claims tokenClaims
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		t.Fatalf("undecodable claims in %q", token)
+	}
+	return claims
+}
+
+func TestIssuedTokenVerifiesAgainstJWKS(t *testing.T) {
+	setupTestDB(t)
+	db.Create(&User{Name: "Alice", Email: "alice@example.com"})
+	db.Create(&UserRole{UserID: 1, Role: authz.RoleAdmin})
+
+	token, err := issueToken(User{ID: 1, Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a three-part JWT, got %q", token)
+	}
+
+	var header map[string]string
+	raw, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(raw, &header)
+	if header["alg"] != "EdDSA" || header["kid"] == "" {
+		t.Fatalf("unexpected header %v", header)
+	}
+
+	var key jwk
+	for _, k := range fetchJWKS(t) {
+		if k.KeyID == header["kid"] {
+			key = k
+		}
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		t.Fatalf("JWKS has no usable key %q", header["kid"])
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		t.Fatal("signature doesn't verify against the published key")
+	}
+
+	claims := decodeClaims(t, token)
+	if claims.Subject != "1" || claims.Email != "alice@example.com" || claims.Issuer != tokenIssuer ||
+		len(claims.Roles) != 1 || claims.Roles[0] != authz.RoleAdmin {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if claims.ExpiresAt-claims.IssuedAt != int64(tokenTTL.Seconds()) {
+		t.Errorf("expected a %s lifetime, got %+v", tokenTTL, claims)
+	}
+}
+
+func TestRotateSigningKeys(t *testing.T) {
+	setupTestDB(t)
+	if keys := fetchJWKS(t); len(keys) != 1 {
+		t.Fatalf("expected one key after setup, got %d", len(keys))
+	}
+
+	// Not due yet: nothing changes.
+	rotateSigningKeys(db)
+	if keys := fetchJWKS(t); len(keys) != 1 {
+		t.Fatalf("expected no rotation before the interval, got %d keys", len(keys))
+	}
+
+	// Due: a new key signs from now on, and the old one stays published.
+	db.Model(&SigningKey{}).Where("1 = 1").Update("created_at", time.Now().Add(-keyRotationInterval))
+	rotateSigningKeys(db)
+	keys := fetchJWKS(t)
+	if len(keys) != 2 {
+		t.Fatalf("expected old and new keys published, got %d", len(keys))
+	}
+	token, _ := issueToken(User{ID: 1})
+	raw, _ := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if !strings.Contains(string(raw), keys[0].KeyID) {
+		t.Errorf("expected the newest key %s to sign, header %s", keys[0].KeyID, raw)
+	}
+
+	// Past retention the old key is dropped.
+	db.Model(&SigningKey{}).Where("id = ?", keys[1].KeyID).Update("created_at", time.Now().Add(-keyRetention-time.Minute))
+	rotateSigningKeys(db)
+	if keys := fetchJWKS(t); len(keys) != 1 {
+		t.Errorf("expected the retired key to be removed, got %d keys", len(keys))
+	}
+}